@@ -1,13 +1,20 @@
 package arch
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"code.google.com/p/go-uuid/uuid"
 	"github.com/influx6/composelab/routes"
+	"github.com/influx6/composelab/trace"
 	"github.com/influx6/evroll"
 	"github.com/influx6/goutils"
 	"github.com/influx6/grids"
@@ -41,10 +48,24 @@ type Linkage interface {
 	Register(string, *LinkDescriptor, func(...interface{})) error
 	Unregister(string, *LinkDescriptor, func(...interface{})) error
 	Request(string, string, io.Reader, func(...interface{}), func(...interface{})) error
+	Providers(string, func(string, []*LinkDescriptor, interface{})) error
 	Dial()
 	End()
 }
 
+//Connected is implemented by links which can tell whether their last Dial connected,
+//links which do not implement it are taken to be connected once dialed
+type Connected interface {
+	Connected() bool
+}
+
+//MaxDatagram is the largest udp pack a datagram carries, udp links and services read
+//datagrams of up to 64KiB and refuse to send packs larger than this
+const MaxDatagram = 65507
+
+//ErrDatagramTooLarge is returned when an encoded udp pack is larger than MaxDatagram
+var ErrDatagramTooLarge = fmt.Errorf("udp pack is larger than the %d bytes a datagram carries", MaxDatagram)
+
 //UDPPack represents a standard json udp message
 type UDPPack struct {
 	Path    string       `json:"path"`
@@ -52,6 +73,8 @@ type UDPPack struct {
 	UUID    string       `json:"uuid"`
 	Data    []byte       `json:"data"`
 	Address *net.UDPAddr `json:"address"`
+	Trace   string       `json:"trace,omitempty"`
+	Span    string       `json:"span,omitempty"`
 	// Visited []*net.UDPAddr `json:"visited"`
 }
 
@@ -63,13 +86,22 @@ func NewUDPPack(path, service, uuid string, data []byte, addr *net.UDPAddr) *UDP
 		uuid,
 		data,
 		addr,
+		"",
+		"",
 	}
 }
 
 //UDPPackFrom creates a new udp packet from a previous one with only the data
 //and addr changed
 func UDPPackFrom(u *UDPPack, data []byte, addr *net.UDPAddr) *UDPPack {
-	return NewUDPPack(u.Path, u.Service, u.UUID, data, addr)
+	pack := NewUDPPack(u.Path, u.Service, u.UUID, data, addr)
+	pack.Trace, pack.Span = u.Trace, u.Span
+	return pack
+}
+
+//TraceContext returns the trace context the udp pack carries
+func (u *UDPPack) TraceContext() trace.Context {
+	return trace.Context{TraceID: u.Trace, SpanID: u.Span}
 }
 
 //MarshalJSON returns the json byte version of the LinkDescriptor
@@ -78,14 +110,29 @@ func UDPPackFrom(u *UDPPack, data []byte, addr *net.UDPAddr) *UDPPack {
 // 	return lb, err
 // }
 
+//DefaultRequestTimeout is the time a service gives its route handlers to answer a request
+var DefaultRequestTimeout = 30 * time.Second
+
 //Service is the base struct defining attributes of a service
 type Service struct {
 	*grids.Grid
-	descrptior *LinkDescriptor
-	Master     Linkage
-	Slaves     *goutils.Map
-	registry   *goutils.Map
-	Route      *routes.Routes
+	descrptior     *LinkDescriptor
+	Master         Linkage
+	Slaves         *goutils.Map
+	registry       map[string][]*LinkDescriptor
+	Route          *routes.Routes
+	RequestTimeout time.Duration
+	Factory        *Factory
+	Tracer         *trace.Tracer
+	Log            Logger
+	timeouts       int64
+	forwards       *goutils.Map
+	regLock        sync.RWMutex
+	measured       map[measure]bool
+	failing        map[string]bool
+	changes        []RegistryChange
+	changeSeq      int64
+	changed        chan struct{}
 }
 
 //LinkDescriptor provides basic level description for links
@@ -106,6 +153,25 @@ type LinkDescriptor struct {
 // 	return lb, err
 // }
 
+//RoutePath builds the path to a route the service published under the name, filling
+//its pattern segments from params
+func (l *LinkDescriptor) RoutePath(name string, params map[string]string) (string, error) {
+	var template string
+
+	switch rs := l.Misc["routes"].(type) {
+	case map[string]string:
+		template = rs[name]
+	case map[string]interface{}:
+		template, _ = rs[name].(string)
+	}
+
+	if template == "" {
+		return "", fmt.Errorf("%s has not published a route named %s", l.Service, name)
+	}
+
+	return routes.BuildPath(template, params)
+}
+
 //NewDescriptor creates a new LinkDescriptor
 func NewDescriptor(proto string, name string, addr string, port int, zone string, scheme string) *LinkDescriptor {
 	return &LinkDescriptor{
@@ -124,6 +190,15 @@ func NewDescriptor(proto string, name string, addr string, port int, zone string
 type ServiceLink struct {
 	*evroll.Streams
 	desc *LinkDescriptor
+	Log  Logger
+}
+
+//Logger returns the logger of the link or the DefaultLogger if it was given none
+func (s *ServiceLink) Logger() Logger {
+	if s.Log == nil {
+		return DefaultLogger
+	}
+	return s.Log
 }
 
 //GetDescriptor is an empty for handling service link dialing
@@ -149,6 +224,11 @@ func (s *ServiceLink) Request(f string, target string, bd io.Reader, before func
 	return nil
 }
 
+//Providers is an empty for handling service link provider listing
+func (s *ServiceLink) Providers(f string, b func(s string, providers []*LinkDescriptor, res interface{})) error {
+	return nil
+}
+
 //Register is an empty for handling service link registeration for master operations
 func (s *ServiceLink) Register(sm string, m *LinkDescriptor, cf func(sets ...interface{})) error {
 	return nil
@@ -159,6 +239,12 @@ func (s *ServiceLink) Unregister(sm string, m *LinkDescriptor, cf func(sets ...i
 	return nil
 }
 
+//RoutePath builds the path of a route published by the linked service under the name,
+//for use as the path of a Request
+func (s *ServiceLink) RoutePath(name string, params map[string]string) (string, error) {
+	return s.desc.RoutePath(name, params)
+}
+
 //GetUUID returns the UUID string of the service link
 func (s *ServiceLink) GetUUID() string {
 	return s.desc.UUID
@@ -166,6 +252,9 @@ func (s *ServiceLink) GetUUID() string {
 
 //GetPrefix returns the prefix of the service link
 func (s *ServiceLink) GetPrefix() string {
+	if mount, ok := s.desc.Misc["mount"].(string); ok && mount != "" {
+		return mount
+	}
 	return s.desc.Service
 }
 
@@ -189,52 +278,214 @@ func NewServiceLink(d *LinkDescriptor) *ServiceLink {
 	return &ServiceLink{
 		evroll.NewStream(false, false),
 		d,
+		nil,
 	}
 }
 
-//NewService creates a new service struct
-func NewService(desc *LinkDescriptor, master Linkage) *Service {
+//ServiceOption sets up a service before it registers with its master
+type ServiceOption func(*Service)
+
+//WithLogger gives the service its logger, so failing to register with its master is
+//logged to it
+func WithLogger(log Logger) ServiceOption {
+	return func(s *Service) {
+		s.Log = log
+	}
+}
+
+//NewService creates a new service struct, the options are applied before it registers
+//with its master
+func NewService(desc *LinkDescriptor, master Linkage, opts ...ServiceOption) *Service {
 	sv := &Service{
 		grids.NewGrid(desc.Service),
 		desc,
 		master,
 		goutils.NewMap(),
+		make(map[string][]*LinkDescriptor),
+		routes.NewRoutes(desc.Service, false),
+		DefaultRequestTimeout,
+		nil,
+		nil,
+		nil,
+		0,
 		goutils.NewMap(),
-		routes.NewRoutes(desc.Service),
+		sync.RWMutex{},
+		make(map[measure]bool),
+		make(map[string]bool),
+		nil,
+		0,
+		make(chan struct{}),
 	}
 
-	sv.Route.Branch("discover")
-	sv.Route.Branch("register")
-	sv.Route.Branch("unregister")
-	sv.Route.Branch("api")
+	sv.Route.NotFound(NotFound)
+	sv.Route.Branch("discover/*service", false)
+	sv.Route.Branch("providers/*service", false)
+	sv.Route.Branch("register", false)
+	sv.Route.Branch("unregister", false)
+	sv.Route.Branch("api", false)
 
-	if sv.Master != nil {
-		err := sv.Master.Register(desc.Service, sv.GetDescriptor(), func(d ...interface{}) {
-			//maybe
-		})
-
-		if err != nil {
-			log.Fatal("unable to register with master:", desc.Service, err)
-		}
+	for _, opt := range opts {
+		opt(sv)
+	}
 
+	if err := sv.JoinMaster(); err != nil {
+		sv.Logger().Error("unable to register with master", Fields{"service": desc.Service, "err": err})
 	}
 
 	return sv
 }
 
+//JoinMaster registers the service's descriptor with its master, services register
+//when they are created and failures are logged so JoinMaster can be called again
+//to retry
+func (s *Service) JoinMaster() error {
+	if s.Master == nil {
+		return nil
+	}
+
+	return s.Master.Register(s.descrptior.Service, s.descrptior, func(d ...interface{}) {})
+}
+
+//Logger returns the logger of the service or the DefaultLogger if it was given none
+func (s *Service) Logger() Logger {
+	if s.Log == nil {
+		return DefaultLogger
+	}
+	return s.Log
+}
+
 //GetDescriptor is an empty for handling service link dialing
 func (s *Service) GetDescriptor() *LinkDescriptor {
 	return s.descrptior
 }
 
-//Divert provides a shortcut member funcs to call Divert on the Service Route
+//PublishRoutes adds the templates of the service's named routes to its descriptor
+//under the 'routes' misc key and registers the descriptor again with the master
+func (s *Service) PublishRoutes() error {
+	s.descrptior.Misc["routes"] = s.Route.Names()
+	return s.JoinMaster()
+}
+
+//IntrospectionPath is the reserved path services expose their route tree on
+var IntrospectionPath = "_routes"
+
+//ExposeRoutes adds the IntrospectionPath route which answers with the service's
+//route tree as json
+func (s *Service) ExposeRoutes() {
+	s.Route.Branch(IntrospectionPath, false)
+
+	rt, err := s.Route.Select(IntrospectionPath)
+
+	if err != nil {
+		return
+	}
+
+	rt.Terminal().Only(routes.ByPackets(func(p *grids.GridPacket) {
+		bin, err := s.Route.DescribeJSON()
+
+		if err != nil {
+			Reply(p, 500, []byte(err.Error()))
+			return
+		}
+
+		Reply(p, 200, bin)
+	}))
+}
+
+//RegistryPath is the reserved path services expose their registry on
+var RegistryPath = "_registry"
+
+//Registry returns a copy of the providers registered with the service by the name of
+//the service they provide
+func (s *Service) Registry() map[string][]*LinkDescriptor {
+	s.regLock.RLock()
+	defer s.regLock.RUnlock()
+
+	reg := make(map[string][]*LinkDescriptor, len(s.registry))
+
+	for name, providers := range s.registry {
+		reg[name] = append([]*LinkDescriptor(nil), providers...)
+	}
+
+	return reg
+}
+
+//ExposeRegistry adds the RegistryPath route which answers with the service's registry
+//as json and the RegistryPath/changes/{since} route which streams its changes, each
+//read answering with the changes after since as RegistryChanges
+func (s *Service) ExposeRegistry() {
+	s.Route.Branch(RegistryPath, false)
+
+	rt, err := s.Route.Select(RegistryPath)
+
+	if err != nil {
+		return
+	}
+
+	rt.Terminal().Only(routes.ByPackets(func(p *grids.GridPacket) {
+		bin, err := json.Marshal(s.Registry())
+
+		if err != nil {
+			ReplyError(p, err)
+			return
+		}
+
+		Reply(p, 200, bin)
+	}))
+
+	s.exposeRegistryChanges()
+}
+
+//Divert provides a shortcut member funcs to call Divert on the Service Route,
+//requests the service's routes reject are tried on the service diverted to before
+//being answered by the service's NotFound handler
 func (s *Service) Divert(sm *Service) {
 	_ = s.Route.Divert(sm.Route)
 }
 
+//Mount serves the routes of another service under the prefix of these service's routes,
+//letting several services share one listener. The mounted service's descriptor is
+//given these service's location with the path it is mounted at as its 'mount' misc
+//key, which links use as their prefix, and it is registered again with its master
+func (s *Service) Mount(prefix string, sm *Service) error {
+	if err := s.Route.Mount(prefix, sm.Route); err != nil {
+		return err
+	}
+
+	desc := sm.GetDescriptor()
+	desc.Address = s.descrptior.Address
+	desc.Port = s.descrptior.Port
+	desc.Proto = s.descrptior.Proto
+	desc.Scheme = s.descrptior.Scheme
+	desc.Misc["mount"] = strings.Join(append([]string{s.descrptior.Service}, goutils.SplitPattern(prefix)...), "/")
+
+	return sm.JoinMaster()
+}
+
+//Trace records spans of the requests the service takes and makes with the exporter,
+//the service's routes record a route span for every request and the service's
+//forwards, pipelines and scatters record a link span for every provider request.
+//Exporters given to a service which already traces get the spans as well
+func (s *Service) Trace(exporter trace.Exporter) *trace.Tracer {
+	if s.Tracer != nil {
+		s.Tracer.AddExporter(exporter)
+		return s.Tracer
+	}
+
+	s.Tracer = trace.NewTracer(s.descrptior.Service, exporter)
+	s.Route.Trace(s.Tracer)
+	return s.Tracer
+}
+
+//NotFound replaces the handler answering requests which neither the service's routes
+//nor the services it diverts to take, the default answers with a 404 error body
+func (s *Service) NotFound(fx func(*grids.GridPacket)) {
+	s.Route.NotFound(fx)
+}
+
 //Branch provides a shortcut member funcs to call Branch on the Service Route
 func (s *Service) Branch(path string) {
-	s.Route.Branch(path)
+	s.Route.Branch(path, false)
 }
 
 //Select provides a shortcut member funcs to call Select on the Service Route
@@ -242,6 +493,22 @@ func (s *Service) Select(path string) (*routes.Routes, error) {
 	return s.Route.Select(path)
 }
 
+//NewDeadline returns a new request deadline using the service's RequestTimeout
+func (s *Service) NewDeadline(parent context.Context) *routes.Deadline {
+	return routes.NewDeadline(parent, s.RequestTimeout)
+}
+
+//RecordTimeout records a request which was not answered before its deadline
+func (s *Service) RecordTimeout(path string) {
+	atomic.AddInt64(&s.timeouts, 1)
+	s.Logger().Warn("request timed out", Fields{"service": s.ServiceName(), "path": path})
+}
+
+//Timeouts returns the total requests which ran past their deadline
+func (s *Service) Timeouts() int64 {
+	return atomic.LoadInt64(&s.timeouts)
+}
+
 //GetPath returns the path of the service
 func (s *Service) GetPath() string {
 	return fmt.Sprintf("%s:%d", s.GetAddress(), s.GetPort())
@@ -273,47 +540,115 @@ func (s *Service) Location() string {
 	return fmt.Sprintf("%s@%s", s.ServiceName(), s.GetPath())
 }
 
-//Register adds a servicelink into the services connection pool
+//Register adds a servicelink into the services connection pool, a service can have
+//many providers and a provider registering again with the same uuid updates its descriptor
 func (s *Service) Register(serviceName string, meta *LinkDescriptor) {
-	if !s.registry.Has(serviceName) {
-		s.registry.Set(serviceName, meta)
+	s.regLock.Lock()
+	defer s.regLock.Unlock()
+
+	providers := s.registry[serviceName]
+	updated := make([]*LinkDescriptor, 0, len(providers)+1)
+
+	for _, m := range providers {
+		if m.UUID != meta.UUID {
+			updated = append(updated, m)
+		}
 	}
+
+	s.registry[serviceName] = append(updated, meta)
+	s.changeRegistry("register", serviceName, meta)
 }
 
 //Unregister removes a servicelink from the services connection pool
 func (s *Service) Unregister(serviceName string, meta *LinkDescriptor) {
-	if s.HasRegistered(serviceName) {
-		m, err := s.GetServiceProvider(serviceName)
+	s.regLock.Lock()
+	defer s.regLock.Unlock()
 
-		if err != nil {
-			return
-		}
+	providers := s.registry[serviceName]
+	updated := make([]*LinkDescriptor, 0, len(providers))
 
-		if m.UUID == meta.UUID {
-			s.registry.Remove(serviceName)
+	for _, m := range providers {
+		if m.UUID != meta.UUID {
+			updated = append(updated, m)
 		}
 	}
+
+	s.dropForward(meta.UUID, nil)
+	delete(s.failing, meta.UUID)
+
+	if len(updated) < len(providers) {
+		s.changeRegistry("unregister", serviceName, meta)
+	}
+
+	if len(updated) <= 0 {
+		delete(s.registry, serviceName)
+		return
+	}
+
+	s.registry[serviceName] = updated
 }
 
 //HasRegistered checks whether a particular service of a specific serviceName is registered
 //and if supplied checks whether there exists a provider with the uuid
 func (s *Service) HasRegistered(serviceName string) bool {
-	return s.registry.Has(serviceName)
+	s.regLock.RLock()
+	defer s.regLock.RUnlock()
+
+	_, ok := s.registry[serviceName]
+	return ok
+}
+
+//RegisteredServices returns the names of the services with registered providers
+func (s *Service) RegisteredServices() []string {
+	s.regLock.RLock()
+	defer s.regLock.RUnlock()
+
+	names := make([]string, 0, len(s.registry))
+
+	for name := range s.registry {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
 }
 
-//GetServiceProvider returns a goutils.Map containing register services under the
-//serviceName provided and supplies a secondary error argument to indicate
-//error
+//HasProvider checks whether the provider with the uuid is registered for the service
+func (s *Service) HasProvider(serviceName, uuid string) bool {
+	providers, _ := s.GetServiceProviders(serviceName)
+
+	for _, m := range providers {
+		if m.UUID == uuid {
+			return true
+		}
+	}
+
+	return false
+}
+
+//GetServiceProvider returns the first registered provider of the service and
+//supplies a secondary error argument to indicate error
 func (s *Service) GetServiceProvider(serviceName string) (*LinkDescriptor, error) {
-	if !s.registry.Has(serviceName) {
-		return nil, fmt.Errorf("%s not found", serviceName)
+	providers, err := s.GetServiceProviders(serviceName)
+
+	if err != nil {
+		return nil, err
 	}
 
-	li, ok := s.registry.Get(serviceName).(*LinkDescriptor)
+	return providers[0], nil
+}
 
-	if !ok {
-		return nil, fmt.Errorf("%s unable to convert to LinkDescriptor %v", serviceName, li)
+//GetServiceProviders returns every registered provider of the service in the order
+//they registered
+func (s *Service) GetServiceProviders(serviceName string) ([]*LinkDescriptor, error) {
+	s.regLock.RLock()
+	defer s.regLock.RUnlock()
+
+	providers, ok := s.registry[serviceName]
+
+	if !ok || len(providers) <= 0 {
+		return nil, fmt.Errorf("%s not found", serviceName)
 	}
 
-	return li, nil
+	return providers, nil
 }
@@ -1,11 +1,28 @@
 package arch
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/franela/goblin"
+	"github.com/influx6/composelab/metrics"
+	"github.com/influx6/composelab/routes"
+	"github.com/influx6/grids"
 )
 
+type refusingMaster struct {
+	*ServiceLink
+}
+
+func (r *refusingMaster) Register(string, *LinkDescriptor, func(...interface{})) error {
+	return errors.New("master refused")
+}
+
 func TestArch(t *testing.T) {
 	g := goblin.Goblin(t)
 
@@ -28,5 +45,271 @@ func TestArch(t *testing.T) {
 			g.Assert(d.Address).Eql(sm.GetAddress())
 			g.Assert(d.Port).Eql(sm.GetPort())
 		})
+
+		g.It("can i build paths from published route names", func() {
+			d := NewDescriptor("uup", "models", "0.0.0.0", 3002, "0", "")
+			d.Misc["routes"] = map[string]interface{}{"model": `models/{id:[\d]+}`}
+			link := NewServiceLink(d)
+
+			path, err := link.RoutePath("model", map[string]string{"id": "3"})
+			g.Assert(err == nil).IsTrue("path was built")
+			g.Assert(path).Eql("models/3")
+
+			_, err = link.RoutePath("missing", nil)
+			g.Assert(err != nil).IsTrue("unknown names fail")
+		})
+
+		g.It("can a service have many providers", func() {
+			master := NewService(NewDescriptor("uup", "master", "0.0.0.0", 3005, "0", ""), nil)
+			one := NewDescriptor("http", "models", "10.0.0.1", 80, "0", "http")
+			two := NewDescriptor("http", "models", "10.0.0.2", 80, "0", "http")
+
+			master.Register("models", one)
+			master.Register("models", two)
+			master.Register("models", one)
+
+			providers, err := master.GetServiceProviders("models")
+			g.Assert(err == nil).IsTrue("providers found")
+			g.Assert(len(providers)).Eql(2)
+			g.Assert(master.HasProvider("models", two.UUID)).IsTrue()
+
+			master.Unregister("models", one)
+			g.Assert(master.HasRegistered("models")).IsTrue()
+			g.Assert(master.HasProvider("models", one.UUID)).IsFalse()
+
+			master.Unregister("models", two)
+			g.Assert(master.HasRegistered("models")).IsFalse()
+		})
+
+		g.It("can registry changes be streamed", func() {
+			master := NewService(NewDescriptor("uup", "master", "0.0.0.0", 3006, "0", ""), nil)
+			master.ExposeRegistry()
+			master.Route.SetSync(true)
+			one := NewDescriptor("http", "models", "10.0.0.1", 80, "0", "http")
+
+			first, changed := master.RegistryChanges(-1)
+			g.Assert(first.Registry != nil).IsTrue("the first read is sent the registry")
+
+			master.Register("models", one)
+			master.Unregister("models", one)
+			master.Unregister("models", one)
+
+			select {
+			case <-changed:
+			default:
+				g.Assert(false).IsTrue("readers were not woken")
+			}
+
+			replies := make(chan []byte, 1)
+
+			master.Route.IssueRequestPath("master/_registry/changes/0", func(p *grids.GridPacket) {
+				p.Set("Reply", Replier(func(st int, bd []byte) error {
+					g.Assert(st).Eql(200)
+					replies <- bd
+					return nil
+				}))
+			})
+
+			body := <-replies
+
+			rc := new(RegistryChanges)
+			g.Assert(json.Unmarshal(body, rc) == nil).IsTrue(string(body))
+			g.Assert(rc.Seq).Eql(int64(2))
+			g.Assert(len(rc.Changes)).Eql(2)
+			g.Assert(rc.Changes[0].Event).Eql("register")
+			g.Assert(rc.Changes[1].Event).Eql("unregister")
+			g.Assert(rc.Changes[1].Provider.UUID).Eql(one.UUID)
+
+			start := time.Now()
+			waited := master.WaitRegistryChanges(2, 50*time.Millisecond, nil)
+			g.Assert(len(waited.Changes)).Eql(0)
+			g.Assert(time.Since(start) >= 50*time.Millisecond).IsTrue("the read waited for a change")
+
+			max := MaxRegistryChanges
+			MaxRegistryChanges = 1
+			defer func() { MaxRegistryChanges = max }()
+
+			master.Register("models", one)
+			master.Register("logs", one)
+			missed, _ := master.RegistryChanges(1)
+			g.Assert(missed.Registry != nil).IsTrue("readers which fell behind are sent the registry")
+			g.Assert(len(missed.Registry)).Eql(2)
+		})
+
+		g.It("can i mount a service under another", func() {
+			gw := NewService(NewDescriptor("http", "gateway", "10.0.0.1", 80, "0", "http"), nil)
+			models := NewService(NewDescriptor("http", "models", "10.0.0.2", 3004, "0", "http"), nil)
+
+			g.Assert(gw.Mount("models", models) == nil).IsTrue("service was mounted")
+			g.Assert(models.GetAddress()).Eql("10.0.0.1")
+			g.Assert(models.GetPort()).Eql(80)
+			g.Assert(NewServiceLink(models.GetDescriptor()).GetPrefix()).Eql("gateway/models")
+		})
+
+		g.It("can unknown paths be answered with a 404", func() {
+			d := NewDescriptor("uup", "logs", "0.0.0.0", 3003, "0", "")
+			sm := NewService(d, nil)
+			sm.Route.SetSync(true)
+
+			var status int
+			var body []byte
+
+			sm.Route.IssueRequestPath("logs/missing", func(p *grids.GridPacket) {
+				p.Set("Reply", Replier(func(st int, bd []byte) error {
+					status, body = st, bd
+					return nil
+				}))
+			})
+
+			g.Assert(status).Eql(404)
+
+			code, msg, ok := ParseErrorBody(body)
+			g.Assert(ok).IsTrue("body is an error body")
+			g.Assert(code).Eql(404)
+			g.Assert(msg).Eql("no route for /logs/missing")
+		})
+
+		g.It("can a service expose its metrics", func() {
+			d := NewDescriptor("uup", "stats", "0.0.0.0", 3004, "0", "")
+			sm := NewService(d, nil)
+			sm.Route.SetSync(true)
+			sm.Register("models", NewDescriptor("uup", "models", "0.0.0.0", 3005, "0", ""))
+
+			reg := metrics.NewRegistry()
+			sm.ExposeMetrics(reg)
+
+			reply := func(p *grids.GridPacket) {
+				p.Set("Reply", Replier(func(st int, bd []byte) error { return nil }))
+			}
+
+			sm.Route.IssueRequestPath("stats/missing", reply)
+
+			var body []byte
+
+			sm.Route.IssueRequestPath("stats/"+MetricsPath, func(p *grids.GridPacket) {
+				p.Set("Reply", Replier(func(st int, bd []byte) error {
+					body = bd
+					return nil
+				}))
+			})
+
+			text := string(body)
+			g.Assert(strings.Contains(text, `composelab_registry_providers{service="stats",target="models"} 1`)).IsTrue(text)
+			g.Assert(strings.Contains(text, `composelab_route_requests_total{service="stats",route="unmatched",status="404"} 1`)).IsTrue(text)
+		})
+
+		g.It("can a service be measured with the same registry more than once", func() {
+			d := NewDescriptor("uup", "twice", "0.0.0.0", 3008, "0", "")
+			sm := NewService(d, nil)
+			sm.Route.SetSync(true)
+			sm.Register("models", NewDescriptor("uup", "models", "0.0.0.0", 3009, "0", ""))
+
+			reg := metrics.NewRegistry()
+			sm.Measure(reg)
+			sm.ExposeMetrics(reg)
+			sm.ExposeMetrics(reg)
+
+			sm.Route.IssueRequestPath("twice/missing", func(p *grids.GridPacket) {
+				p.Set("Reply", Replier(func(st int, bd []byte) error { return nil }))
+			})
+
+			var replies int
+			var body []byte
+
+			sm.Route.IssueRequestPath("twice/"+MetricsPath, func(p *grids.GridPacket) {
+				p.Set("Reply", Replier(func(st int, bd []byte) error {
+					replies++
+					body = bd
+					return nil
+				}))
+			})
+
+			text := string(body)
+			g.Assert(replies).Eql(1)
+			g.Assert(strings.Count(text, `composelab_registry_providers{service="twice",target="models"}`)).Eql(1)
+			g.Assert(strings.Contains(text, `composelab_route_requests_total{service="twice",route="unmatched",status="404"} 1`)).IsTrue(text)
+		})
+
+		g.It("can a logger write leveled entries with fields", func() {
+			var buf bytes.Buffer
+			lg := NewStdLogger(&buf, WarnLevel)
+
+			lg.Info("skipped", nil)
+			lg.Warn("invalid udp pack", Fields{"err": "bad json", "addr": "127.0.0.1:4000"})
+
+			line := buf.String()
+			g.Assert(strings.Contains(line, "skipped")).IsFalse(line)
+			g.Assert(strings.HasSuffix(line, `warn invalid udp pack addr=127.0.0.1:4000 err="bad json"`+"\n")).IsTrue(line)
+		})
+
+		g.It("can a service outlive a master refusing it", func() {
+			var buf bytes.Buffer
+			defer func(lg Logger) { DefaultLogger = lg }(DefaultLogger)
+			DefaultLogger = NewStdLogger(&buf, DebugLevel)
+
+			master := &refusingMaster{NewServiceLink(NewDescriptor("uup", "master", "0.0.0.0", 3006, "0", ""))}
+			sm := NewService(NewDescriptor("uup", "orphan", "0.0.0.0", 3007, "0", ""), master)
+
+			g.Assert(strings.Contains(buf.String(), `error unable to register with master err="master refused" service=orphan`)).IsTrue(buf.String())
+
+			sm.Log = NopLogger{}
+			g.Assert(sm.JoinMaster() != nil).IsTrue("join fails")
+			g.Assert(sm.PublishRoutes() != nil).IsTrue("publish fails")
+		})
+
+		g.It("can a service log a refused registration to the logger it was given", func() {
+			var buf, fallback bytes.Buffer
+			defer func(lg Logger) { DefaultLogger = lg }(DefaultLogger)
+			DefaultLogger = NewStdLogger(&fallback, DebugLevel)
+
+			master := &refusingMaster{NewServiceLink(NewDescriptor("uup", "master", "0.0.0.0", 3006, "0", ""))}
+			NewService(NewDescriptor("uup", "orphan", "0.0.0.0", 3007, "0", ""), master, WithLogger(NewStdLogger(&buf, DebugLevel)))
+
+			g.Assert(strings.Contains(buf.String(), `error unable to register with master err="master refused" service=orphan`)).IsTrue(buf.String())
+			g.Assert(fallback.Len()).Eql(0)
+		})
+
+		g.It("can errors travel as error bodies and be decoded", func() {
+			sm := NewService(NewDescriptor("uup", "errs", "0.0.0.0", 3008, "0", ""), nil)
+			sm.Route.SetSync(true)
+			sm.Route.Branch("fail", false)
+
+			rt, _ := sm.Route.Select("fail")
+			rt.Terminal().Only(routes.ByPackets(func(p *grids.GridPacket) {
+				ReplyError(p, NewError(503, "models are down").With("service", "models"))
+			}))
+
+			var status int
+			var body []byte
+
+			sm.Route.IssueRequestPath("errs/fail", func(p *grids.GridPacket) {
+				p.Set("RequestID", "req-1")
+				p.Set("Reply", Replier(func(st int, bd []byte) error {
+					status, body = st, bd
+					return nil
+				}))
+			})
+
+			g.Assert(status).Eql(503)
+
+			e, ok := ParseError(body)
+			g.Assert(ok).IsTrue(string(body))
+			g.Assert(e.Code).Eql(503)
+			g.Assert(e.RequestID).Eql("req-1")
+			g.Assert(e.Retryable).IsTrue("503 is retryable")
+			g.Assert(e.Details["service"]).Eql("models")
+
+			err, ok := LinkError(NewUDPPack("errs/fail", "errs", "req-1", body, nil)).(*Error)
+			g.Assert(ok).IsTrue("udp replies decode to an *Error")
+			g.Assert(err.Message).Eql("models are down")
+
+			err, ok = LinkError([]byte("gone"), &http.Response{StatusCode: 410}).(*Error)
+			g.Assert(ok).IsTrue("plain http replies decode to an *Error")
+			g.Assert(err.Code).Eql(410)
+			g.Assert(err.Message).Eql("gone")
+			g.Assert(err.Retryable).IsFalse()
+
+			g.Assert(LinkError([]byte("{}"), &http.Response{StatusCode: 200}) == nil).IsTrue("success is not an error")
+		})
 	})
 }
@@ -0,0 +1,138 @@
+package arch
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/influx6/composelab/routes"
+	"github.com/influx6/grids"
+)
+
+//MaxRegistryChanges is the number of registry changes a service keeps for readers
+//of its change stream, readers which fall further behind are sent the registry
+var MaxRegistryChanges = 1024
+
+//RegistryWait is the longest a read of the registry changes is held open waiting for
+//a change
+var RegistryWait = 10 * time.Second
+
+//RegistryChange is a provider registered or unregistered with a service, numbered in
+//the order the registry changed
+type RegistryChange struct {
+	Seq      int64           `json:"seq"`
+	Event    string          `json:"event"`
+	Service  string          `json:"service"`
+	Provider *LinkDescriptor `json:"provider"`
+}
+
+//RegistryChanges is the answer to a read of the registry changes. Seq is the last
+//change the reader has seen once it has these, Registry is set instead of Changes
+//when the changes the reader missed are no longer kept
+type RegistryChanges struct {
+	Seq      int64                        `json:"seq"`
+	Changes  []RegistryChange             `json:"changes"`
+	Registry map[string][]*LinkDescriptor `json:"registry,omitempty"`
+}
+
+//changeRegistry records a registry change and wakes the readers waiting on it, the
+//regLock must be held
+func (s *Service) changeRegistry(event, serviceName string, meta *LinkDescriptor) {
+	s.changeSeq++
+	s.changes = append(s.changes, RegistryChange{s.changeSeq, event, serviceName, meta})
+
+	if over := len(s.changes) - MaxRegistryChanges; over > 0 {
+		s.changes = append([]RegistryChange(nil), s.changes[over:]...)
+	}
+
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+//RegistryChanges returns the registry changes after since and a chan closed at the
+//next change. The registry is returned instead when changes after since are no
+//longer kept
+func (s *Service) RegistryChanges(since int64) (*RegistryChanges, <-chan struct{}) {
+	s.regLock.RLock()
+	defer s.regLock.RUnlock()
+
+	rc := &RegistryChanges{Seq: s.changeSeq, Changes: []RegistryChange{}}
+
+	if since >= s.changeSeq {
+		return rc, s.changed
+	}
+
+	if len(s.changes) == 0 || since < s.changes[0].Seq-1 {
+		rc.Registry = make(map[string][]*LinkDescriptor, len(s.registry))
+
+		for name, providers := range s.registry {
+			rc.Registry[name] = append([]*LinkDescriptor(nil), providers...)
+		}
+
+		return rc, s.changed
+	}
+
+	for _, c := range s.changes {
+		if c.Seq > since {
+			rc.Changes = append(rc.Changes, c)
+		}
+	}
+
+	return rc, s.changed
+}
+
+//WaitRegistryChanges returns the registry changes after since, waiting up to wait for
+//one if there are none yet or until the cancel chan is closed
+func (s *Service) WaitRegistryChanges(since int64, wait time.Duration, cancel <-chan struct{}) *RegistryChanges {
+	rc, changed := s.RegistryChanges(since)
+
+	if rc.Seq > since || rc.Registry != nil {
+		return rc
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-changed:
+		rc, _ = s.RegistryChanges(since)
+	case <-timer.C:
+	case <-cancel:
+	}
+
+	return rc
+}
+
+//exposeRegistryChanges adds the RegistryPath/changes/{since:int} route which answers
+//with the registry changes after since, held open up to RegistryWait for a change
+func (s *Service) exposeRegistryChanges() {
+	path := RegistryPath + "/changes/{since:int}"
+	s.Route.Branch(path, false)
+
+	rt, err := s.Route.Select(RegistryPath + "/changes/since")
+
+	if err != nil {
+		return
+	}
+
+	rt.Terminal().Only(routes.ByPackets(func(p *grids.GridPacket) {
+		since, _ := routes.PacketParams(p).Get("since").(int)
+		wait := RegistryWait
+
+		//answer before the request deadline does
+		if dl, ok := routes.PacketDeadline(p); ok && dl.Remaining()/2 < wait {
+			wait = dl.Remaining() / 2
+		}
+
+		go func() {
+			rc := s.WaitRegistryChanges(int64(since), wait, routes.PacketContext(p).Done())
+			bin, err := json.Marshal(rc)
+
+			if err != nil {
+				ReplyError(p, err)
+				return
+			}
+
+			Reply(p, 200, bin)
+		}()
+	}))
+}
@@ -0,0 +1,303 @@
+package arch
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/influx6/composelab/routes"
+	"github.com/influx6/composelab/trace"
+	"github.com/influx6/grids"
+)
+
+//ErrNoFactory is returned when forwarding from a service without a Factory
+var ErrNoFactory = errors.New("service has no Factory to resolve links with")
+
+//ErrNoMaster is returned when forwarding from a service without a Master
+var ErrNoMaster = errors.New("service has no Master to discover providers with")
+
+//RequestID returns the id of a request packet from its 'RequestID' meta, the uuid of
+//its udp pack or the X-Request-UUID header of its http request, requests without one
+//are given a new id which is kept as their 'RequestID' meta
+func RequestID(p *grids.GridPacket) string {
+	if id, ok := p.Get("RequestID").(string); ok && id != "" {
+		return id
+	}
+
+	var id string
+
+	if u, ok := p.Get("Packet").(*UDPPack); ok {
+		id = u.UUID
+	} else if r, ok := p.Get("Req").(*http.Request); ok {
+		id = r.Header.Get("X-Request-UUID")
+	}
+
+	if id == "" {
+		id = uuid.New()
+	}
+
+	p.Set("RequestID", id)
+	return id
+}
+
+//RequestBody returns the body of a request packet from its 'Body' meta or its udp pack
+func RequestBody(p *grids.GridPacket) []byte {
+	if body, ok := p.Get("Body").([]byte); ok {
+		return body
+	}
+
+	if u, ok := p.Get("Packet").(*UDPPack); ok {
+		return u.Data
+	}
+
+	return nil
+}
+
+//Forward sends a request on to a provider of the target service, found through the
+//master and linked to with the service's Factory, and answers the request with the
+//provider's reply through its 'Reply' meta. The path is the provider's path below its
+//prefix and the request keeps its id. Links are kept per provider and reused till they
+//fail or the provider is unregistered
+func (s *Service) Forward(target, path string, p *grids.GridPacket) error {
+	return s.send(target, path, requestHop(p), RequestBody(p), func(status int, body []byte, err error) {
+		if err != nil {
+			failForward(p, err)
+			return
+		}
+
+		Reply(p, status, body)
+	})
+}
+
+//hop is what a request sent on to a provider keeps of the request it is made for
+type hop struct {
+	id    string
+	trace trace.Context
+}
+
+//requestHop returns the hop of requests made for the request packet
+func requestHop(p *grids.GridPacket) hop {
+	return hop{RequestID(p), routes.PacketTrace(p)}
+}
+
+//send discovers a provider of the target service and sends it the body under the
+//hop, the provider's reply or the error which stopped the request once the request
+//was under way is handed to reply
+func (s *Service) send(target, path string, h hop, body []byte, reply func(int, []byte, error)) error {
+	if s.Master == nil {
+		return ErrNoMaster
+	}
+
+	if s.Factory == nil {
+		return ErrNoFactory
+	}
+
+	return s.Master.Discover(target, func(_ string, data interface{}, meta interface{}) {
+		desc, ok := data.(*LinkDescriptor)
+
+		if !ok {
+			if err, ok := meta.(*Error); ok {
+				reply(0, nil, fmt.Errorf("discovering %s: %s", target, err.Message))
+				return
+			}
+
+			reply(0, nil, fmt.Errorf("%s discovered without a descriptor", target))
+			return
+		}
+
+		if err := s.sendTo(desc, path, h, body, reply); err != nil {
+			reply(0, nil, err)
+		}
+	})
+}
+
+//sendTo sends the body to the provider under the hop's request id and trace and hands
+//its reply to reply, errors stopping the request from being sent are returned. The
+//request is recorded as a link span when the service has a Tracer
+func (s *Service) sendTo(desc *LinkDescriptor, path string, h hop, body []byte, reply func(int, []byte, error)) error {
+	span := s.Tracer.Start(trace.LinkSpan, desc.Service+"/"+path, h.trace)
+	span.Set("target", desc.Service)
+	span.Set("provider", desc.UUID)
+	span.Set("request", h.id)
+
+	if span != nil {
+		h.trace = span.Context()
+	}
+
+	link, err := s.forwardLink(desc)
+
+	if err != nil {
+		span.Fail(err)
+		span.Finish()
+		s.markProvider(desc.UUID, false)
+		return err
+	}
+
+	var rd io.Reader
+
+	if len(body) > 0 {
+		rd = bytes.NewReader(body)
+	}
+
+	err = link.Request(path, desc.Service, rd, func(m ...interface{}) {
+		stampRequest(h, m...)
+	}, func(m ...interface{}) {
+		status, out, err := LinkReply(m...)
+
+		span.Set("status", strconv.Itoa(status))
+
+		if err == nil {
+			span.Fail(StatusError(status, out))
+		}
+
+		span.Fail(err)
+		span.Finish()
+		s.markProvider(desc.UUID, err == nil)
+		reply(status, out, err)
+	})
+
+	if err != nil {
+		span.Fail(err)
+		span.Finish()
+		s.markProvider(desc.UUID, false)
+		s.dropForward(desc.UUID, link)
+	}
+
+	return err
+}
+
+//markProvider records whether the last request the service sent the provider reached it
+func (s *Service) markProvider(uuid string, reached bool) {
+	s.regLock.Lock()
+	defer s.regLock.Unlock()
+
+	if reached {
+		delete(s.failing, uuid)
+		return
+	}
+
+	s.failing[uuid] = true
+}
+
+//HealthyProviders returns the registered providers of the service which the last
+//request this service forwarded, piped or scattered to them reached, providers it
+//has sent nothing are taken as healthy
+func (s *Service) HealthyProviders(serviceName string) []*LinkDescriptor {
+	providers, _ := s.GetServiceProviders(serviceName)
+
+	s.regLock.RLock()
+	defer s.regLock.RUnlock()
+
+	healthy := make([]*LinkDescriptor, 0, len(providers))
+
+	for _, desc := range providers {
+		if !s.failing[desc.UUID] {
+			healthy = append(healthy, desc)
+		}
+	}
+
+	return healthy
+}
+
+//forwardLink returns the link to the provider, resolving and dialing it the first time,
+//links which report they could not connect are ended and not kept
+func (s *Service) forwardLink(desc *LinkDescriptor) (Linkage, error) {
+	if link, ok := s.forwards.Get(desc.UUID).(Linkage); ok {
+		return link, nil
+	}
+
+	link, err := s.Factory.Resolve(desc)
+
+	if err != nil {
+		return nil, err
+	}
+
+	link.Dial()
+
+	if c, ok := link.(Connected); ok && !c.Connected() {
+		link.End()
+		return nil, fmt.Errorf("unable to dial provider %s of %s", desc.UUID, desc.Service)
+	}
+
+	s.forwards.Set(desc.UUID, link)
+	return link, nil
+}
+
+//dropForward ends and forgets the link kept for the provider if it is still the link
+//given, a nil link drops whichever link is kept
+func (s *Service) dropForward(uuid string, link Linkage) {
+	kept, ok := s.forwards.Get(uuid).(Linkage)
+
+	if !ok || (link != nil && kept != link) {
+		return
+	}
+
+	s.forwards.Remove(uuid)
+	kept.End()
+}
+
+//stampRequest gives the outgoing http request or udp pack the hop's request id and
+//trace context
+func stampRequest(h hop, m ...interface{}) {
+	if len(m) <= 0 {
+		return
+	}
+
+	switch out := m[0].(type) {
+	case *http.Request:
+		out.Header.Set("X-Request-UUID", h.id)
+		trace.Inject(out.Header, h.trace)
+	case *UDPPack:
+		out.UUID = h.id
+		out.Trace, out.Span = h.trace.TraceID, h.trace.SpanID
+	}
+}
+
+//LinkReply returns the status and body of the reply a http or udp link hands the
+//after callback of a Request, udp replies carrying an error body take the status of
+//the error
+func LinkReply(m ...interface{}) (int, []byte, error) {
+	if len(m) <= 0 {
+		return 0, nil, errors.New("provider sent no reply")
+	}
+
+	switch in := m[0].(type) {
+	case *UDPPack:
+		if e, ok := ParseError(in.Data); ok {
+			return e.Code, in.Data, nil
+		}
+
+		return 200, in.Data, nil
+	case []byte:
+		if len(m) > 1 {
+			if res, ok := m[1].(*http.Response); ok {
+				return res.StatusCode, in, nil
+			}
+		}
+
+		return 0, nil, fmt.Errorf("provider sent an invalid reply: %s", in)
+	default:
+		return 0, nil, fmt.Errorf("provider sent an unknown reply %v", in)
+	}
+}
+
+//LinkError returns the error of the reply a http or udp link hands the after callback
+//of a Request, an *Error if the provider answered with one and nil if it succeeded
+func LinkError(m ...interface{}) error {
+	status, body, err := LinkReply(m...)
+
+	if err != nil {
+		return err
+	}
+
+	return StatusError(status, body)
+}
+
+//failForward answers a request which could not be forwarded with a 502
+func failForward(p *grids.GridPacket, err error) {
+	ReplyError(p, NewError(502, err.Error()))
+}
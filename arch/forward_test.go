@@ -0,0 +1,193 @@
+package arch
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/franela/goblin"
+	"github.com/influx6/composelab/trace"
+	"github.com/influx6/grids"
+)
+
+//fakeMaster discovers a single provider or the provider kept for the service, and
+//lists the providers kept for a service
+type fakeMaster struct {
+	*ServiceLink
+	provider  *LinkDescriptor
+	services  map[string]*LinkDescriptor
+	providers map[string][]*LinkDescriptor
+}
+
+func (f *fakeMaster) Discover(target string, cb func(string, interface{}, interface{})) error {
+	if desc, ok := f.services[target]; ok {
+		cb(target, desc, nil)
+		return nil
+	}
+
+	cb(target, f.provider, nil)
+	return nil
+}
+
+func (f *fakeMaster) Providers(target string, cb func(string, []*LinkDescriptor, interface{})) error {
+	cb(target, f.providers[target], nil)
+	return nil
+}
+
+//fakeProvider answers udp requests with its answer to the body, or its path when it
+//has none, and never answers when silent. Requests return fails once answered and
+//the provider reports it is not connected when down
+type fakeProvider struct {
+	*ServiceLink
+	sent   *UDPPack
+	tries  int
+	silent bool
+	down   bool
+	fails  error
+	answer func(path string, body []byte) []byte
+}
+
+func (f *fakeProvider) Connected() bool {
+	return !f.down
+}
+
+func (f *fakeProvider) Request(path, target string, body io.Reader, before, after func(...interface{})) error {
+	var data []byte
+
+	if body != nil {
+		data, _ = ioutil.ReadAll(body)
+	}
+
+	f.tries++
+	f.sent = NewUDPPack(path, target, "new-id", data, nil)
+	before(f.sent, target)
+
+	if f.silent {
+		return f.fails
+	}
+
+	reply := []byte(`{"path":"` + path + `"}`)
+
+	if f.answer != nil {
+		reply = f.answer(path, data)
+	}
+
+	after(UDPPackFrom(f.sent, reply, nil), f.sent, target)
+	return f.fails
+}
+
+func TestForward(t *testing.T) {
+	g := goblin.Goblin(t)
+
+	g.Describe("Service forwarding", func() {
+
+		g.It("can a request be forwarded to a discovered provider", func() {
+			models := NewDescriptor("udp", "models", "127.0.0.1", 3010, "0", "udp4")
+			provider := &fakeProvider{ServiceLink: NewServiceLink(models)}
+
+			master := &fakeMaster{ServiceLink: NewServiceLink(NewDescriptor("udp", "master", "127.0.0.1", 3011, "0", "udp4")), provider: models}
+			sm := NewService(NewDescriptor("udp", "front", "127.0.0.1", 3012, "0", "udp4"), nil)
+			sm.Master = master
+			sm.Factory = NewFactory()
+			sm.Factory.Provide("udp", func(d *LinkDescriptor) (Linkage, error) {
+				return provider, nil
+			})
+
+			var status int
+			var reply []byte
+
+			p := grids.NewPacket()
+			p.Set("Packet", NewUDPPack("front/models", "front", "req-1", []byte("hello"), nil))
+			p.Set("Reply", Replier(func(st int, body []byte) error {
+				status, reply = st, body
+				return nil
+			}))
+
+			g.Assert(sm.Forward("models", "models/3", p) == nil).IsTrue("request forwarded")
+			g.Assert(provider.sent.UUID).Eql("req-1")
+			g.Assert(string(provider.sent.Data)).Eql("hello")
+			g.Assert(status).Eql(200)
+			g.Assert(string(reply)).Eql(`{"path":"models/3"}`)
+		})
+
+		g.It("can a forwarded request carry its trace and be recorded", func() {
+			models := NewDescriptor("udp", "models", "127.0.0.1", 3015, "0", "udp4")
+			provider := &fakeProvider{ServiceLink: NewServiceLink(models)}
+
+			sm := NewService(NewDescriptor("udp", "front", "127.0.0.1", 3016, "0", "udp4"), nil)
+			sm.Master = &fakeMaster{ServiceLink: NewServiceLink(NewDescriptor("udp", "master", "127.0.0.1", 3017, "0", "udp4")), provider: models}
+			sm.Factory = NewFactory()
+			sm.Factory.Provide("udp", func(d *LinkDescriptor) (Linkage, error) {
+				return provider, nil
+			})
+
+			var spans []*trace.Span
+			sm.Trace(trace.ExporterFunc(func(s *trace.Span) error {
+				spans = append(spans, s)
+				return nil
+			}))
+
+			p := grids.NewPacket()
+			p.Set("Trace", trace.Context{TraceID: "t1", SpanID: "s1"})
+			p.Set("Reply", Replier(func(st int, body []byte) error { return nil }))
+
+			g.Assert(sm.Forward("models", "models/3", p) == nil).IsTrue("request forwarded")
+			g.Assert(len(spans)).Eql(1)
+			g.Assert(spans[0].Kind).Eql(trace.LinkSpan)
+			g.Assert(spans[0].ParentID).Eql("s1")
+			g.Assert(spans[0].Attrs["status"]).Eql("200")
+			g.Assert(provider.sent.Trace).Eql("t1")
+			g.Assert(provider.sent.Span).Eql(spans[0].SpanID)
+		})
+
+		g.It("can links which did not dial or failed not be kept", func() {
+			models := NewDescriptor("udp", "models", "127.0.0.1", 3018, "0", "udp4")
+			provider := &fakeProvider{ServiceLink: NewServiceLink(models), down: true}
+			resolved := 0
+
+			sm := NewService(NewDescriptor("udp", "front", "127.0.0.1", 3019, "0", "udp4"), nil)
+			sm.Master = &fakeMaster{ServiceLink: NewServiceLink(NewDescriptor("udp", "master", "127.0.0.1", 3020, "0", "udp4")), provider: models}
+			sm.Factory = NewFactory()
+			sm.Factory.Provide("udp", func(d *LinkDescriptor) (Linkage, error) {
+				resolved++
+				return provider, nil
+			})
+
+			var status int
+			p := grids.NewPacket()
+			p.Set("Reply", Replier(func(st int, body []byte) error {
+				status = st
+				return nil
+			}))
+
+			sm.Forward("models", "models/3", p)
+			g.Assert(status).Eql(502)
+			g.Assert(sm.forwards.Has(models.UUID)).IsFalse("undialed link was not kept")
+
+			provider.down = false
+			provider.silent = true
+			provider.fails = errors.New("connection refused")
+			sm.Forward("models", "models/3", p)
+			g.Assert(resolved).Eql(2)
+			g.Assert(sm.forwards.Has(models.UUID)).IsFalse("failed link was dropped")
+
+			provider.silent = false
+			provider.fails = nil
+			sm.Forward("models", "models/3", p)
+			g.Assert(status).Eql(200)
+			g.Assert(sm.forwards.Has(models.UUID)).IsTrue("working link was kept")
+
+			sm.Register("models", models)
+			sm.Unregister("models", models)
+			g.Assert(sm.forwards.Has(models.UUID)).IsFalse("unregistered provider was dropped")
+		})
+
+		g.It("can forwarding without a factory fail", func() {
+			sm := NewService(NewDescriptor("udp", "front", "127.0.0.1", 3013, "0", "udp4"), nil)
+			sm.Master = &fakeMaster{ServiceLink: NewServiceLink(NewDescriptor("udp", "master", "127.0.0.1", 3014, "0", "udp4"))}
+
+			g.Assert(sm.Forward("models", "models", grids.NewPacket())).Eql(ErrNoFactory)
+		})
+	})
+}
@@ -0,0 +1,126 @@
+package arch
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+//Fields are the structured fields of a log entry
+type Fields map[string]interface{}
+
+//Logger logs leveled entries with structured fields, services and links log through
+//the Logger they are given and never end the process
+type Logger interface {
+	Debug(msg string, fields Fields)
+	Info(msg string, fields Fields)
+	Warn(msg string, fields Fields)
+	Error(msg string, fields Fields)
+}
+
+//Level is the severity of a log entry
+type Level int
+
+//The levels of log entries from the least to the most severe
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+//String returns the name of the level
+func (l Level) String() string {
+	switch l {
+	case DebugLevel:
+		return "debug"
+	case WarnLevel:
+		return "warn"
+	case ErrorLevel:
+		return "error"
+	default:
+		return "info"
+	}
+}
+
+//DefaultLogger is the logger of services and links which were not given one
+var DefaultLogger Logger = NewStdLogger(os.Stderr, InfoLevel)
+
+//StdLogger writes entries at or above its level through the standard log package as
+//a line of the level, message and fields in key order e.g
+//'2016/01/02 15:04:05 warn invalid udp pack addr=127.0.0.1:4000 err="bad json"'
+type StdLogger struct {
+	Level Level
+	out   *log.Logger
+}
+
+//NewStdLogger returns a logger writing entries at or above the level to the writer
+func NewStdLogger(w io.Writer, level Level) *StdLogger {
+	return &StdLogger{level, log.New(w, "", log.LstdFlags)}
+}
+
+//Debug logs a debug entry
+func (s *StdLogger) Debug(msg string, fields Fields) {
+	s.write(DebugLevel, msg, fields)
+}
+
+//Info logs an info entry
+func (s *StdLogger) Info(msg string, fields Fields) {
+	s.write(InfoLevel, msg, fields)
+}
+
+//Warn logs a warn entry
+func (s *StdLogger) Warn(msg string, fields Fields) {
+	s.write(WarnLevel, msg, fields)
+}
+
+//Error logs an error entry
+func (s *StdLogger) Error(msg string, fields Fields) {
+	s.write(ErrorLevel, msg, fields)
+}
+
+func (s *StdLogger) write(level Level, msg string, fields Fields) {
+	if level < s.Level {
+		return
+	}
+
+	keys := make([]string, 0, len(fields))
+
+	for key := range fields {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	line := []string{level.String(), msg}
+
+	for _, key := range keys {
+		val := fmt.Sprint(fields[key])
+
+		if strings.ContainsAny(val, " \"=") {
+			val = fmt.Sprintf("%q", val)
+		}
+
+		line = append(line, key+"="+val)
+	}
+
+	s.out.Println(strings.Join(line, " "))
+}
+
+//NopLogger drops every entry
+type NopLogger struct{}
+
+//Debug drops the entry
+func (NopLogger) Debug(string, Fields) {}
+
+//Info drops the entry
+func (NopLogger) Info(string, Fields) {}
+
+//Warn drops the entry
+func (NopLogger) Warn(string, Fields) {}
+
+//Error drops the entry
+func (NopLogger) Error(string, Fields) {}
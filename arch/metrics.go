@@ -0,0 +1,92 @@
+package arch
+
+import (
+	"github.com/influx6/composelab/metrics"
+	"github.com/influx6/composelab/routes"
+	"github.com/influx6/grids"
+)
+
+//MetricsPath is the reserved path services expose their metrics on
+var MetricsPath = "_metrics"
+
+//measure is a set of metrics added to a registry
+type measure struct {
+	reg *metrics.Registry
+	set string
+}
+
+//Measures marks the named set of metrics of the service as added to the registry, it
+//returns false if they already were so services and the types embedding them add
+//each of their sets once per registry
+func (s *Service) Measures(reg *metrics.Registry, set string) bool {
+	s.regLock.Lock()
+	defer s.regLock.Unlock()
+
+	key := measure{reg, set}
+
+	if s.measured[key] {
+		return false
+	}
+
+	s.measured[key] = true
+	return true
+}
+
+//Measure adds the metrics of the service to the registry, the requests its routes
+//take and the requests it sends to providers are counted and timed from their spans,
+//its registry is measured by the providers registered and the providers healthy per
+//service and its timeouts are counted. Services sharing a registry each add their own label sets and measuring
+//a service with the same registry again adds nothing
+func (s *Service) Measure(reg *metrics.Registry) {
+	if !s.Measures(reg, "service") {
+		return
+	}
+
+	name := s.descrptior.Service
+
+	s.Trace(metrics.NewSpanMetrics(reg))
+
+	reg.GaugeFunc("composelab_registry_providers", "Providers registered with a service by the service they provide.", func(set func(float64, ...string)) {
+		for _, target := range s.RegisteredServices() {
+			providers, _ := s.GetServiceProviders(target)
+			set(float64(len(providers)), name, target)
+		}
+	}, "service", "target")
+
+	reg.GaugeFunc("composelab_registry_healthy_providers", "Providers registered with a service which the last request the service sent them reached.", func(set func(float64, ...string)) {
+		for _, target := range s.RegisteredServices() {
+			set(float64(len(s.HealthyProviders(target))), name, target)
+		}
+	}, "service", "target")
+
+	reg.GaugeFunc("composelab_registry_services", "Services with providers registered with a service.", func(set func(float64, ...string)) {
+		set(float64(len(s.RegisteredServices())), name)
+	}, "service")
+
+	reg.CounterFunc("composelab_request_timeouts_total", "Requests which ran past their deadline.", func(set func(float64, ...string)) {
+		set(float64(s.Timeouts()), name)
+	}, "service")
+}
+
+//ExposeMetrics measures the service with the registry and adds the MetricsPath route
+//which answers with every metric of the registry in the prometheus text format, the
+//route is added once per registry
+func (s *Service) ExposeMetrics(reg *metrics.Registry) {
+	s.Measure(reg)
+
+	if !s.Measures(reg, "expose") {
+		return
+	}
+
+	s.Route.Branch(MetricsPath, false)
+
+	rt, err := s.Route.Select(MetricsPath)
+
+	if err != nil {
+		return
+	}
+
+	rt.Terminal().Only(routes.ByPackets(func(p *grids.GridPacket) {
+		Reply(p, 200, reg.Text())
+	}))
+}
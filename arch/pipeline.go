@@ -0,0 +1,402 @@
+package arch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/influx6/composelab/routes"
+	"github.com/influx6/grids"
+)
+
+//ErrStageTimeout is returned when a pipeline stage is not answered within its timeout
+var ErrStageTimeout = errors.New("stage timed out")
+
+//StageFailure says what a pipeline does when one of its stages fails, a stage fails
+//when its provider can not be reached, does not answer in time or answers with a
+//status of 400 or above
+type StageFailure int
+
+//The ways a pipeline can handle a failed stage
+const (
+	//FailPipeline answers the request with the error of the stage
+	FailPipeline StageFailure = iota
+	//SkipStage hands the input of the stage on to the next stage
+	SkipStage
+	//FallbackStage hands the stage's Fallback on to the next stage
+	FallbackStage
+)
+
+//String returns the name of the failure mode as used in pipeline configs
+func (f StageFailure) String() string {
+	switch f {
+	case SkipStage:
+		return "skip"
+	case FallbackStage:
+		return "fallback"
+	default:
+		return "fail"
+	}
+}
+
+//parseStageFailure returns the failure mode with the name, an empty name is 'fail'
+func parseStageFailure(name string) (StageFailure, error) {
+	switch name {
+	case "", "fail":
+		return FailPipeline, nil
+	case "skip":
+		return SkipStage, nil
+	case "fallback":
+		return FallbackStage, nil
+	default:
+		return FailPipeline, fmt.Errorf("unknown stage failure mode %q", name)
+	}
+}
+
+//Stage is a single step of a pipeline, the stage's input is sent as the body of a
+//request to the path of a provider of the service and the provider's reply is the
+//stage's output. A stage without a timeout has what is left of the request's deadline
+//or the RequestTimeout of the service running it and a stage which times out, fails
+//with a 5xx or a retryable error is tried again up to Retries times before its
+//OnError mode is used. The Fallback is a json value,
+//handed on as it is in Go and in pipeline configs
+type Stage struct {
+	Service  string
+	Path     string
+	Timeout  time.Duration
+	Retries  int
+	OnError  StageFailure
+	Fallback json.RawMessage
+}
+
+//NewStage returns a new stage sending requests to the path of the service
+func NewStage(service, path string) *Stage {
+	return &Stage{Service: service, Path: path}
+}
+
+//stageConfig is the json form of a stage
+type stageConfig struct {
+	Service  string          `json:"service"`
+	Path     string          `json:"path"`
+	Timeout  string          `json:"timeout,omitempty"`
+	Retries  int             `json:"retries,omitempty"`
+	OnError  string          `json:"on_error,omitempty"`
+	Fallback json.RawMessage `json:"fallback,omitempty"`
+}
+
+//MarshalJSON returns the json form of the stage with its timeout as a duration string
+func (st *Stage) MarshalJSON() ([]byte, error) {
+	conf := stageConfig{
+		Service:  st.Service,
+		Path:     st.Path,
+		Retries:  st.Retries,
+		OnError:  st.OnError.String(),
+		Fallback: st.Fallback,
+	}
+
+	if st.Timeout > 0 {
+		conf.Timeout = st.Timeout.String()
+	}
+
+	return json.Marshal(conf)
+}
+
+//UnmarshalJSON sets the stage from its json form e.g
+//{"service":"models","path":"models/list","timeout":"2s","on_error":"skip"}
+func (st *Stage) UnmarshalJSON(data []byte) error {
+	var conf stageConfig
+
+	if err := json.Unmarshal(data, &conf); err != nil {
+		return err
+	}
+
+	mode, err := parseStageFailure(conf.OnError)
+
+	if err != nil {
+		return err
+	}
+
+	var timeout time.Duration
+
+	if conf.Timeout != "" {
+		if timeout, err = time.ParseDuration(conf.Timeout); err != nil {
+			return fmt.Errorf("stage %s/%s: %s", conf.Service, conf.Path, err)
+		}
+	}
+
+	*st = Stage{
+		Service:  conf.Service,
+		Path:     conf.Path,
+		Timeout:  timeout,
+		Retries:  conf.Retries,
+		OnError:  mode,
+		Fallback: conf.Fallback,
+	}
+
+	return nil
+}
+
+//Pipeline chains requests to services, it is served on its path on a service and
+//the body of a request to it is the input of the first stage, the output of each
+//stage is the input of the next and the output of the last is the reply
+type Pipeline struct {
+	Name   string   `json:"name"`
+	Path   string   `json:"path"`
+	Stages []*Stage `json:"stages"`
+}
+
+//NewPipeline returns a new pipeline served on the path
+func NewPipeline(name, path string, stages ...*Stage) *Pipeline {
+	return &Pipeline{Name: name, Path: path, Stages: stages}
+}
+
+//Then adds a stage sending requests to the path of the service and returns it
+func (pl *Pipeline) Then(service, path string) *Stage {
+	st := NewStage(service, path)
+	pl.Stages = append(pl.Stages, st)
+	return st
+}
+
+//Validate returns an error if the pipeline has no path or stages or has a stage
+//without a service or path or with a Fallback which is not json
+func (pl *Pipeline) Validate() error {
+	if pl.Path == "" {
+		return fmt.Errorf("pipeline %s has no path", pl.Name)
+	}
+
+	if len(pl.Stages) <= 0 {
+		return fmt.Errorf("pipeline %s has no stages", pl.Name)
+	}
+
+	for i, st := range pl.Stages {
+		if st.Service == "" || st.Path == "" {
+			return fmt.Errorf("pipeline %s stage %d needs a service and a path", pl.Name, i)
+		}
+
+		if len(st.Fallback) > 0 && !json.Valid(st.Fallback) {
+			return fmt.Errorf("pipeline %s stage %d has a fallback which is not json", pl.Name, i)
+		}
+	}
+
+	return nil
+}
+
+//ParsePipelines returns the pipelines of a json list of pipelines e.g
+//[{"name":"pages","path":"pages","stages":[{"service":"models","path":"list"}]}]
+func ParsePipelines(data []byte) ([]*Pipeline, error) {
+	var pls []*Pipeline
+
+	if err := json.Unmarshal(data, &pls); err != nil {
+		return nil, err
+	}
+
+	for _, pl := range pls {
+		if err := pl.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	return pls, nil
+}
+
+//LoadPipelines returns the pipelines of a json file as read by ParsePipelines
+func LoadPipelines(file string) ([]*Pipeline, error) {
+	data, err := ioutil.ReadFile(file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return ParsePipelines(data)
+}
+
+//Pipe serves the pipelines on their paths on the service's routes
+func (s *Service) Pipe(pls ...*Pipeline) error {
+	for _, pl := range pls {
+		if err := pl.Validate(); err != nil {
+			return err
+		}
+
+		s.Route.Branch(pl.Path, false)
+
+		rt, err := s.Route.Select(pl.Path)
+
+		if err != nil {
+			return err
+		}
+
+		pipe := pl
+		rt.Terminal().Only(routes.ByPackets(func(p *grids.GridPacket) {
+			s.RunPipeline(pipe, p)
+		}))
+	}
+
+	return nil
+}
+
+//RunPipeline runs the stages of the pipeline one after the other with the body of the
+//request and answers the request with the output of the last stage through its 'Reply'
+//meta, every stage request keeps the id of the request
+func (s *Service) RunPipeline(pl *Pipeline, p *grids.GridPacket) {
+	h := requestHop(p)
+	input := RequestBody(p)
+	status := 200
+
+	for i, st := range pl.Stages {
+		code, out, err := s.runStage(st, h, input, p)
+
+		if err == nil && code < 400 {
+			status, input = code, out
+			continue
+		}
+
+		switch st.OnError {
+		case SkipStage:
+			continue
+		case FallbackStage:
+			input = st.Fallback
+			continue
+		}
+
+		ReplyError(p, stageError(pl, i, code, out, err))
+		return
+	}
+
+	Reply(p, status, input)
+}
+
+//runStage sends the input to the stage, trying it again up to the stage's Retries
+//times while it fails in a way which may pass when tried again
+func (s *Service) runStage(st *Stage, h hop, input []byte, p *grids.GridPacket) (status int, out []byte, err error) {
+	for try := 0; try <= st.Retries; try++ {
+		var timeout time.Duration
+
+		if timeout, err = s.stageTimeout(st, p); err != nil {
+			return
+		}
+
+		status, out, err = s.exchange(st.Service, st.Path, h, input, timeout)
+
+		if err == nil && status < 400 {
+			return
+		}
+
+		if !retryStage(status, out, err) {
+			return
+		}
+	}
+
+	return
+}
+
+//retryStage returns true if a stage which failed with the status and error may pass
+//when tried again, as stages which time out, fail with a 5xx or a retryable error do
+func retryStage(status int, out []byte, err error) bool {
+	if err == ErrStageTimeout {
+		return true
+	}
+
+	if err == nil {
+		err = StatusError(status, out)
+	}
+
+	e := AsError(err)
+	return e.Retryable || e.Code >= 500
+}
+
+//stageTimeout returns the time the stage has to answer, no more than what is left of
+//the request's deadline. It returns ErrStageTimeout once the deadline has passed
+func (s *Service) stageTimeout(st *Stage, p *grids.GridPacket) (time.Duration, error) {
+	timeout := st.Timeout
+
+	if timeout <= 0 {
+		timeout = s.RequestTimeout
+	}
+
+	dl, ok := routes.PacketDeadline(p)
+
+	if !ok {
+		return timeout, nil
+	}
+
+	if dl.Expired() {
+		return 0, ErrStageTimeout
+	}
+
+	//a deadline without a time set has -1 left
+	if left := dl.Remaining(); left != -1 {
+		if left <= 0 {
+			return 0, ErrStageTimeout
+		}
+
+		if timeout <= 0 || left < timeout {
+			timeout = left
+		}
+	}
+
+	return timeout, nil
+}
+
+//exchange sends the body to a provider of the target service and waits up to the
+//timeout for its reply
+func (s *Service) exchange(target, path string, h hop, body []byte, timeout time.Duration) (int, []byte, error) {
+	type result struct {
+		status int
+		body   []byte
+		err    error
+	}
+
+	done := make(chan result, 1)
+
+	err := s.send(target, path, h, body, func(status int, body []byte, err error) {
+		select {
+		case done <- result{status, body, err}:
+		default:
+		}
+	})
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var expired <-chan time.Time
+
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case res := <-done:
+		return res.status, res.body, res.err
+	case <-expired:
+		return 0, nil, ErrStageTimeout
+	}
+}
+
+//stageError returns the error a failed stage answers its pipeline's request with,
+//errors of the stage's provider are passed on as they are
+func stageError(pl *Pipeline, index, status int, body []byte, err error) *Error {
+	if e, ok := ParseError(body); ok && err == nil {
+		return e
+	}
+
+	st := pl.Stages[index]
+	where := fmt.Sprintf("pipeline %s stage %d (%s/%s)", pl.Name, index, st.Service, st.Path)
+
+	var e *Error
+
+	switch {
+	case err == ErrStageTimeout:
+		e = NewError(504, where+" timed out")
+	case err != nil:
+		e = NewError(502, fmt.Sprintf("%s failed: %s", where, err))
+	default:
+		e = NewError(status, fmt.Sprintf("%s failed with status %d", where, status))
+	}
+
+	return e.With("pipeline", pl.Name).With("stage", index)
+}
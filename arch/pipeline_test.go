@@ -0,0 +1,215 @@
+package arch
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/franela/goblin"
+	"github.com/influx6/composelab/routes"
+	"github.com/influx6/grids"
+)
+
+func TestPipeline(t *testing.T) {
+	g := goblin.Goblin(t)
+
+	upper := func(path string, body []byte) []byte {
+		return []byte(strings.ToUpper(string(body)))
+	}
+
+	wrap := func(path string, body []byte) []byte {
+		return []byte("<" + path + ">" + string(body))
+	}
+
+	broken := func(path string, body []byte) []byte {
+		return ErrorBody(500, "broken")
+	}
+
+	newFront := func(port int, links map[string]*fakeProvider) *Service {
+		master := &fakeMaster{ServiceLink: NewServiceLink(NewDescriptor("udp", "master", "127.0.0.1", port, "0", "udp4")), services: map[string]*LinkDescriptor{}}
+
+		for name := range links {
+			master.services[name] = NewDescriptor("udp", name, "127.0.0.1", port+1, "0", "udp4")
+		}
+
+		sm := NewService(NewDescriptor("udp", "front", "127.0.0.1", port+2, "0", "udp4"), nil)
+		sm.Master = master
+		sm.Factory = NewFactory()
+		sm.Factory.Provide("udp", func(d *LinkDescriptor) (Linkage, error) {
+			return links[d.Service], nil
+		})
+
+		return sm
+	}
+
+	run := func(sm *Service, pl *Pipeline, body string) (int, string) {
+		var status int
+		var reply []byte
+
+		p := grids.NewPacket()
+		p.Set("Packet", NewUDPPack("front/"+pl.Path, "front", "req-1", []byte(body), nil))
+		p.Set("Reply", Replier(func(st int, b []byte) error {
+			status, reply = st, b
+			return nil
+		}))
+
+		sm.RunPipeline(pl, p)
+		return status, string(reply)
+	}
+
+	g.Describe("Service pipelines", func() {
+
+		g.It("can each stage's output be the next stage's input", func() {
+			sm := newFront(3030, map[string]*fakeProvider{
+				"models": {answer: upper},
+				"views":  {answer: wrap},
+			})
+
+			pl := NewPipeline("pages", "pages")
+			pl.Then("models", "models/list")
+			pl.Then("views", "views/render")
+
+			status, reply := run(sm, pl, "hello")
+			g.Assert(status).Eql(200)
+			g.Assert(reply).Eql("<views/render>HELLO")
+		})
+
+		g.It("can a failed stage fail the pipeline with its error", func() {
+			sm := newFront(3033, map[string]*fakeProvider{
+				"models": {answer: broken},
+				"views":  {answer: wrap},
+			})
+
+			pl := NewPipeline("pages", "pages", NewStage("models", "list"), NewStage("views", "render"))
+
+			status, reply := run(sm, pl, "hello")
+			g.Assert(status).Eql(500)
+			code, msg, ok := ParseErrorBody([]byte(reply))
+			g.Assert(ok).IsTrue("reply is an error body")
+			g.Assert(code).Eql(500)
+			g.Assert(msg).Eql("broken")
+		})
+
+		g.It("can failed stages be skipped or fall back", func() {
+			sm := newFront(3036, map[string]*fakeProvider{
+				"models": {answer: broken},
+				"views":  {answer: wrap},
+			})
+
+			skip := NewStage("models", "list")
+			skip.OnError = SkipStage
+			status, reply := run(sm, NewPipeline("pages", "pages", skip, NewStage("views", "render")), "hello")
+			g.Assert(status).Eql(200)
+			g.Assert(reply).Eql("<render>hello")
+
+			fallback := NewStage("models", "list")
+			fallback.OnError = FallbackStage
+			fallback.Fallback = json.RawMessage(`"empty"`)
+			status, reply = run(sm, NewPipeline("pages", "pages", fallback, NewStage("views", "render")), "hello")
+			g.Assert(status).Eql(200)
+			g.Assert(reply).Eql(`<render>"empty"`)
+		})
+
+		g.It("can a stage time out and be retried", func() {
+			silent := &fakeProvider{silent: true}
+			sm := newFront(3039, map[string]*fakeProvider{"models": silent})
+
+			st := NewStage("models", "list")
+			st.Timeout = 10 * time.Millisecond
+			st.Retries = 2
+
+			status, _ := run(sm, NewPipeline("pages", "pages", st), "hello")
+			g.Assert(status).Eql(504)
+			g.Assert(silent.tries).Eql(3)
+		})
+
+		g.It("can only stages failing in ways which may pass be retried", func() {
+			failing := &fakeProvider{answer: broken}
+			missing := &fakeProvider{answer: func(path string, body []byte) []byte {
+				return ErrorBody(404, "no list")
+			}}
+			sm := newFront(3066, map[string]*fakeProvider{"models": failing, "views": missing})
+
+			st := NewStage("models", "list")
+			st.Retries = 2
+
+			status, _ := run(sm, NewPipeline("pages", "pages", st), "hello")
+			g.Assert(status).Eql(500)
+			g.Assert(failing.tries).Eql(3)
+
+			st = NewStage("views", "render")
+			st.Retries = 2
+
+			status, _ = run(sm, NewPipeline("pages", "pages", st), "hello")
+			g.Assert(status).Eql(404)
+			g.Assert(missing.tries).Eql(1)
+		})
+
+		g.It("can pipelines be read from json", func() {
+			pls, err := ParsePipelines([]byte(`[{"name":"pages","path":"pages/*rest","stages":[
+				{"service":"models","path":"list","timeout":"2s","retries":1},
+				{"service":"views","path":"render","on_error":"fallback","fallback":"none"}
+			]}]`))
+
+			g.Assert(err == nil).IsTrue("pipelines parsed")
+			g.Assert(len(pls)).Eql(1)
+			g.Assert(pls[0].Stages[0].Timeout).Eql(2 * time.Second)
+			g.Assert(pls[0].Stages[0].Retries).Eql(1)
+			g.Assert(pls[0].Stages[1].OnError).Eql(FallbackStage)
+			g.Assert(string(pls[0].Stages[1].Fallback)).Eql(`"none"`)
+
+			_, err = ParsePipelines([]byte(`[{"name":"pages","path":"pages","stages":[{"service":"models","path":"list","on_error":"ignore"}]}]`))
+			g.Assert(err == nil).IsFalse("unknown failure mode rejected")
+
+			_, err = ParsePipelines([]byte(`[{"name":"pages","path":"pages"}]`))
+			g.Assert(err == nil).IsFalse("pipeline without stages rejected")
+		})
+
+		g.It("can pipelines built in go be written to json and read back", func() {
+			st := NewStage("models", "list")
+			st.Timeout = 2 * time.Second
+			st.Retries = 1
+			st.OnError = FallbackStage
+			st.Fallback = json.RawMessage(`{"items":[]}`)
+
+			pl := NewPipeline("pages", "pages", st)
+			data, err := json.Marshal([]*Pipeline{pl})
+			g.Assert(err == nil).IsTrue("pipeline written")
+
+			pls, err := ParsePipelines(data)
+			g.Assert(err == nil).IsTrue("pipeline read back")
+			g.Assert(pls[0].Stages[0]).Eql(st)
+
+			st.Fallback = json.RawMessage("empty")
+			g.Assert(pl.Validate() == nil).IsFalse("fallback which is not json rejected")
+		})
+
+		g.It("can stages not be sent once the deadline has passed", func() {
+			provider := &fakeProvider{answer: upper}
+			sm := newFront(3045, map[string]*fakeProvider{"models": provider})
+
+			dl := routes.NewDeadline(nil, time.Millisecond)
+			time.Sleep(5 * time.Millisecond)
+
+			var status int
+			p := grids.NewPacket()
+			p.Set("Deadline", dl)
+			p.Set("Reply", Replier(func(st int, body []byte) error {
+				status = st
+				return nil
+			}))
+
+			sm.RunPipeline(NewPipeline("pages", "pages", NewStage("models", "list")), p)
+			g.Assert(status).Eql(504)
+			g.Assert(provider.tries).Eql(0)
+		})
+
+		g.It("can a pipeline be served on a service route", func() {
+			sm := newFront(3042, map[string]*fakeProvider{"models": {answer: upper}})
+
+			g.Assert(sm.Pipe(NewPipeline("pages", "pages", NewStage("models", "list")))).Eql(nil)
+			g.Assert(sm.Route.Has("pages")).IsTrue("pipeline route added")
+		})
+	})
+}
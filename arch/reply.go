@@ -0,0 +1,172 @@
+package arch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/influx6/composelab/routes"
+	"github.com/influx6/grids"
+)
+
+//ErrNoReplier is returned when replying to a packet no transport can answer
+var ErrNoReplier = errors.New("packet has no Reply meta")
+
+//Replier answers a request with a status and body over the transport the request
+//came in on, transports set it as the 'Reply' meta of the packets they issue
+type Replier func(status int, body []byte) error
+
+//Reply answers a request packet through its 'Reply' meta, the status is recorded on
+//the request's route span
+func Reply(p *grids.GridPacket, status int, body []byte) error {
+	routes.PacketSpan(p).Set("status", strconv.Itoa(status))
+
+	fx, ok := p.Get("Reply").(Replier)
+
+	if !ok {
+		return ErrNoReplier
+	}
+
+	return fx(status, body)
+}
+
+//Error is the error services answer failed requests with on every transport, it is
+//sent as the json error body
+//{"error":{"code":404,"message":"no route for /models/x","request_id":"...","retryable":false}}
+//as the body of http and websocket replies and the data of udp replies. Links decode
+//error bodies back into an *Error
+type Error struct {
+	Code      int                    `json:"code"`
+	Message   string                 `json:"message"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+	RequestID string                 `json:"request_id,omitempty"`
+	Retryable bool                   `json:"retryable"`
+}
+
+//NewError returns an error with the code and message, it is retryable if the code is
+//one a later attempt may not fail with
+func NewError(code int, message string) *Error {
+	return &Error{Code: code, Message: message, Retryable: RetryableStatus(code)}
+}
+
+//Error returns the code and message of the error
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d: %s", e.Code, e.Message)
+}
+
+//With adds a detail to the error and returns it
+func (e *Error) With(key string, value interface{}) *Error {
+	if e.Details == nil {
+		e.Details = make(map[string]interface{})
+	}
+	e.Details[key] = value
+	return e
+}
+
+//Body returns the json error body of the error
+func (e *Error) Body() []byte {
+	bin, _ := json.Marshal(errorBody{e})
+	return bin
+}
+
+//errorBody is the json error body services answer failed requests with
+type errorBody struct {
+	Error *Error `json:"error"`
+}
+
+//RetryableStatus returns true if a request failing with the status may succeed when
+//sent again, as with timeouts and unavailable or failing upstreams
+func RetryableStatus(code int) bool {
+	switch code {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+//AsError returns the error as an *Error, route halts keep their status and other
+//errors are a 500
+func AsError(err error) *Error {
+	switch e := err.(type) {
+	case *Error:
+		return e
+	case *routes.Halt:
+		return NewError(e.Status, e.Message)
+	}
+	return NewError(http.StatusInternalServerError, err.Error())
+}
+
+//StatusError returns the *Error of a reply with the status and body, error bodies are
+//decoded and other bodies become the message. It returns nil for statuses below 400
+func StatusError(status int, body []byte) error {
+	if status < 400 {
+		return nil
+	}
+
+	if e, ok := ParseError(body); ok {
+		return e
+	}
+
+	msg := strings.TrimSpace(string(body))
+
+	if msg == "" {
+		msg = http.StatusText(status)
+	}
+
+	return NewError(status, msg)
+}
+
+//ErrorBody returns the json error body of a new error with the status and message
+func ErrorBody(status int, message string) []byte {
+	return NewError(status, message).Body()
+}
+
+//ParseError returns the error of a json error body, ok is false if the body is not one
+func ParseError(body []byte) (*Error, bool) {
+	var eb errorBody
+
+	if err := json.Unmarshal(body, &eb); err != nil || eb.Error == nil || eb.Error.Code == 0 {
+		return nil, false
+	}
+
+	return eb.Error, true
+}
+
+//ParseErrorBody returns the status and message of a json error body, ok is false
+//if the body is not one
+func ParseErrorBody(body []byte) (status int, message string, ok bool) {
+	e, ok := ParseError(body)
+
+	if !ok {
+		return 0, "", false
+	}
+
+	return e.Code, e.Message, true
+}
+
+//ReplyError answers a request packet with the error body of the error, as made by
+//AsError, stamped with the id of the request
+func ReplyError(p *grids.GridPacket, err error) error {
+	e := *AsError(err)
+
+	if e.RequestID == "" {
+		e.RequestID = RequestID(p)
+	}
+
+	return Reply(p, e.Code, e.Body())
+}
+
+//NotFound answers requests which no route of a service takes with a 404 error body
+//through the request's 'Reply' meta or halts them with a 404 when it has none
+func NotFound(p *grids.GridPacket) {
+	paths, _ := p.Get("RequestPath").([]string)
+	msg := fmt.Sprintf("no route for /%s", strings.Join(paths, "/"))
+
+	if err := ReplyError(p, NewError(404, msg)); err == ErrNoReplier {
+		routes.HaltPacket(p, routes.NewHalt(404, msg))
+	}
+}
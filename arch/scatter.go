@@ -0,0 +1,305 @@
+package arch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/influx6/grids"
+)
+
+//ErrNoProviders is returned when a scatter finds no providers for its services
+var ErrNoProviders = errors.New("no providers to scatter to")
+
+//ErrNoReply is the error of providers which did not answer a scatter before its deadline
+var ErrNoReply = errors.New("provider did not answer before the deadline")
+
+//DefaultScatterDeadline is the deadline of scatters which do not set one
+var DefaultScatterDeadline = 10 * time.Second
+
+//Result is the reply of a single provider to a scattered request, Err is set when the
+//provider could not be reached, did not answer before the deadline or answered with a
+//status of 400 or above, as the *Error of its reply
+type Result struct {
+	Provider *LinkDescriptor
+	Status   int
+	Body     []byte
+	Err      error
+}
+
+//OK returns true if the provider answered successfully
+func (r *Result) OK() bool {
+	return r.Err == nil
+}
+
+//MergeFunc combines the successful results of a gather into the body of its reply
+type MergeFunc func(results []*Result) ([]byte, error)
+
+//Scatter sends a request to every provider of a set of services, found through the
+//master's registry, and gathers their replies. The gather ends at the Deadline or when
+//every provider has answered, or as soon as Quorum providers have answered when a
+//quorum is set. It succeeds when the quorum is met, when every provider answered or,
+//if Partial is set, when any provider answered
+type Scatter struct {
+	Services []string
+	Path     string
+	Deadline time.Duration
+	Quorum   int
+	Partial  bool
+	Merge    MergeFunc
+}
+
+//NewScatter returns a new scatter to the path of every provider of the services
+func NewScatter(path string, services ...string) *Scatter {
+	return &Scatter{Services: services, Path: path}
+}
+
+//Gathered holds the outcome of a scatter, a result per provider in the order the
+//providers were listed
+type Gathered struct {
+	Results []*Result
+}
+
+//Succeeded returns the results of the providers which answered successfully
+func (g *Gathered) Succeeded() []*Result {
+	var ok []*Result
+
+	for _, r := range g.Results {
+		if r.OK() {
+			ok = append(ok, r)
+		}
+	}
+
+	return ok
+}
+
+//Failed returns the results of the providers which failed or did not answer
+func (g *Gathered) Failed() []*Result {
+	var failed []*Result
+
+	for _, r := range g.Results {
+		if !r.OK() {
+			failed = append(failed, r)
+		}
+	}
+
+	return failed
+}
+
+//GatherError is returned when a gather does not get the replies its scatter needs
+type GatherError struct {
+	Needed    int
+	Succeeded int
+	Providers int
+}
+
+//Error returns the message of the gather error
+func (g *GatherError) Error() string {
+	return fmt.Sprintf("%d of %d providers answered, %d needed", g.Succeeded, g.Providers, g.Needed)
+}
+
+//Scatter sends the body to every provider of the scatter's services under the request
+//id and waits for their replies, the gathered results are returned with a
+//*GatherError if the scatter did not get the replies it needs
+func (s *Service) Scatter(sc *Scatter, id string, body []byte) (*Gathered, error) {
+	return s.scatter(sc, hop{id: id}, body)
+}
+
+//scatter sends the body to every provider of the scatter's services under the hop
+func (s *Service) scatter(sc *Scatter, h hop, body []byte) (*Gathered, error) {
+	deadline := sc.Deadline
+
+	if deadline <= 0 {
+		deadline = DefaultScatterDeadline
+	}
+
+	timer := time.NewTimer(deadline)
+	defer timer.Stop()
+
+	providers, err := s.scatterProviders(sc.Services, timer.C)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(providers) <= 0 {
+		return nil, ErrNoProviders
+	}
+
+	gathered := &Gathered{Results: make([]*Result, len(providers))}
+	replies := make(chan int, len(providers))
+
+	var lock sync.Mutex
+
+	for i, desc := range providers {
+		index, provider := i, desc
+		gathered.Results[i] = &Result{Provider: provider, Err: ErrNoReply}
+
+		//links may call back and still return an error, each provider is answered once
+		var once sync.Once
+
+		answer := func(status int, out []byte, err error) {
+			once.Do(func() {
+				if err == nil {
+					err = StatusError(status, out)
+				}
+
+				lock.Lock()
+				gathered.Results[index] = &Result{provider, status, out, err}
+				lock.Unlock()
+
+				replies <- index
+			})
+		}
+
+		if err := s.sendTo(provider, sc.Path, h, body, answer); err != nil {
+			answer(0, nil, err)
+		}
+	}
+
+	needed := sc.needed(len(providers))
+	answered, succeeded := 0, 0
+
+gather:
+	for answered < len(providers) {
+		select {
+		case index := <-replies:
+			answered++
+
+			lock.Lock()
+			ok := gathered.Results[index].OK()
+			lock.Unlock()
+
+			if ok {
+				succeeded++
+			}
+
+			if sc.Quorum > 0 && succeeded >= sc.Quorum {
+				break gather
+			}
+		case <-timer.C:
+			break gather
+		}
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	done := &Gathered{Results: append([]*Result(nil), gathered.Results...)}
+
+	if succeeded < needed {
+		return done, &GatherError{needed, succeeded, len(providers)}
+	}
+
+	return done, nil
+}
+
+//needed returns the successful replies the scatter needs from the providers
+func (sc *Scatter) needed(providers int) int {
+	switch {
+	case sc.Quorum > 0:
+		return sc.Quorum
+	case sc.Partial:
+		return 1
+	default:
+		return providers
+	}
+}
+
+//scatterProviders lists the providers of the services from the service's own registry
+//or through its master, waiting no longer than the deadline for the master
+func (s *Service) scatterProviders(services []string, deadline <-chan time.Time) ([]*LinkDescriptor, error) {
+	var providers []*LinkDescriptor
+
+	for _, name := range services {
+		if found, err := s.GetServiceProviders(name); err == nil {
+			providers = append(providers, found...)
+			continue
+		}
+
+		if s.Master == nil {
+			continue
+		}
+
+		listed := make(chan []*LinkDescriptor, 1)
+
+		err := s.Master.Providers(name, func(_ string, found []*LinkDescriptor, _ interface{}) {
+			select {
+			case listed <- found:
+			default:
+			}
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		select {
+		case found := <-listed:
+			providers = append(providers, found...)
+		case <-deadline:
+			return nil, fmt.Errorf("listing providers of %s timed out", name)
+		}
+	}
+
+	return providers, nil
+}
+
+//ScatterRequest scatters the body of the request to the providers of the scatter's
+//services and answers the request through its 'Reply' meta with the successful
+//results merged by the scatter's Merge or MergeJSON, a gather without the replies it
+//needs is answered with a 504 error body
+func (s *Service) ScatterRequest(sc *Scatter, p *grids.GridPacket) {
+	gathered, err := s.scatter(sc, requestHop(p), RequestBody(p))
+
+	if err != nil {
+		status := 502
+
+		if _, ok := err.(*GatherError); ok {
+			status = 504
+		}
+
+		ReplyError(p, NewError(status, err.Error()))
+		return
+	}
+
+	merge := sc.Merge
+
+	if merge == nil {
+		merge = MergeJSON
+	}
+
+	body, err := merge(gathered.Succeeded())
+
+	if err != nil {
+		ReplyError(p, err)
+		return
+	}
+
+	Reply(p, 200, body)
+}
+
+//MergeJSON merges the results into a json list of their bodies, bodies which are not
+//json are added as strings
+func MergeJSON(results []*Result) ([]byte, error) {
+	list := make([]json.RawMessage, 0, len(results))
+
+	for _, r := range results {
+		if json.Valid(r.Body) {
+			list = append(list, json.RawMessage(r.Body))
+			continue
+		}
+
+		str, err := json.Marshal(string(r.Body))
+
+		if err != nil {
+			return nil, err
+		}
+
+		list = append(list, str)
+	}
+
+	return json.Marshal(list)
+}
@@ -0,0 +1,187 @@
+package arch
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/franela/goblin"
+	"github.com/influx6/composelab/metrics"
+	"github.com/influx6/grids"
+)
+
+func TestScatter(t *testing.T) {
+	g := goblin.Goblin(t)
+
+	named := func(name string) func(string, []byte) []byte {
+		return func(path string, body []byte) []byte {
+			return []byte(`"` + name + `:` + string(body) + `"`)
+		}
+	}
+
+	//newGatherer returns a service with the providers in its registry under the service
+	//name before the dash of their key e.g 'search-1'
+	newGatherer := func(port int, links map[string]*fakeProvider) *Service {
+		sm := NewService(NewDescriptor("udp", "front", "127.0.0.1", port, "0", "udp4"), nil)
+		sm.Factory = NewFactory()
+
+		byUUID := map[string]*fakeProvider{}
+
+		for key, link := range links {
+			desc := NewDescriptor("udp", strings.Split(key, "-")[0], "127.0.0.1", port+1, "0", "udp4")
+			byUUID[desc.UUID] = link
+			sm.Register(desc.Service, desc)
+		}
+
+		sm.Factory.Provide("udp", func(d *LinkDescriptor) (Linkage, error) {
+			return byUUID[d.UUID], nil
+		})
+
+		return sm
+	}
+
+	g.Describe("Service scatter-gather", func() {
+
+		g.It("can a request be gathered from every provider of several services", func() {
+			sm := newGatherer(3050, map[string]*fakeProvider{
+				"search-1": {answer: named("a")},
+				"search-2": {answer: named("b")},
+				"index-1":  {answer: named("c")},
+			})
+
+			gathered, err := sm.Scatter(NewScatter("find", "search", "index"), "req-1", []byte("q"))
+			g.Assert(err == nil).IsTrue("every provider answered")
+			g.Assert(len(gathered.Results)).Eql(3)
+			g.Assert(len(gathered.Succeeded())).Eql(3)
+
+			var status int
+			var reply []byte
+
+			p := grids.NewPacket()
+			p.Set("Packet", NewUDPPack("front/find", "front", "req-2", []byte("q"), nil))
+			p.Set("Reply", Replier(func(st int, b []byte) error {
+				status, reply = st, b
+				return nil
+			}))
+
+			sm.ScatterRequest(NewScatter("find", "index"), p)
+			g.Assert(status).Eql(200)
+			g.Assert(string(reply)).Eql(`["c:q"]`)
+		})
+
+		g.It("can a gather fail, allow partial results or meet a quorum", func() {
+			sm := newGatherer(3053, map[string]*fakeProvider{
+				"search-1": {answer: named("a")},
+				"search-2": {silent: true},
+			})
+
+			sc := NewScatter("find", "search")
+			sc.Deadline = 20 * time.Millisecond
+
+			gathered, err := sm.Scatter(sc, "req-1", nil)
+			gerr, ok := err.(*GatherError)
+			g.Assert(ok).IsTrue("gather failed without every reply")
+			g.Assert(gerr.Succeeded).Eql(1)
+			g.Assert(len(gathered.Failed())).Eql(1)
+			g.Assert(gathered.Failed()[0].Err).Eql(ErrNoReply)
+
+			sc.Partial = true
+			gathered, err = sm.Scatter(sc, "req-1", nil)
+			g.Assert(err == nil).IsTrue("partial results accepted")
+			g.Assert(len(gathered.Succeeded())).Eql(1)
+
+			sc.Partial = false
+			sc.Quorum = 1
+			sc.Deadline = time.Minute
+
+			start := time.Now()
+			_, err = sm.Scatter(sc, "req-1", nil)
+			g.Assert(err == nil).IsTrue("quorum met")
+			g.Assert(time.Since(start) < time.Second).IsTrue("quorum ends the gather early")
+		})
+
+		g.It("can providers which reply and also fail be answered once", func() {
+			sm := newGatherer(3058, map[string]*fakeProvider{
+				"search-1": {answer: named("a"), fails: errors.New("body was cut short")},
+				"search-2": {silent: true},
+			})
+
+			sc := NewScatter("find", "search")
+			sc.Quorum = 2
+			sc.Deadline = 30 * time.Millisecond
+
+			gathered, err := sm.Scatter(sc, "req-1", []byte("q"))
+			gerr, ok := err.(*GatherError)
+			g.Assert(ok).IsTrue("the quorum was not met by one provider")
+			g.Assert(gerr.Succeeded).Eql(1)
+			g.Assert(len(gathered.Succeeded())).Eql(1)
+			g.Assert(string(gathered.Succeeded()[0].Body)).Eql(`"a:q"`)
+		})
+
+		g.It("can providers which could not be reached be measured as unhealthy", func() {
+			sm := newGatherer(3063, map[string]*fakeProvider{
+				"search-1": {answer: named("a")},
+				"search-2": {silent: true, fails: errors.New("connection refused")},
+			})
+
+			reg := metrics.NewRegistry()
+			sm.Measure(reg)
+
+			sc := NewScatter("find", "search")
+			sc.Partial = true
+			sm.Scatter(sc, "req-1", nil)
+
+			text := string(reg.Text())
+			g.Assert(strings.Contains(text, `composelab_registry_providers{service="front",target="search"} 2`)).IsTrue(text)
+			g.Assert(strings.Contains(text, `composelab_registry_healthy_providers{service="front",target="search"} 1`)).IsTrue(text)
+			g.Assert(len(sm.HealthyProviders("search"))).Eql(1)
+		})
+
+		g.It("can results be merged with a custom merge", func() {
+			sm := newGatherer(3056, map[string]*fakeProvider{
+				"search-1": {answer: named("a")},
+				"search-2": {answer: named("b")},
+			})
+
+			sc := NewScatter("find", "search")
+			sc.Merge = func(results []*Result) ([]byte, error) {
+				var bodies []string
+				for _, r := range results {
+					bodies = append(bodies, string(r.Body))
+				}
+				return []byte(strings.Join(bodies, "+")), nil
+			}
+
+			var reply []byte
+			p := grids.NewPacket()
+			p.Set("Reply", Replier(func(st int, b []byte) error {
+				reply = b
+				return nil
+			}))
+
+			sm.ScatterRequest(sc, p)
+			g.Assert(strings.Contains(string(reply), `"a:"`)).IsTrue("first provider merged")
+			g.Assert(strings.Contains(string(reply), `"b:"`)).IsTrue("second provider merged")
+		})
+
+		g.It("can providers be listed through the master", func() {
+			search := &fakeProvider{answer: named("a")}
+			desc := NewDescriptor("udp", "search", "127.0.0.1", 3060, "0", "udp4")
+
+			sm := NewService(NewDescriptor("udp", "front", "127.0.0.1", 3061, "0", "udp4"), nil)
+			sm.Master = &fakeMaster{ServiceLink: NewServiceLink(NewDescriptor("udp", "master", "127.0.0.1", 3062, "0", "udp4")), providers: map[string][]*LinkDescriptor{"search": {desc}}}
+			sm.Factory = NewFactory()
+			sm.Factory.Provide("udp", func(d *LinkDescriptor) (Linkage, error) {
+				return search, nil
+			})
+
+			gathered, err := sm.Scatter(NewScatter("find", "search"), "req-1", []byte("q"))
+			g.Assert(err == nil).IsTrue("provider listed by the master")
+			g.Assert(string(gathered.Results[0].Body)).Eql(`"a:q"`)
+
+			_, err = sm.Scatter(NewScatter("find", "missing"), "req-1", nil)
+			g.Assert(err).Eql(ErrNoProviders)
+		})
+	})
+}
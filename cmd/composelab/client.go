@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/influx6/composelab/arch"
+	"github.com/influx6/composelab/links"
+)
+
+//errTimeout is returned when a master or service does not answer in time
+var errTimeout = errors.New("no reply in time")
+
+//masterLink returns a dialed link to the master at the address, written as
+//scheme://host:port/name where the scheme is http, https or udp and name is the
+//service the master serves its routes under, 'master' if left out
+func masterLink(addr string) (arch.Linkage, error) {
+	u, err := url.Parse(addr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	host, rawPort, err := net.SplitHostPort(u.Host)
+
+	if err != nil {
+		return nil, fmt.Errorf("master %s: %s", addr, err)
+	}
+
+	port, err := strconv.Atoi(rawPort)
+
+	if err != nil {
+		return nil, fmt.Errorf("master %s: bad port %q", addr, rawPort)
+	}
+
+	name := strings.Trim(u.Path, "/")
+
+	if name == "" {
+		name = "master"
+	}
+
+	var link arch.Linkage
+
+	switch u.Scheme {
+	case "http":
+		link = links.NewHTTPLink(name, host, port)
+	case "https":
+		link = links.NewSecureHTTPLink(name, host, port, &http.Transport{})
+	case "udp":
+		ul, err := links.NewUDPLink(name, host, port)
+
+		if err != nil {
+			return nil, err
+		}
+
+		link = ul
+	default:
+		return nil, fmt.Errorf("master %s: unknown scheme %q", addr, u.Scheme)
+	}
+
+	link.Dial()
+	return link, nil
+}
+
+//call sends a request with fx and waits up to the timeout for the reply it hands to
+//done, http links answer before fx returns and udp links answer later
+func call(timeout time.Duration, fx func(done func(...interface{})) error) ([]interface{}, error) {
+	replies := make(chan []interface{}, 1)
+
+	err := fx(func(m ...interface{}) {
+		select {
+		case replies <- m:
+		default:
+		}
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case m := <-replies:
+		return m, nil
+	case <-time.After(timeout):
+		return nil, errTimeout
+	}
+}
+
+//request sends a request for the path to the service over the link and returns the
+//body of its reply, replies with an error status are returned as their *arch.Error
+func request(link arch.Linkage, path, service string, timeout time.Duration) ([]byte, error) {
+	m, err := call(timeout, func(done func(...interface{})) error {
+		return link.Request(path, service, nil, func(...interface{}) {}, done)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	status, body, err := arch.LinkReply(m...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := arch.StatusError(status, body); err != nil {
+		return nil, err
+	}
+
+	return body, nil
+}
+
+//registry requests the registry of the master
+func registry(link arch.Linkage, timeout time.Duration) (map[string][]*arch.LinkDescriptor, error) {
+	body, err := request(link, arch.RegistryPath, link.GetPrefix(), timeout)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var reg map[string][]*arch.LinkDescriptor
+
+	if err := json.Unmarshal(body, &reg); err != nil {
+		return nil, fmt.Errorf("invalid registry: %s", err)
+	}
+
+	return reg, nil
+}
+
+//registryChanges reads the registry changes of the master after since, the master
+//holds the read open up to arch.RegistryWait for a change
+func registryChanges(link arch.Linkage, since int64, timeout time.Duration) (*arch.RegistryChanges, error) {
+	path := fmt.Sprintf("%s/changes/%d", arch.RegistryPath, since)
+	body, err := request(link, path, link.GetPrefix(), timeout)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rc := new(arch.RegistryChanges)
+
+	if err := json.Unmarshal(body, rc); err != nil {
+		return nil, fmt.Errorf("invalid registry changes: %s", err)
+	}
+
+	return rc, nil
+}
+
+//writeTable writes the providers of the registry as a table sorted by service
+func writeTable(w io.Writer, reg map[string][]*arch.LinkDescriptor) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SERVICE\tPROTO\tADDRESS\tPORT\tZONE\tUUID")
+
+	for _, name := range sortedNames(reg) {
+		for _, d := range reg[name] {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%s\n", name, d.Proto, d.Address, d.Port, d.Zone, d.UUID)
+		}
+	}
+
+	return tw.Flush()
+}
+
+//change is a provider registered or unregistered with a registry
+type change struct {
+	Event    string               `json:"event"`
+	Service  string               `json:"service"`
+	Provider *arch.LinkDescriptor `json:"provider"`
+}
+
+//changes returns the providers registered and unregistered from the old registry to
+//the new one, by service and then uuid
+func changes(old, updated map[string][]*arch.LinkDescriptor) []change {
+	var out []change
+
+	for _, name := range sortedNames(updated) {
+		for _, d := range updated[name] {
+			if !hasProvider(old[name], d.UUID) {
+				out = append(out, change{"register", name, d})
+			}
+		}
+	}
+
+	for _, name := range sortedNames(old) {
+		for _, d := range old[name] {
+			if !hasProvider(updated[name], d.UUID) {
+				out = append(out, change{"unregister", name, d})
+			}
+		}
+	}
+
+	return out
+}
+
+//applyChange returns the registry with the change made to it
+func applyChange(reg map[string][]*arch.LinkDescriptor, c change) map[string][]*arch.LinkDescriptor {
+	var kept []*arch.LinkDescriptor
+
+	for _, d := range reg[c.Service] {
+		if d.UUID != c.Provider.UUID {
+			kept = append(kept, d)
+		}
+	}
+
+	if c.Event == "register" {
+		kept = append(kept, c.Provider)
+	}
+
+	if len(kept) == 0 {
+		delete(reg, c.Service)
+		return reg
+	}
+
+	reg[c.Service] = kept
+	return reg
+}
+
+func hasProvider(providers []*arch.LinkDescriptor, uuid string) bool {
+	for _, d := range providers {
+		if d.UUID == uuid {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedNames(reg map[string][]*arch.LinkDescriptor) []string {
+	names := make([]string, 0, len(reg))
+
+	for name := range reg {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+//writeJSON writes the value as indented json
+func writeJSON(w io.Writer, v interface{}) error {
+	bin, err := json.MarshalIndent(v, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "%s\n", bin)
+	return err
+}
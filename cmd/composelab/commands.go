@@ -0,0 +1,467 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/influx6/composelab/arch"
+	"github.com/influx6/composelab/links"
+	"github.com/influx6/composelab/routes"
+	"github.com/influx6/composelab/services"
+)
+
+//DefaultMaster is the master commands talk to when not given one
+const DefaultMaster = "http://127.0.0.1:3000"
+
+//clientFlags are the flags of the commands which talk to a master
+type clientFlags struct {
+	master  string
+	timeout time.Duration
+	json    bool
+}
+
+func (c *clientFlags) add(fs *flag.FlagSet) {
+	fs.StringVar(&c.master, "master", DefaultMaster, "address of the master as http|https|udp://host:port")
+	fs.DurationVar(&c.timeout, "timeout", 5*time.Second, "time to wait for a reply")
+	fs.BoolVar(&c.json, "json", false, "write json instead of text")
+}
+
+//runMaster serves a master till it fails, its registry and route tree are exposed for
+//the list, watch and routes commands
+func runMaster(args []string, out io.Writer) error {
+	fs := newFlags("master")
+	addr := fs.String("addr", "0.0.0.0", "address to listen on")
+	port := fs.Int("port", 3000, "port to listen on")
+	proto := fs.String("proto", "http", "protocol to serve, http or udp")
+	name := fs.String("name", "master", "name the master serves its routes under")
+	cert := fs.String("cert", "", "tls certificate file of a http master")
+	key := fs.String("key", "", "tls key file of a http master")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var sv *arch.Service
+	var dial func() error
+
+	switch *proto {
+	case "http":
+		hs := services.NewHTTPService(*name, *addr, *port, nil)
+
+		if *cert != "" || *key != "" {
+			hs.UseTLS(&services.HTTPCert{Cert: *cert, Key: *key})
+		}
+
+		sv, dial = hs.Service, hs.Dial
+	case "udp":
+		us, err := services.NewUDPService(*name, *addr, *port, nil)
+
+		if err != nil {
+			return err
+		}
+
+		sv, dial = us.Service, us.Dial
+	default:
+		return fmt.Errorf("unknown master proto %q", *proto)
+	}
+
+	sv.ExposeRegistry()
+	sv.ExposeRoutes()
+
+	fmt.Fprintf(out, "%s master %s listening on %s:%d\n", *proto, *name, *addr, *port)
+	return dial()
+}
+
+//runRegister registers a provider with the master and writes its descriptor
+func runRegister(args []string, out io.Writer) error {
+	var cf clientFlags
+
+	fs := newFlags("register")
+	cf.add(fs)
+	service := fs.String("service", "", "name of the service provided")
+	addr := fs.String("addr", "", "address of the provider")
+	port := fs.Int("port", 0, "port of the provider")
+	proto := fs.String("proto", "http", "protocol of the provider, http or udp")
+	scheme := fs.String("scheme", "", "scheme of the provider, http, https or udp4")
+	zone := fs.String("zone", "0", "zone of the provider")
+	id := fs.String("uuid", "", "uuid of the provider, a new one if not set")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *service == "" || *addr == "" || *port <= 0 {
+		return errors.New("register needs -service, -addr and -port")
+	}
+
+	if *scheme == "" {
+		*scheme = *proto
+
+		if *proto == "udp" {
+			*scheme = "udp4"
+		}
+	}
+
+	desc := arch.NewDescriptor(*proto, *service, *addr, *port, *zone, *scheme)
+
+	if *id != "" {
+		desc.UUID = *id
+	}
+
+	if err := changeRegistry(cf, desc, true); err != nil {
+		return err
+	}
+
+	if cf.json {
+		return writeJSON(out, desc)
+	}
+
+	fmt.Fprintf(out, "registered %s provider %s\n", desc.Service, desc.UUID)
+	return nil
+}
+
+//runUnregister unregisters a provider from the master
+func runUnregister(args []string, out io.Writer) error {
+	var cf clientFlags
+
+	fs := newFlags("unregister")
+	cf.add(fs)
+	service := fs.String("service", "", "name of the service provided")
+	id := fs.String("uuid", "", "uuid of the provider")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *service == "" || *id == "" {
+		return errors.New("unregister needs -service and -uuid")
+	}
+
+	desc := arch.NewDescriptor("", *service, "", 0, "", "")
+	desc.UUID = *id
+
+	if err := changeRegistry(cf, desc, false); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "unregistered %s provider %s\n", desc.Service, desc.UUID)
+	return nil
+}
+
+//changeRegistry registers or unregisters the provider with the master
+func changeRegistry(cf clientFlags, desc *arch.LinkDescriptor, register bool) error {
+	link, err := masterLink(cf.master)
+
+	if err != nil {
+		return err
+	}
+
+	defer link.End()
+
+	m, err := call(cf.timeout, func(done func(...interface{})) error {
+		if register {
+			return link.Register(desc.Service, desc, done)
+		}
+		return link.Unregister(desc.Service, desc, done)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return arch.LinkError(m...)
+}
+
+//runDiscover writes a provider of the service
+func runDiscover(args []string, out io.Writer) error {
+	var cf clientFlags
+
+	fs := newFlags("discover")
+	cf.add(fs)
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	service, err := arg(fs, "service name")
+
+	if err != nil {
+		return err
+	}
+
+	link, err := masterLink(cf.master)
+
+	if err != nil {
+		return err
+	}
+
+	defer link.End()
+
+	desc, err := discover(link, service, cf.timeout)
+
+	if err != nil {
+		return err
+	}
+
+	if cf.json {
+		return writeJSON(out, desc)
+	}
+
+	return writeTable(out, map[string][]*arch.LinkDescriptor{service: {desc}})
+}
+
+//discover asks the master for a provider of the service
+func discover(link arch.Linkage, service string, timeout time.Duration) (*arch.LinkDescriptor, error) {
+	m, err := call(timeout, func(done func(...interface{})) error {
+		return link.Discover(service, func(_ string, data interface{}, meta interface{}) {
+			done(data, meta)
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if desc, ok := m[0].(*arch.LinkDescriptor); ok {
+		return desc, nil
+	}
+
+	if err, ok := m[1].(error); ok {
+		return nil, err
+	}
+
+	return nil, fmt.Errorf("no provider of %s", service)
+}
+
+//runList writes the registry of the master
+func runList(args []string, out io.Writer) error {
+	var cf clientFlags
+
+	fs := newFlags("list")
+	cf.add(fs)
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	link, err := masterLink(cf.master)
+
+	if err != nil {
+		return err
+	}
+
+	defer link.End()
+
+	reg, err := registry(link, cf.timeout)
+
+	if err != nil {
+		return err
+	}
+
+	if cf.json {
+		return writeJSON(out, reg)
+	}
+
+	return writeTable(out, reg)
+}
+
+//runWatch streams the registry changes of the master and writes the providers
+//registered and unregistered till interrupted
+func runWatch(args []string, out io.Writer) error {
+	var cf clientFlags
+
+	fs := newFlags("watch")
+	cf.add(fs)
+	interval := fs.Duration("interval", time.Second, "time to wait before reading the changes again after a failed read")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	link, err := masterLink(cf.master)
+
+	if err != nil {
+		return err
+	}
+
+	defer link.End()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt)
+	defer signal.Stop(stop)
+
+	return watch(link, cf, *interval, out, stop)
+}
+
+//watch writes the registry changes the master streams till stop is sent to. The
+//first read is answered with the registry, as is a read which fell behind the changes
+//the master keeps, and the providers it differs by from the last seen are written.
+//A read which fails is written as an error and tried again after the interval
+func watch(link arch.Linkage, cf clientFlags, interval time.Duration, out io.Writer, stop <-chan os.Signal) error {
+	last := make(map[string][]*arch.LinkDescriptor)
+	since := int64(-1)
+
+	type read struct {
+		rc  *arch.RegistryChanges
+		err error
+	}
+
+	for {
+		reads := make(chan read, 1)
+
+		go func(since int64) {
+			rc, err := registryChanges(link, since, cf.timeout+arch.RegistryWait)
+			reads <- read{rc, err}
+		}(since)
+
+		var rd read
+
+		select {
+		case <-stop:
+			return nil
+		case rd = <-reads:
+		}
+
+		if rd.err != nil {
+			if err := writeWatchError(out, rd.err, cf.json); err != nil {
+				return err
+			}
+
+			select {
+			case <-stop:
+				return nil
+			case <-time.After(interval):
+			}
+			continue
+		}
+
+		var found []change
+
+		if rd.rc.Registry != nil {
+			found = changes(last, rd.rc.Registry)
+		} else {
+			for _, c := range rd.rc.Changes {
+				found = append(found, change{c.Event, c.Service, c.Provider})
+			}
+		}
+
+		for _, c := range found {
+			last = applyChange(last, c)
+
+			if err := writeChange(out, c, cf.json); err != nil {
+				return err
+			}
+		}
+
+		since = rd.rc.Seq
+	}
+}
+
+//writeWatchError writes a failed read of the registry changes as a line of text or json
+func writeWatchError(w io.Writer, err error, asJSON bool) error {
+	if asJSON {
+		bin, jerr := json.Marshal(map[string]string{"event": "error", "error": err.Error()})
+
+		if jerr != nil {
+			return jerr
+		}
+
+		_, jerr = fmt.Fprintf(w, "%s\n", bin)
+		return jerr
+	}
+
+	_, err = fmt.Fprintf(w, "! %s\n", err)
+	return err
+}
+
+//writeChange writes a change as a line of text or json
+func writeChange(w io.Writer, c change, asJSON bool) error {
+	if asJSON {
+		bin, err := json.Marshal(c)
+
+		if err != nil {
+			return err
+		}
+
+		_, err = fmt.Fprintf(w, "%s\n", bin)
+		return err
+	}
+
+	sign := "+"
+
+	if c.Event == "unregister" {
+		sign = "-"
+	}
+
+	d := c.Provider
+	_, err := fmt.Fprintf(w, "%s %s %s %s:%d %s\n", sign, c.Service, d.Proto, d.Address, d.Port, d.UUID)
+	return err
+}
+
+//runRoutes writes the route tree of a provider of the service, the service must
+//expose its routes with arch.Service.ExposeRoutes
+func runRoutes(args []string, out io.Writer) error {
+	var cf clientFlags
+
+	fs := newFlags("routes")
+	cf.add(fs)
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	service, err := arg(fs, "service name")
+
+	if err != nil {
+		return err
+	}
+
+	master, err := masterLink(cf.master)
+
+	if err != nil {
+		return err
+	}
+
+	defer master.End()
+
+	desc, err := discover(master, service, cf.timeout)
+
+	if err != nil {
+		return err
+	}
+
+	link, err := links.NewFactory().Resolve(desc)
+
+	if err != nil {
+		return err
+	}
+
+	link.Dial()
+	defer link.End()
+
+	body, err := request(link, arch.IntrospectionPath, desc.Service, cf.timeout)
+
+	if err != nil {
+		return err
+	}
+
+	if cf.json {
+		_, err = fmt.Fprintf(out, "%s\n", body)
+		return err
+	}
+
+	info := new(routes.RouteInfo)
+
+	if err := json.Unmarshal(body, info); err != nil {
+		return fmt.Errorf("invalid route tree: %s", err)
+	}
+
+	_, err = io.WriteString(out, info.Text())
+	return err
+}
@@ -0,0 +1,105 @@
+//Command composelab starts masters and reads and changes their registries through
+//http or udp links
+//
+//	composelab master     [-addr 0.0.0.0] [-port 3000] [-proto http|udp] [-cert file -key file]
+//	composelab register   [-master url] -service name -addr host -port n [-proto http] [-zone z] [-uuid id]
+//	composelab unregister [-master url] -service name -uuid id
+//	composelab discover   [-master url] service
+//	composelab list       [-master url] [-json]
+//	composelab watch      [-master url] [-json] [-interval 1s]
+//	composelab routes     [-master url] [-json] service
+//
+//Masters are addressed as scheme://host:port with a scheme of http, https or udp, the
+//default is http://127.0.0.1:3000. watch streams the registry changes of the master, a
+//failed read is written and tried again after -interval
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+//command is a subcommand of the tool
+type command struct {
+	usage string
+	run   func(args []string, out io.Writer) error
+}
+
+var commands = map[string]*command{
+	"master":     {"start a master", runMaster},
+	"register":   {"register a provider of a service with a master", runRegister},
+	"unregister": {"unregister a provider of a service from a master", runUnregister},
+	"discover":   {"show a provider of a service", runDiscover},
+	"list":       {"show the registry of a master", runList},
+	"watch":      {"stream the providers registered with and unregistered from a master", runWatch},
+	"routes":     {"show the route tree of a service", runRoutes},
+}
+
+//errUsage is returned when the tool is run without a known command
+var errUsage = errors.New("usage: composelab <command> [flags]")
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout); err != nil {
+		if err != flag.ErrHelp {
+			fmt.Fprintln(os.Stderr, "composelab:", err)
+		}
+		os.Exit(1)
+	}
+}
+
+//run runs the command named by the first argument with the rest
+func run(args []string, out io.Writer) error {
+	if len(args) == 0 {
+		usage(os.Stderr)
+		return errUsage
+	}
+
+	cmd, ok := commands[args[0]]
+
+	if !ok {
+		usage(os.Stderr)
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+
+	return cmd.run(args[1:], out)
+}
+
+//usage writes the commands of the tool
+func usage(w io.Writer) {
+	names := make([]string, 0, len(commands))
+
+	for name := range commands {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	fmt.Fprintln(w, errUsage.Error()+"\n\ncommands:")
+
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-11s %s\n", name, commands[name].usage)
+	}
+
+	fmt.Fprintln(w, "\nrun 'composelab <command> -h' for the flags of a command")
+}
+
+//newFlags returns the flag set of a command, its errors are returned rather than
+//ending the process
+func newFlags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet("composelab "+name, flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	return fs
+}
+
+//arg returns the single argument a command takes after its flags
+func arg(fs *flag.FlagSet, what string) (string, error) {
+	if fs.NArg() != 1 || strings.TrimSpace(fs.Arg(0)) == "" {
+		return "", fmt.Errorf("%s takes a %s", strings.TrimPrefix(fs.Name(), "composelab "), what)
+	}
+	return fs.Arg(0), nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/franela/goblin"
+	"github.com/influx6/composelab/arch"
+	"github.com/influx6/composelab/services"
+)
+
+func TestComposelab(t *testing.T) {
+	g := goblin.Goblin(t)
+
+	g.Describe("Composelab", func() {
+
+		g.It("can master addresses be read", func() {
+			link, err := masterLink("udp://127.0.0.1:3200/hub")
+			g.Assert(err == nil).IsTrue("udp address was read")
+			g.Assert(link.GetPrefix()).Eql("hub")
+			g.Assert(link.GetPort()).Eql(3200)
+			link.End()
+
+			_, err = masterLink("ftp://127.0.0.1:3200")
+			g.Assert(err != nil).IsTrue("unknown schemes fail")
+
+			_, err = masterLink("http://127.0.0.1")
+			g.Assert(err != nil).IsTrue("addresses need a port")
+		})
+
+		g.It("can registry changes be found", func() {
+			one := arch.NewDescriptor("http", "models", "10.0.0.1", 80, "0", "http")
+			two := arch.NewDescriptor("http", "models", "10.0.0.2", 80, "0", "http")
+
+			first := changes(nil, map[string][]*arch.LinkDescriptor{"models": {one}})
+			g.Assert(len(first)).Eql(1)
+			g.Assert(first[0].Event).Eql("register")
+
+			next := changes(map[string][]*arch.LinkDescriptor{"models": {one}}, map[string][]*arch.LinkDescriptor{"models": {two}})
+			g.Assert(len(next)).Eql(2)
+			g.Assert(next[0].Provider.UUID).Eql(two.UUID)
+			g.Assert(next[1].Event).Eql("unregister")
+			g.Assert(next[1].Provider.UUID).Eql(one.UUID)
+		})
+
+		g.It("can providers be registered, listed and unregistered", func() {
+			master := services.NewHTTPService("master", "127.0.0.1", 3201, nil)
+			master.ExposeRegistry()
+			go master.Dial()
+			time.Sleep(100 * time.Millisecond)
+
+			addr := "-master=http://127.0.0.1:3201"
+
+			var out bytes.Buffer
+			err := run([]string{"register", addr, "-json", "-service", "models", "-addr", "10.0.0.1", "-port", "4000"}, &out)
+			g.Assert(err == nil).IsTrue("provider was registered")
+
+			desc := new(arch.LinkDescriptor)
+			json.Unmarshal(out.Bytes(), desc)
+			g.Assert(master.HasProvider("models", desc.UUID)).IsTrue()
+
+			out.Reset()
+			g.Assert(run([]string{"list", addr}, &out) == nil).IsTrue("registry was listed")
+			g.Assert(strings.Contains(out.String(), "models   http   10.0.0.1")).IsTrue(out.String())
+
+			out.Reset()
+			g.Assert(run([]string{"discover", addr, "-json", "models"}, &out) == nil).IsTrue("provider was discovered")
+			g.Assert(strings.Contains(out.String(), desc.UUID)).IsTrue(out.String())
+
+			out.Reset()
+			g.Assert(run([]string{"unregister", addr, "-service", "models", "-uuid", desc.UUID}, &out) == nil).IsTrue("provider was unregistered")
+			g.Assert(master.HasRegistered("models")).IsFalse()
+
+			err = run([]string{"discover", addr, "models"}, &out)
+			e, ok := err.(*arch.Error)
+			g.Assert(ok).IsTrue("missing services are an *arch.Error")
+			g.Assert(e.Code).Eql(404)
+		})
+
+		g.It("can a udp master list a registry larger than a small datagram", func() {
+			master, err := services.NewUDPService("master", "127.0.0.1", 3202, nil)
+			g.Assert(err == nil).IsTrue("master was made")
+			master.ExposeRegistry()
+			go master.Dial()
+			defer master.End()
+			time.Sleep(100 * time.Millisecond)
+
+			for i := 0; i < 40; i++ {
+				master.Register("models", arch.NewDescriptor("udp", "models", fmt.Sprintf("10.0.0.%d", i+1), 4000, "0", "udp4"))
+			}
+
+			addr := "-master=udp://127.0.0.1:3202"
+
+			var out bytes.Buffer
+			g.Assert(run([]string{"list", addr, "-json"}, &out) == nil).IsTrue("registry was listed")
+
+			var reg map[string][]*arch.LinkDescriptor
+			g.Assert(json.Unmarshal(out.Bytes(), &reg) == nil).IsTrue(out.String())
+			g.Assert(len(reg["models"])).Eql(40)
+			g.Assert(out.Len() > 1024).IsTrue("the registry is larger than the old read buffer")
+
+			out.Reset()
+			g.Assert(run([]string{"discover", addr, "models"}, &out) == nil).IsTrue("provider was discovered")
+			g.Assert(strings.Contains(out.String(), "10.0.0.")).IsTrue(out.String())
+		})
+
+		g.It("can watch stream providers registered and unregistered between reads", func() {
+			master := services.NewHTTPService("master", "127.0.0.1", 3203, nil)
+			master.ExposeRegistry()
+			go master.Dial()
+			time.Sleep(100 * time.Millisecond)
+
+			link, err := masterLink("http://127.0.0.1:3203")
+			g.Assert(err == nil).IsTrue("link was made")
+			defer link.End()
+
+			var out bytes.Buffer
+			stop := make(chan os.Signal)
+			done := make(chan error)
+
+			go func() {
+				done <- watch(link, clientFlags{timeout: time.Second}, 10*time.Millisecond, &out, stop)
+			}()
+
+			time.Sleep(100 * time.Millisecond)
+
+			one := arch.NewDescriptor("http", "models", "10.0.0.1", 4000, "0", "http")
+			master.Register("models", one)
+			master.Unregister("models", one)
+
+			time.Sleep(100 * time.Millisecond)
+			stop <- os.Interrupt
+			g.Assert(<-done == nil).IsTrue("watch stopped")
+
+			lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+			g.Assert(len(lines)).Eql(2)
+			g.Assert(strings.HasPrefix(lines[0], "+ models http 10.0.0.1:4000")).IsTrue(out.String())
+			g.Assert(strings.HasPrefix(lines[1], "- models http 10.0.0.1:4000")).IsTrue(out.String())
+		})
+
+		g.It("can watch write failed reads to its writer", func() {
+			link, err := masterLink("http://127.0.0.1:3204")
+			g.Assert(err == nil).IsTrue("link was made")
+			defer link.End()
+
+			var out bytes.Buffer
+			stop := make(chan os.Signal)
+			done := make(chan error)
+
+			go func() {
+				done <- watch(link, clientFlags{timeout: time.Second, json: true}, time.Second, &out, stop)
+			}()
+
+			time.Sleep(100 * time.Millisecond)
+			stop <- os.Interrupt
+			g.Assert(<-done == nil).IsTrue("watch stopped")
+
+			var line map[string]string
+			g.Assert(json.Unmarshal(out.Bytes(), &line) == nil).IsTrue(out.String())
+			g.Assert(line["event"]).Eql("error")
+			g.Assert(line["error"] != "").IsTrue("the error was written")
+		})
+
+		g.It("can unknown commands fail", func() {
+			g.Assert(run([]string{"launch"}, &bytes.Buffer{}) != nil).IsTrue()
+			g.Assert(run(nil, &bytes.Buffer{}) == errUsage).IsTrue()
+		})
+	})
+}
@@ -0,0 +1,246 @@
+package config
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/influx6/composelab/arch"
+	"github.com/influx6/composelab/links"
+	"github.com/influx6/composelab/services"
+)
+
+//Server is a service which serves requests once dialed, Dial returns the error it
+//stopped serving with
+type Server interface {
+	Dial() error
+}
+
+//Instance is a service built from its config
+type Instance struct {
+	Config  *Service
+	Service *arch.Service
+	Server  Server
+}
+
+//Stack is the masters and services of a config once built, services are registered
+//with their masters and dialed by Start
+type Stack struct {
+	Masters   map[string]arch.Linkage
+	Instances []*Instance
+	errs      chan error
+	once      sync.Once
+}
+
+//Build builds the master links and services of the config without dialing them
+func (c *Config) Build() (*Stack, error) {
+	st := &Stack{Masters: make(map[string]arch.Linkage)}
+
+	for _, m := range c.Masters {
+		link, err := buildMaster(m)
+
+		if err != nil {
+			return nil, fmt.Errorf("master %s: %s", m.Name, err)
+		}
+
+		st.Masters[m.Name] = link
+	}
+
+	for _, s := range c.Services {
+		in, err := buildService(s)
+
+		if err != nil {
+			return nil, fmt.Errorf("service %s: %s", s.Name, err)
+		}
+
+		st.Instances = append(st.Instances, in)
+	}
+
+	return st, nil
+}
+
+//Instance returns the instance of the service with the name
+func (s *Stack) Instance(name string) (*Instance, bool) {
+	for _, in := range s.Instances {
+		if in.Config.Name == name {
+			return in, true
+		}
+	}
+	return nil, false
+}
+
+//Start dials the master links, registers every service with its master and dials the
+//services, each in its own goroutine. A service which can not register is logged and
+//still served, errors services stop serving with are returned by Wait
+func (s *Stack) Start() {
+	s.once.Do(func() {
+		s.errs = make(chan error, len(s.Instances))
+
+		for _, m := range s.Masters {
+			m.Dial()
+		}
+
+		for _, in := range s.Instances {
+			if in.Config.Master != "" {
+				in.Service.Master = s.Masters[in.Config.Master]
+
+				if err := in.Service.JoinMaster(); err != nil {
+					in.Service.Logger().Error("unable to register with master", arch.Fields{"service": in.Config.Name, "master": in.Config.Master, "err": err})
+				}
+			}
+
+			go func(in *Instance) {
+				err := in.Server.Dial()
+
+				if err == nil {
+					err = fmt.Errorf("service %s stopped serving", in.Config.Name)
+				}
+
+				s.errs <- fmt.Errorf("service %s: %s", in.Config.Name, err)
+			}(in)
+		}
+	})
+}
+
+//Wait blocks till a service of the started stack stops serving and returns its error
+func (s *Stack) Wait() error {
+	s.Start()
+	return <-s.errs
+}
+
+//Stop ends the master links of the stack
+func (s *Stack) Stop() {
+	for _, m := range s.Masters {
+		m.End()
+	}
+}
+
+//Start loads the config file, builds it and starts the stack
+func Start(file string) (*Stack, error) {
+	conf, err := Load(file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := conf.Build()
+
+	if err != nil {
+		return nil, err
+	}
+
+	st.Start()
+	return st, nil
+}
+
+//buildMaster returns the link to the master
+func buildMaster(m *Master) (arch.Linkage, error) {
+	service := m.Service
+
+	if service == "" {
+		service = "master"
+	}
+
+	if m.Proto == "udp" {
+		return links.NewUDPLink(service, m.Address, m.Port)
+	}
+
+	if m.Secure {
+		return links.NewSecureHTTPLink(service, m.Address, m.Port, &http.Transport{}), nil
+	}
+
+	return links.NewHTTPLink(service, m.Address, m.Port), nil
+}
+
+//buildService returns the service of the config with its zone, metadata, timeout,
+//factory and pipelines set, it has no master till the stack starts
+func buildService(c *Service) (*Instance, error) {
+	var server Server
+	var sv *arch.Service
+
+	switch c.Proto {
+	case "udp":
+		us, err := services.NewUDPService(c.Name, c.Address, c.Port, nil)
+
+		if err != nil {
+			return nil, err
+		}
+
+		server, sv = us, us.Service
+	case "jsonp":
+		js := services.NewJSONPService(c.Name, c.Address, c.Port, nil, c.Callback)
+		server, sv = js, js.Service
+	case "websocket":
+		ws := services.NewWebSocketService(c.Name, c.Address, c.Port, nil)
+		server, sv = ws, ws.Service
+	case "poll":
+		ps := services.NewPollService(c.Name, c.Address, c.Port, nil)
+		server, sv = ps, ps.Service
+	case "hybrid":
+		hs := services.NewHybridService(c.Name, c.Address, c.Port, nil, c.Callback)
+		server, sv = hs, hs.Service
+	case "http":
+		hs := services.NewHTTPService(c.Name, c.Address, c.Port, nil)
+		server, sv = hs, hs.Service
+	default:
+		return nil, fmt.Errorf("unknown proto %q", c.Proto)
+	}
+
+	if c.TLS != nil {
+		ts, ok := server.(interface {
+			UseTLS(*services.HTTPCert)
+		})
+
+		if !ok {
+			return nil, fmt.Errorf("%s services can not use tls", c.Proto)
+		}
+
+		ts.UseTLS(&services.HTTPCert{Key: c.TLS.Key, Cert: c.TLS.Cert})
+	}
+
+	desc := sv.GetDescriptor()
+
+	if c.Zone != "" {
+		desc.Zone = c.Zone
+	}
+
+	for k, v := range c.Metadata {
+		desc.Misc[k] = v
+	}
+
+	if c.Timeout > 0 {
+		sv.RequestTimeout = time.Duration(c.Timeout)
+	}
+
+	sv.Factory = links.NewFactory()
+
+	if len(c.Factory) > 0 {
+		factory := arch.NewFactory()
+		all := links.NewFactory()
+
+		for _, proto := range c.Factory {
+			if !all.Has(proto) {
+				return nil, fmt.Errorf("no links for factory proto %q", proto)
+			}
+
+			factory.Provide(proto, all.Resolve)
+		}
+
+		sv.Factory = factory
+	}
+
+	if c.Pipelines != "" {
+		pls, err := arch.LoadPipelines(c.Pipelines)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if err := sv.Pipe(pls...); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Instance{c, sv, server}, nil
+}
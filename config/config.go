@@ -0,0 +1,446 @@
+//Package config declares services, the masters they register with and the protocols
+//they forward over in json or yaml files, and builds and starts them
+//e.g
+//
+//	{
+//	  "masters": [{"name": "main", "proto": "http", "address": "10.0.0.1", "port": 3000}],
+//	  "services": [
+//	    {"name": "models", "proto": "http", "address": "0.0.0.0", "port": 4000,
+//	     "master": "main", "factory": ["http", "udp"], "timeout": "2s",
+//	     "metadata": {"version": "2"}}
+//	  ]
+//	}
+
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+//EnvPrefix is the prefix of the environment variables overriding config values
+var EnvPrefix = "COMPOSELAB"
+
+//Protos are the protocols services can be declared with
+var Protos = []string{"http", "udp", "jsonp", "websocket", "poll", "hybrid"}
+
+//Duration is a time.Duration written as a duration string such as "2s"
+type Duration time.Duration
+
+//MarshalJSON returns the duration as a duration string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+//UnmarshalJSON sets the duration from a duration string
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+
+	dur, err := time.ParseDuration(s)
+
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(dur)
+	return nil
+}
+
+//TLS is the certificate and key files a http based service is served with
+type TLS struct {
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+}
+
+//Master declares a link to a master services register with and discover through,
+//Service is the name the master serves its routes under and is 'master' if not set
+type Master struct {
+	Name    string `json:"name"`
+	Service string `json:"service,omitempty"`
+	Proto   string `json:"proto"`
+	Address string `json:"address"`
+	Port    int    `json:"port"`
+	Secure  bool   `json:"secure,omitempty"`
+}
+
+//Service declares a service, its Proto is one of Protos and its Master the name of
+//one of the config's masters. Factory lists the protocols the service forwards to
+//providers over, all that links know if it is empty, and Pipelines is a json file of
+//pipelines the service serves
+type Service struct {
+	Name      string                 `json:"name"`
+	Proto     string                 `json:"proto"`
+	Address   string                 `json:"address"`
+	Port      int                    `json:"port"`
+	Zone      string                 `json:"zone,omitempty"`
+	TLS       *TLS                   `json:"tls,omitempty"`
+	Master    string                 `json:"master,omitempty"`
+	Factory   []string               `json:"factory,omitempty"`
+	Timeout   Duration               `json:"timeout,omitempty"`
+	Callback  string                 `json:"callback,omitempty"`
+	Pipelines string                 `json:"pipelines,omitempty"`
+	Metadata  map[string]interface{} `json:"metadata,omitempty"`
+}
+
+//Config declares the masters and services of a process
+type Config struct {
+	Masters  []*Master  `json:"masters,omitempty"`
+	Services []*Service `json:"services"`
+}
+
+//Parse reads a config from json or, when the format is 'yaml', yaml data. References
+//to environment variables as ${NAME} or ${NAME:-default} are expanded as Expand does
+//for json and within the string values of yaml once it is decoded
+func Parse(data []byte, format string) (*Config, error) {
+	if format == "yaml" {
+		var raw interface{}
+
+		if err := yaml.Unmarshal(data, &raw); err != nil {
+			return nil, err
+		}
+
+		bin, err := json.Marshal(expandValues(stringKeys(raw), os.LookupEnv))
+
+		if err != nil {
+			return nil, err
+		}
+
+		data = bin
+	} else {
+		data = Expand(data, os.LookupEnv)
+	}
+
+	conf := new(Config)
+
+	if err := json.Unmarshal(data, conf); err != nil {
+		return nil, err
+	}
+
+	return conf, nil
+}
+
+//Load reads the config file, as yaml if it ends in .yaml or .yml and json if not,
+//applies the environment overrides and validates it
+func Load(file string) (*Config, error) {
+	data, err := ioutil.ReadFile(file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	format := "json"
+
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		format = "yaml"
+	}
+
+	conf, err := Parse(data, format)
+
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+
+	if err := conf.Override(os.LookupEnv); err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+
+	if err := conf.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+
+	return conf, nil
+}
+
+//envRef matches ${NAME} and ${NAME:-default}
+var envRef = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+//Expand replaces references to variables as ${NAME} in json with their value from
+//lookup, unset variables are replaced with the default of a ${NAME:-default} reference
+//or left empty. Values within json strings are escaped so they stay within the string
+//while those outside, as for numbers, are put in as they are
+func Expand(data []byte, lookup func(string) (string, bool)) []byte {
+	var out []byte
+	var quoted, escaped bool
+	last := 0
+
+	for _, loc := range envRef.FindAllSubmatchIndex(data, -1) {
+		for _, c := range data[last:loc[0]] {
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\' && quoted:
+				escaped = true
+			case c == '"':
+				quoted = !quoted
+			}
+		}
+
+		val := lookupRef(data[loc[0]:loc[1]], lookup)
+
+		if quoted {
+			esc, _ := json.Marshal(val)
+			val = string(esc[1 : len(esc)-1])
+		}
+
+		out = append(append(out, data[last:loc[0]]...), val...)
+		last = loc[1]
+	}
+
+	return append(out, data[last:]...)
+}
+
+//lookupRef returns the value of a ${NAME} or ${NAME:-default} reference
+func lookupRef(ref []byte, lookup func(string) (string, bool)) string {
+	m := envRef.FindSubmatch(ref)
+
+	if val, ok := lookup(string(m[1])); ok {
+		return val
+	}
+
+	return string(m[3])
+}
+
+//expandValues expands the references within the string values of decoded yaml, a
+//value which is a single reference becomes a number or bool if its value is one
+func expandValues(v interface{}, lookup func(string) (string, bool)) interface{} {
+	switch in := v.(type) {
+	case map[string]interface{}:
+		for k, val := range in {
+			in[k] = expandValues(val, lookup)
+		}
+		return in
+	case []interface{}:
+		for i, val := range in {
+			in[i] = expandValues(val, lookup)
+		}
+		return in
+	case string:
+		if loc := envRef.FindStringIndex(in); loc != nil && loc[0] == 0 && loc[1] == len(in) {
+			val := lookupRef([]byte(in), lookup)
+
+			var scalar interface{}
+
+			if err := yaml.Unmarshal([]byte(val), &scalar); err == nil {
+				switch scalar.(type) {
+				case int, float64, bool:
+					return scalar
+				}
+			}
+
+			return val
+		}
+
+		return envRef.ReplaceAllStringFunc(in, func(ref string) string {
+			return lookupRef([]byte(ref), lookup)
+		})
+	}
+
+	return v
+}
+
+//Override sets values of the config from variables named after the master or service
+//and the field, as EnvPrefix_SERVICE_MODELS_PORT or EnvPrefix_MASTER_MAIN_ADDRESS.
+//Services take ADDRESS, PORT, ZONE, PROTO, MASTER, TIMEOUT, TLS_CERT and TLS_KEY and
+//masters take ADDRESS, PORT, PROTO and SERVICE
+func (c *Config) Override(lookup func(string) (string, bool)) error {
+	for _, m := range c.Masters {
+		env := envName("MASTER", m.Name)
+
+		if v, ok := lookup(env + "_ADDRESS"); ok {
+			m.Address = v
+		}
+
+		if v, ok := lookup(env + "_PROTO"); ok {
+			m.Proto = v
+		}
+
+		if v, ok := lookup(env + "_SERVICE"); ok {
+			m.Service = v
+		}
+
+		if err := overridePort(lookup, env+"_PORT", &m.Port); err != nil {
+			return err
+		}
+	}
+
+	for _, s := range c.Services {
+		env := envName("SERVICE", s.Name)
+
+		if v, ok := lookup(env + "_ADDRESS"); ok {
+			s.Address = v
+		}
+
+		if v, ok := lookup(env + "_ZONE"); ok {
+			s.Zone = v
+		}
+
+		if v, ok := lookup(env + "_PROTO"); ok {
+			s.Proto = v
+		}
+
+		if v, ok := lookup(env + "_MASTER"); ok {
+			s.Master = v
+		}
+
+		if err := overridePort(lookup, env+"_PORT", &s.Port); err != nil {
+			return err
+		}
+
+		if v, ok := lookup(env + "_TIMEOUT"); ok {
+			dur, err := time.ParseDuration(v)
+
+			if err != nil {
+				return fmt.Errorf("%s_TIMEOUT: %s", env, err)
+			}
+
+			s.Timeout = Duration(dur)
+		}
+
+		cert, hasCert := lookup(env + "_TLS_CERT")
+		key, hasKey := lookup(env + "_TLS_KEY")
+
+		if hasCert || hasKey {
+			if s.TLS == nil {
+				s.TLS = new(TLS)
+			}
+
+			if hasCert {
+				s.TLS.Cert = cert
+			}
+
+			if hasKey {
+				s.TLS.Key = key
+			}
+		}
+	}
+
+	return nil
+}
+
+//Validate returns an error for the first master or service which is not complete or
+//refers to what the config does not declare
+func (c *Config) Validate() error {
+	masters := make(map[string]bool)
+
+	for _, m := range c.Masters {
+		switch {
+		case m.Name == "":
+			return fmt.Errorf("master at %s:%d has no name", m.Address, m.Port)
+		case masters[m.Name]:
+			return fmt.Errorf("master %s is declared twice", m.Name)
+		case m.Proto != "http" && m.Proto != "udp":
+			return fmt.Errorf("master %s: unknown proto %q", m.Name, m.Proto)
+		case m.Port <= 0:
+			return fmt.Errorf("master %s has no port", m.Name)
+		}
+
+		masters[m.Name] = true
+	}
+
+	services := make(map[string]bool)
+
+	for _, s := range c.Services {
+		switch {
+		case s.Name == "":
+			return fmt.Errorf("service at %s:%d has no name", s.Address, s.Port)
+		case services[s.Name]:
+			return fmt.Errorf("service %s is declared twice", s.Name)
+		case !knownProto(s.Proto):
+			return fmt.Errorf("service %s: unknown proto %q", s.Name, s.Proto)
+		case s.Port <= 0:
+			return fmt.Errorf("service %s has no port", s.Name)
+		case s.Master != "" && !masters[s.Master]:
+			return fmt.Errorf("service %s: no master named %s", s.Name, s.Master)
+		case s.TLS != nil && s.Proto == "udp":
+			return fmt.Errorf("service %s: udp services can not use tls", s.Name)
+		case s.TLS != nil && (s.TLS.Cert == "" || s.TLS.Key == ""):
+			return fmt.Errorf("service %s: tls needs a cert and key", s.Name)
+		}
+
+		services[s.Name] = true
+	}
+
+	return nil
+}
+
+//knownProto returns true if the proto is one of Protos
+func knownProto(proto string) bool {
+	for _, p := range Protos {
+		if p == proto {
+			return true
+		}
+	}
+	return false
+}
+
+//envName returns the variable name prefix of a master or service, its name upper
+//cased with every character which is not a letter or digit as '_'
+func envName(kind, name string) string {
+	clean := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, name)
+
+	return EnvPrefix + "_" + kind + "_" + strings.ToUpper(clean)
+}
+
+//overridePort sets the port from the variable if it is set
+func overridePort(lookup func(string) (string, bool), name string, port *int) error {
+	v, ok := lookup(name)
+
+	if !ok {
+		return nil
+	}
+
+	p, err := strconv.Atoi(v)
+
+	if err != nil {
+		return fmt.Errorf("%s: %s", name, err)
+	}
+
+	*port = p
+	return nil
+}
+
+//stringKeys turns the maps yaml decodes into, which may have keys of any type, into
+//maps with string keys so they can be encoded as json
+func stringKeys(v interface{}) interface{} {
+	switch in := v.(type) {
+	case map[interface{}]interface{}:
+		out := make(map[string]interface{}, len(in))
+
+		for k, val := range in {
+			out[fmt.Sprint(k)] = stringKeys(val)
+		}
+
+		return out
+	case map[string]interface{}:
+		for k, val := range in {
+			in[k] = stringKeys(val)
+		}
+		return in
+	case []interface{}:
+		for i, val := range in {
+			in[i] = stringKeys(val)
+		}
+		return in
+	}
+
+	return v
+}
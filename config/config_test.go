@@ -0,0 +1,150 @@
+package config
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/franela/goblin"
+	"github.com/influx6/composelab/services"
+)
+
+const stack = `{
+	"masters": [{"name": "main", "proto": "udp", "address": "127.0.0.1", "port": 3100}],
+	"services": [
+		{"name": "models", "proto": "http", "address": "127.0.0.1", "port": ${MODELS_PORT:-3101},
+		 "master": "main", "zone": "eu", "factory": ["udp"], "timeout": "2s",
+		 "metadata": {"version": "2", "tags": {"tier": "back"}}},
+		{"name": "feed", "proto": "websocket", "address": "127.0.0.1", "port": 3102,
+		 "tls": {"cert": "feed.crt", "key": "feed.key"}}
+	]
+}`
+
+func TestConfig(t *testing.T) {
+	g := goblin.Goblin(t)
+
+	env := func(vars map[string]string) func(string) (string, bool) {
+		return func(name string) (string, bool) {
+			v, ok := vars[name]
+			return v, ok
+		}
+	}
+
+	g.Describe("Config", func() {
+
+		g.It("can a config be read from json", func() {
+			conf, err := Parse([]byte(stack), "json")
+			g.Assert(err == nil).IsTrue("config was parsed")
+			g.Assert(conf.Validate() == nil).IsTrue("config is valid")
+			g.Assert(len(conf.Services)).Eql(2)
+
+			models := conf.Services[0]
+			g.Assert(models.Port).Eql(3101)
+			g.Assert(time.Duration(models.Timeout)).Eql(2 * time.Second)
+			g.Assert(models.Factory).Eql([]string{"udp"})
+			g.Assert(conf.Services[1].TLS.Cert).Eql("feed.crt")
+		})
+
+		g.It("can environment variables expand and override values", func() {
+			data := Expand([]byte(`{"port": ${PORT}, "zone": "${ZONE:-eu}", "name": "${NAME}"}`), env(map[string]string{"PORT": "80"}))
+			g.Assert(string(data)).Eql(`{"port": 80, "zone": "eu", "name": ""}`)
+
+			conf, _ := Parse([]byte(stack), "json")
+			err := conf.Override(env(map[string]string{
+				"COMPOSELAB_SERVICE_MODELS_PORT":    "4101",
+				"COMPOSELAB_SERVICE_MODELS_TIMEOUT": "5s",
+				"COMPOSELAB_MASTER_MAIN_ADDRESS":    "10.0.0.1",
+			}))
+
+			g.Assert(err == nil).IsTrue("overrides were applied")
+			g.Assert(conf.Services[0].Port).Eql(4101)
+			g.Assert(time.Duration(conf.Services[0].Timeout)).Eql(5 * time.Second)
+			g.Assert(conf.Masters[0].Address).Eql("10.0.0.1")
+
+			err = conf.Override(env(map[string]string{"COMPOSELAB_SERVICE_FEED_PORT": "high"}))
+			g.Assert(err != nil).IsTrue("bad ports fail")
+		})
+
+		g.It("can values within json strings not break out of them", func() {
+			data := Expand([]byte(`{"name": "${NAME}", "port": ${PORT}}`), env(map[string]string{
+				"NAME": `x", "proto": "udp`,
+				"PORT": "80",
+			}))
+
+			var decoded map[string]interface{}
+			g.Assert(json.Unmarshal(data, &decoded) == nil).IsTrue(string(data))
+			g.Assert(decoded["name"]).Eql(`x", "proto": "udp`)
+			g.Assert(decoded["port"]).Eql(float64(80))
+			g.Assert(decoded["proto"] == nil).IsTrue("no key was added")
+		})
+
+		g.It("can references be expanded within yaml values", func() {
+			os.Setenv("CONFIG_TEST_NAME", "models\nproto: udp")
+			os.Setenv("CONFIG_TEST_PORT", "4101")
+			defer os.Unsetenv("CONFIG_TEST_NAME")
+			defer os.Unsetenv("CONFIG_TEST_PORT")
+
+			conf, err := Parse([]byte(`
+services:
+  - name: ${CONFIG_TEST_NAME}
+    proto: http
+    address: 127.0.0.1
+    port: ${CONFIG_TEST_PORT}
+    zone: ${CONFIG_TEST_ZONE:-eu}-west
+`), "yaml")
+
+			g.Assert(err == nil).IsTrue("config was parsed")
+			g.Assert(conf.Services[0].Name).Eql("models\nproto: udp")
+			g.Assert(conf.Services[0].Proto).Eql("http")
+			g.Assert(conf.Services[0].Port).Eql(4101)
+			g.Assert(conf.Services[0].Zone).Eql("eu-west")
+		})
+
+		g.It("can invalid configs be refused", func() {
+			for _, bad := range []string{
+				`{"services": [{"name": "x", "proto": "smoke", "port": 1}]}`,
+				`{"services": [{"name": "x", "proto": "http", "port": 1, "master": "none"}]}`,
+				`{"services": [{"name": "x", "proto": "udp", "port": 1, "tls": {"cert": "a", "key": "b"}}]}`,
+				`{"services": [{"name": "x", "proto": "http", "port": 1}, {"name": "x", "proto": "udp", "port": 2}]}`,
+			} {
+				conf, err := Parse([]byte(bad), "json")
+				g.Assert(err == nil).IsTrue(bad)
+				g.Assert(conf.Validate() != nil).IsTrue(bad)
+			}
+		})
+
+		g.It("can a config file be built into services", func() {
+			dir, _ := ioutil.TempDir("", "config")
+			defer os.RemoveAll(dir)
+
+			file := filepath.Join(dir, "stack.json")
+			ioutil.WriteFile(file, []byte(stack), 0644)
+
+			conf, err := Load(file)
+			g.Assert(err == nil).IsTrue("config was loaded")
+
+			st, err := conf.Build()
+			g.Assert(err == nil).IsTrue("config was built")
+			g.Assert(st.Masters["main"].GetPrefix()).Eql("master")
+
+			models, ok := st.Instance("models")
+			g.Assert(ok).IsTrue("models was built")
+			g.Assert(models.Service.Master == nil).IsTrue("masters are joined on start")
+			g.Assert(models.Service.RequestTimeout).Eql(2 * time.Second)
+			g.Assert(models.Service.Factory.Has("udp")).IsTrue()
+			g.Assert(models.Service.Factory.Has("http")).IsFalse()
+
+			desc := models.Service.GetDescriptor()
+			g.Assert(desc.Zone).Eql("eu")
+			g.Assert(desc.Misc["version"]).Eql("2")
+
+			feed, _ := st.Instance("feed")
+			_, ok = feed.Server.(*services.WebSocketService)
+			g.Assert(ok).IsTrue("feed is a websocket service")
+			g.Assert(feed.Service.GetDescriptor().Scheme).Eql("https")
+		})
+	})
+}
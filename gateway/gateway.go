@@ -0,0 +1,429 @@
+//Package gateway provides a http gateway which proxies requests for /{service}/...
+//to the providers registered with a master, over whichever protocol they speak
+
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/influx6/composelab/arch"
+	"github.com/influx6/composelab/metrics"
+	"github.com/influx6/composelab/trace"
+	"github.com/influx6/goutils"
+)
+
+//DefaultTimeout is the time providers have to answer a proxied request
+var DefaultTimeout = 30 * time.Second
+
+//DefaultCooldown is the time a provider which failed is left out of the rotation
+var DefaultCooldown = 10 * time.Second
+
+//hopHeaders are the headers which only apply to a single connection and are never proxied
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+//Route configures how the gateway proxies the requests of one service
+type Route struct {
+	Timeout       time.Duration     //replaces the gateway's Timeout when set
+	SetHeaders    map[string]string //headers set on requests sent to providers
+	RemoveHeaders []string          //headers removed from requests sent to providers
+}
+
+//rewrite applies the route's header changes
+func (rt *Route) rewrite(h http.Header) {
+	if rt == nil {
+		return
+	}
+
+	for _, name := range rt.RemoveHeaders {
+		h.Del(name)
+	}
+
+	for name, value := range rt.SetHeaders {
+		h.Set(name, value)
+	}
+}
+
+//Gateway proxies http requests for /{service}/... to a healthy provider of the
+//service, picked in turn from the providers its Registry lists. Links to providers
+//are made with its Factory so any protocol the factory resolves can be proxied to.
+//With a Tracer every proxied request is recorded as a link span under the trace
+//headers it came in with
+type Gateway struct {
+	Registry Registry
+	Factory  *arch.Factory
+	Tracer   *trace.Tracer
+	Timeout  time.Duration
+	Cooldown time.Duration
+	lock     sync.Mutex
+	routes   map[string]*Route
+	links    map[string]map[string]arch.Linkage
+	down     map[string]time.Time
+	turns    map[string]int
+	measured map[*metrics.Registry]bool
+}
+
+//NewGateway returns a gateway proxying to the providers the registry lists through
+//links resolved by the factory
+func NewGateway(registry Registry, factory *arch.Factory) *Gateway {
+	return &Gateway{
+		Registry: registry,
+		Factory:  factory,
+		Timeout:  DefaultTimeout,
+		Cooldown: DefaultCooldown,
+		routes:   make(map[string]*Route),
+		links:    make(map[string]map[string]arch.Linkage),
+		down:     make(map[string]time.Time),
+		turns:    make(map[string]int),
+		measured: make(map[*metrics.Registry]bool),
+	}
+}
+
+//Route sets how the requests of the service are proxied
+func (g *Gateway) Route(service string, rt *Route) *Gateway {
+	g.lock.Lock()
+	g.routes[service] = rt
+	g.lock.Unlock()
+	return g
+}
+
+//ListenAndServe serves the gateway on the address
+func (g *Gateway) ListenAndServe(addr string) error {
+	return http.ListenAndServe(addr, g)
+}
+
+//ServeHTTP proxies the request to a provider of the service named by its first path
+//segment, trying the next healthy provider when one cannot be reached. Unknown
+//services are answered with a 404, registries which fail to list providers with a
+//*RegistryError's 502 or 503, services without a healthy provider with a 503 and
+//providers which do not answer in time with a 504 without being marked down
+func (g *Gateway) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	parts := goutils.SplitPattern(r.URL.Path)
+
+	if len(parts) <= 0 {
+		writeError(rw, http.StatusNotFound, "no service requested")
+		return
+	}
+
+	service := parts[0]
+	path := strings.Join(parts[1:], "/")
+
+	providers, err := g.Registry.Providers(service)
+
+	if re, ok := err.(*RegistryError); ok {
+		writeError(rw, re.Status(), re.Error())
+		return
+	}
+
+	if err != nil || len(providers) <= 0 {
+		writeError(rw, http.StatusNotFound, "no service named "+service)
+		return
+	}
+
+	g.prune(service, providers)
+
+	var body []byte
+
+	if r.Body != nil {
+		body, _ = ioutil.ReadAll(r.Body)
+	}
+
+	id := r.Header.Get("X-Request-UUID")
+
+	if id == "" {
+		id = uuid.New()
+	}
+
+	for range providers {
+		desc := g.pick(service, providers)
+
+		if desc == nil {
+			break
+		}
+
+		link, err := g.link(service, desc)
+
+		if err != nil {
+			g.markDown(desc)
+			continue
+		}
+
+		if g.proxy(rw, r, link, desc, service, path, body, id) {
+			return
+		}
+	}
+
+	writeError(rw, http.StatusServiceUnavailable, "no healthy provider of "+service)
+}
+
+//reply is the answer of a provider
+type reply struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+//proxy sends the request over the link and writes the provider's reply, it returns
+//false without writing anything if the provider could not be reached
+func (g *Gateway) proxy(rw http.ResponseWriter, r *http.Request, link arch.Linkage, desc *arch.LinkDescriptor, service, path string, body []byte, id string) bool {
+	rt := g.route(service)
+	tc := trace.Extract(r.Header)
+	span := g.Tracer.Start(trace.LinkSpan, service+"/"+path, tc)
+	span.Set("target", service)
+	span.Set("provider", desc.UUID)
+	span.Set("request", id)
+	defer span.Finish()
+
+	if span != nil {
+		tc = span.Context()
+	}
+
+	replies := make(chan *reply, 1)
+	failed := make(chan error, 1)
+
+	var rd io.Reader
+
+	if len(body) > 0 {
+		rd = bytes.NewReader(body)
+	}
+
+	go func() {
+		err := link.Request(path, service, rd, func(m ...interface{}) {
+			g.outgoing(r, rt, id, tc, m...)
+		}, func(m ...interface{}) {
+			select {
+			case replies <- incoming(m...):
+			default:
+			}
+		})
+
+		if err != nil {
+			failed <- err
+		}
+	}()
+
+	timeout := g.Timeout
+
+	if rt != nil && rt.Timeout > 0 {
+		timeout = rt.Timeout
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case rep := <-replies:
+		if rep == nil {
+			span.Fail(errors.New("provider sent an unknown reply"))
+			g.markDown(desc)
+			return false
+		}
+
+		span.Set("status", strconv.Itoa(rep.status))
+
+		for name, values := range rep.header {
+			for _, v := range values {
+				rw.Header().Add(name, v)
+			}
+		}
+
+		removeHopHeaders(rw.Header())
+		rw.Header().Set("X-Request-UUID", id)
+		rw.WriteHeader(rep.status)
+		rw.Write(rep.body)
+		return true
+	case err := <-failed:
+		span.Fail(err)
+		g.markDown(desc)
+		return false
+	case <-timer.C:
+		//the timeout is the caller's, the provider may only be slow so it is not marked down
+		span.Fail(errors.New("provider did not answer in time"))
+		writeError(rw, http.StatusGatewayTimeout, service+" did not answer in time")
+		return true
+	}
+}
+
+//outgoing prepares the request sent to a provider, http requests get the headers,
+//method and query of the incoming request and udp packs get its id, both get the
+//trace context
+func (g *Gateway) outgoing(in *http.Request, rt *Route, id string, tc trace.Context, m ...interface{}) {
+	if len(m) <= 0 {
+		return
+	}
+
+	switch out := m[0].(type) {
+	case *http.Request:
+		for name, values := range in.Header {
+			out.Header[name] = append([]string(nil), values...)
+		}
+
+		removeHopHeaders(out.Header)
+
+		if host, _, err := net.SplitHostPort(in.RemoteAddr); err == nil {
+			if prior := in.Header.Get("X-Forwarded-For"); prior != "" {
+				host = prior + ", " + host
+			}
+			out.Header.Set("X-Forwarded-For", host)
+		}
+
+		out.Header.Set("X-Forwarded-Host", in.Host)
+		out.Header.Set("X-Request-UUID", id)
+		trace.Inject(out.Header, tc)
+		out.Method = in.Method
+		out.URL.RawQuery = in.URL.RawQuery
+		rt.rewrite(out.Header)
+	case *arch.UDPPack:
+		out.UUID = id
+		out.Trace, out.Span = tc.TraceID, tc.SpanID
+	}
+}
+
+//incoming turns the reply of a http or udp link into a reply, it returns nil for
+//replies it does not know
+func incoming(m ...interface{}) *reply {
+	if len(m) <= 0 {
+		return nil
+	}
+
+	switch in := m[0].(type) {
+	case []byte:
+		if len(m) > 1 {
+			if res, ok := m[1].(*http.Response); ok {
+				return &reply{res.StatusCode, res.Header, in}
+			}
+		}
+	case *arch.UDPPack:
+		header := make(http.Header)
+
+		if e, ok := arch.ParseError(in.Data); ok {
+			header.Set("Content-Type", "application/json")
+			return &reply{e.Code, header, in.Data}
+		}
+
+		if json.Valid(in.Data) {
+			header.Set("Content-Type", "application/json")
+		}
+
+		return &reply{http.StatusOK, header, in.Data}
+	}
+
+	return nil
+}
+
+//route returns the route of the service
+func (g *Gateway) route(service string) *Route {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.routes[service]
+}
+
+//pick returns the next healthy provider of the service in turn
+func (g *Gateway) pick(service string, providers []*arch.LinkDescriptor) *arch.LinkDescriptor {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	now := time.Now()
+
+	for i := 0; i < len(providers); i++ {
+		turn := g.turns[service] % len(providers)
+		g.turns[service] = turn + 1
+
+		desc := providers[turn]
+
+		if until, ok := g.down[desc.UUID]; ok && now.Before(until) {
+			continue
+		}
+
+		return desc
+	}
+
+	return nil
+}
+
+//markDown leaves the provider out of the rotation for the cooldown
+func (g *Gateway) markDown(desc *arch.LinkDescriptor) {
+	g.lock.Lock()
+	g.down[desc.UUID] = time.Now().Add(g.Cooldown)
+	g.lock.Unlock()
+}
+
+//link returns the link to the provider, resolving and dialing it the first time
+func (g *Gateway) link(service string, desc *arch.LinkDescriptor) (arch.Linkage, error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	links, ok := g.links[service]
+
+	if !ok {
+		links = make(map[string]arch.Linkage)
+		g.links[service] = links
+	}
+
+	if link, ok := links[desc.UUID]; ok {
+		return link, nil
+	}
+
+	link, err := g.Factory.Resolve(desc)
+
+	if err != nil {
+		return nil, err
+	}
+
+	link.Dial()
+	links[desc.UUID] = link
+	return link, nil
+}
+
+//prune ends the links to providers of the service which are no longer registered
+func (g *Gateway) prune(service string, providers []*arch.LinkDescriptor) {
+	current := make(map[string]bool, len(providers))
+
+	for _, desc := range providers {
+		current[desc.UUID] = true
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	for id, link := range g.links[service] {
+		if !current[id] {
+			link.End()
+			delete(g.links[service], id)
+			delete(g.down, id)
+		}
+	}
+}
+
+//removeHopHeaders removes the headers which are never proxied
+func removeHopHeaders(h http.Header) {
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+//writeError answers with a json error body
+func writeError(rw http.ResponseWriter, status int, message string) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	rw.Write(arch.ErrorBody(status, message))
+}
@@ -0,0 +1,191 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/franela/goblin"
+	"github.com/influx6/composelab/arch"
+	"github.com/influx6/composelab/links"
+	"github.com/influx6/composelab/metrics"
+)
+
+//deadLink is a provider link which can never be reached
+type deadLink struct {
+	*arch.ServiceLink
+}
+
+func (d *deadLink) Request(path, target string, body io.Reader, before, after func(...interface{})) error {
+	return errors.New("connection refused")
+}
+
+//slowLink is a provider link which never answers
+type slowLink struct {
+	*arch.ServiceLink
+}
+
+func (s *slowLink) Request(path, target string, body io.Reader, before, after func(...interface{})) error {
+	return nil
+}
+
+//fakeMaster lists providers of services with the error or never answers when silent
+type fakeMaster struct {
+	*arch.ServiceLink
+	fails  error
+	meta   interface{}
+	silent bool
+}
+
+func (f *fakeMaster) Providers(target string, cb func(string, []*arch.LinkDescriptor, interface{})) error {
+	if f.fails != nil || f.silent {
+		return f.fails
+	}
+
+	cb(target, nil, f.meta)
+	return nil
+}
+
+func TestGateway(t *testing.T) {
+	g := goblin.Goblin(t)
+
+	provider := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		rw.Header().Set("X-Seen-Token", r.Header.Get("X-Token"))
+		rw.Header().Set("X-Seen-Secret", r.Header.Get("X-Secret"))
+		rw.Header().Set("X-Seen-Request", r.Header.Get("X-Request-UUID"))
+		rw.WriteHeader(201)
+		fmt.Fprintf(rw, "%s %s %s", r.Method, r.URL.Path, body)
+	}))
+	defer provider.Close()
+
+	addr, _ := url.Parse(provider.URL)
+	port, _ := strconv.Atoi(addr.Port())
+
+	live := arch.NewDescriptor("http", "models", addr.Hostname(), port, "0", "http")
+	dead := arch.NewDescriptor("dead", "models", "127.0.0.1", 1, "0", "http")
+	slow := arch.NewDescriptor("slow", "views", "127.0.0.1", 2, "0", "http")
+	gone := arch.NewDescriptor("dead", "logs", "127.0.0.1", 3, "0", "http")
+
+	factory := links.NewFactory()
+	factory.Provide("dead", func(d *arch.LinkDescriptor) (arch.Linkage, error) {
+		return &deadLink{arch.NewServiceLink(d)}, nil
+	})
+	factory.Provide("slow", func(d *arch.LinkDescriptor) (arch.Linkage, error) {
+		return &slowLink{arch.NewServiceLink(d)}, nil
+	})
+
+	registry := map[string][]*arch.LinkDescriptor{
+		"models": {dead, live},
+		"views":  {slow},
+		"logs":   {gone},
+	}
+
+	gw := NewGateway(RegistryFunc(func(service string) ([]*arch.LinkDescriptor, error) {
+		if service == "broken" {
+			return nil, &RegistryError{service, ErrLookupTimeout}
+		}
+
+		providers, ok := registry[service]
+		if !ok {
+			return nil, fmt.Errorf("%s not found", service)
+		}
+		return providers, nil
+	}), factory)
+
+	gw.Route("models", &Route{
+		SetHeaders:    map[string]string{"X-Token": "gateway"},
+		RemoveHeaders: []string{"X-Secret"},
+	})
+
+	gw.Route("views", &Route{Timeout: 50 * time.Millisecond})
+
+	g.Describe("Gateway specification", func() {
+
+		g.It("can a request be proxied past a dead provider", func() {
+			req := httptest.NewRequest("PUT", "/models/3?full=1", nil)
+			req.Header.Set("X-Secret", "hidden")
+			req.Header.Set("X-Request-UUID", "req-1")
+			rec := httptest.NewRecorder()
+
+			gw.ServeHTTP(rec, req)
+
+			g.Assert(rec.Code).Eql(201)
+			g.Assert(rec.Body.String()).Eql("PUT /models/3 ")
+			g.Assert(rec.Header().Get("X-Seen-Token")).Eql("gateway")
+			g.Assert(rec.Header().Get("X-Seen-Secret")).Eql("")
+			g.Assert(rec.Header().Get("X-Seen-Request")).Eql("req-1")
+		})
+
+		g.It("can unknown services get a 404", func() {
+			rec := httptest.NewRecorder()
+			gw.ServeHTTP(rec, httptest.NewRequest("GET", "/unknown/3", nil))
+			g.Assert(rec.Code).Eql(404)
+		})
+
+		g.It("can failing registries get a 503 or 502 rather than a 404", func() {
+			rec := httptest.NewRecorder()
+			gw.ServeHTTP(rec, httptest.NewRequest("GET", "/broken/3", nil))
+			g.Assert(rec.Code).Eql(503)
+
+			lr := NewLinkRegistry(&fakeMaster{ServiceLink: arch.NewServiceLink(dead), fails: errors.New("connection refused")}, time.Second)
+			_, err := lr.Providers("models")
+			re, ok := err.(*RegistryError)
+			g.Assert(ok).IsTrue("unreachable masters are a *RegistryError")
+			g.Assert(re.Status()).Eql(502)
+
+			lr = NewLinkRegistry(&fakeMaster{ServiceLink: arch.NewServiceLink(dead), meta: arch.NewError(500, "broken")}, time.Second)
+			_, err = lr.Providers("models")
+			re, ok = err.(*RegistryError)
+			g.Assert(ok).IsTrue("masters failing to list are a *RegistryError")
+			g.Assert(re.Status()).Eql(502)
+
+			lr = NewLinkRegistry(&fakeMaster{ServiceLink: arch.NewServiceLink(dead), silent: true}, time.Second)
+			lr.Timeout = 10 * time.Millisecond
+			_, err = lr.Providers("models")
+			re, ok = err.(*RegistryError)
+			g.Assert(ok).IsTrue("silent masters are a *RegistryError")
+			g.Assert(re.Status()).Eql(503)
+
+			lr = NewLinkRegistry(&fakeMaster{ServiceLink: arch.NewServiceLink(dead), meta: arch.NewError(404, "models not found")}, time.Second)
+			_, err = lr.Providers("models")
+			_, ok = err.(*RegistryError)
+			g.Assert(err != nil && !ok).IsTrue("unknown services are not a registry failure")
+		})
+
+		g.It("can slow providers get a 504 and not be marked down", func() {
+			rec := httptest.NewRecorder()
+			gw.ServeHTTP(rec, httptest.NewRequest("GET", "/views/home", nil))
+			g.Assert(rec.Code).Eql(504)
+
+			rec = httptest.NewRecorder()
+			gw.ServeHTTP(rec, httptest.NewRequest("GET", "/views/home", nil))
+			g.Assert(rec.Code).Eql(504)
+		})
+
+		g.It("can services without healthy providers get a 503", func() {
+			rec := httptest.NewRecorder()
+			gw.ServeHTTP(rec, httptest.NewRequest("GET", "/logs/home", nil))
+			g.Assert(rec.Code).Eql(503)
+		})
+
+		g.It("can the gateway be measured with the same registry more than once", func() {
+			reg := metrics.NewRegistry()
+			gw.Measure(reg)
+			gw.Measure(reg)
+
+			gw.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/models/3", nil))
+
+			text := string(reg.Text())
+			g.Assert(strings.Count(text, `composelab_gateway_providers{service="models",state="healthy"}`)).Eql(1)
+		})
+	})
+}
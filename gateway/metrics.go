@@ -0,0 +1,89 @@
+package gateway
+
+import (
+	"sort"
+	"time"
+
+	"github.com/influx6/composelab/arch"
+	"github.com/influx6/composelab/metrics"
+	"github.com/influx6/composelab/trace"
+)
+
+//Measure adds the metrics of the gateway to the registry, proxied requests are
+//counted and timed by target service from their link spans and the providers of the
+//services the gateway has proxied to are counted by whether they are healthy or down.
+//Measuring the gateway with the same registry again adds nothing
+func (g *Gateway) Measure(reg *metrics.Registry) {
+	g.lock.Lock()
+	measured := g.measured[reg]
+	g.measured[reg] = true
+	g.lock.Unlock()
+
+	if measured {
+		return
+	}
+
+	sm := metrics.NewSpanMetrics(reg)
+
+	if g.Tracer == nil {
+		g.Tracer = trace.NewTracer("gateway", sm)
+	} else {
+		g.Tracer.AddExporter(sm)
+	}
+
+	reg.GaugeFunc("composelab_gateway_providers", "Providers of the services proxied by the gateway by health.", func(set func(float64, ...string)) {
+		for _, service := range g.services() {
+			providers, err := g.Registry.Providers(service)
+
+			if err != nil {
+				continue
+			}
+
+			down := g.downCount(providers)
+			set(float64(len(providers)-down), service, "healthy")
+			set(float64(down), service, "down")
+		}
+	}, "service", "state")
+}
+
+//services returns the names of the services the gateway has proxied to or has routes for
+func (g *Gateway) services() []string {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	seen := make(map[string]bool)
+
+	for service := range g.links {
+		seen[service] = true
+	}
+
+	for service := range g.routes {
+		seen[service] = true
+	}
+
+	names := make([]string, 0, len(seen))
+
+	for service := range seen {
+		names = append(names, service)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+//downCount returns how many of the providers are out of the rotation
+func (g *Gateway) downCount(providers []*arch.LinkDescriptor) int {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	now := time.Now()
+	down := 0
+
+	for _, desc := range providers {
+		if until, ok := g.down[desc.UUID]; ok && now.Before(until) {
+			down++
+		}
+	}
+
+	return down
+}
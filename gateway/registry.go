@@ -0,0 +1,141 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/influx6/composelab/arch"
+)
+
+//Registry gives the gateway the providers currently registered for a service. A
+//registry which could not list the providers returns a *RegistryError, other errors
+//mean the service has no providers
+type Registry interface {
+	Providers(service string) ([]*arch.LinkDescriptor, error)
+}
+
+//ErrLookupTimeout is the error of a RegistryError when the master did not list the
+//providers in time
+var ErrLookupTimeout = errors.New("master did not list providers in time")
+
+//RegistryError is returned by registries which failed to list the providers of a
+//service, the gateway answers it with a 503 if the master did not answer in time and
+//with a 502 otherwise
+type RegistryError struct {
+	Service string
+	Err     error
+}
+
+//Error returns the message of the error
+func (r *RegistryError) Error() string {
+	return fmt.Sprintf("unable to list providers of %s: %s", r.Service, r.Err)
+}
+
+//Status returns the status the gateway answers the error with
+func (r *RegistryError) Status() int {
+	if r.Err == ErrLookupTimeout {
+		return 503
+	}
+	return 502
+}
+
+//RegistryFunc adapts a function into a Registry
+type RegistryFunc func(service string) ([]*arch.LinkDescriptor, error)
+
+//Providers calls the function
+func (r RegistryFunc) Providers(service string) ([]*arch.LinkDescriptor, error) {
+	return r(service)
+}
+
+//ServiceRegistry returns a Registry reading the registry of a master service running
+//in the same process
+func ServiceRegistry(master *arch.Service) Registry {
+	return RegistryFunc(master.GetServiceProviders)
+}
+
+//DefaultLookupTimeout is the time a LinkRegistry waits for the master to list providers
+var DefaultLookupTimeout = 5 * time.Second
+
+//LinkRegistry asks a remote master for the providers of services through a link,
+//keeping each answer for its ttl so the master is not asked on every request
+type LinkRegistry struct {
+	Master  arch.Linkage
+	TTL     time.Duration
+	Timeout time.Duration
+	lock    sync.Mutex
+	cache   map[string]*lookup
+}
+
+//lookup is a cached provider list
+type lookup struct {
+	providers []*arch.LinkDescriptor
+	expires   time.Time
+}
+
+//NewLinkRegistry returns a LinkRegistry asking the master, answers are kept for the ttl
+func NewLinkRegistry(master arch.Linkage, ttl time.Duration) *LinkRegistry {
+	return &LinkRegistry{
+		Master:  master,
+		TTL:     ttl,
+		Timeout: DefaultLookupTimeout,
+		cache:   make(map[string]*lookup),
+	}
+}
+
+//Providers returns the providers of the service from the cache or from the master
+func (l *LinkRegistry) Providers(service string) ([]*arch.LinkDescriptor, error) {
+	l.lock.Lock()
+	cached, ok := l.cache[service]
+	l.lock.Unlock()
+
+	if ok && time.Now().Before(cached.expires) {
+		return cached.providers, nil
+	}
+
+	type listing struct {
+		providers []*arch.LinkDescriptor
+		err       error
+	}
+
+	found := make(chan listing, 1)
+
+	err := l.Master.Providers(service, func(_ string, providers []*arch.LinkDescriptor, meta interface{}) {
+		ls := listing{providers: providers}
+
+		if e, ok := meta.(error); ok {
+			ls.err = e
+		}
+
+		select {
+		case found <- ls:
+		default:
+		}
+	})
+
+	if err != nil {
+		return nil, &RegistryError{service, err}
+	}
+
+	select {
+	case ls := <-found:
+		if ls.err != nil {
+			if e, ok := ls.err.(*arch.Error); !ok || e.Code != 404 {
+				return nil, &RegistryError{service, ls.err}
+			}
+		}
+
+		if len(ls.providers) <= 0 {
+			return nil, fmt.Errorf("%s not found", service)
+		}
+
+		l.lock.Lock()
+		l.cache[service] = &lookup{ls.providers, time.Now().Add(l.TTL)}
+		l.lock.Unlock()
+
+		return ls.providers, nil
+	case <-time.After(l.Timeout):
+		return nil, &RegistryError{service, ErrLookupTimeout}
+	}
+}
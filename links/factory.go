@@ -0,0 +1,50 @@
+package links
+
+import (
+	"net/http"
+
+	"github.com/influx6/composelab/arch"
+)
+
+//NewFactory returns an arch.Factory resolving 'http' descriptors into HTTPLinks, with
+//https for an 'https' scheme, and 'udp' descriptors into UDPLinks
+func NewFactory() *arch.Factory {
+	f := arch.NewFactory()
+
+	f.Provide("http", func(d *arch.LinkDescriptor) (arch.Linkage, error) {
+		var hl *HTTPLink
+
+		if d.Scheme == "https" {
+			hl = NewSecureHTTPLink(d.Service, d.Address, d.Port, &http.Transport{})
+		} else {
+			hl = NewHTTPLink(d.Service, d.Address, d.Port)
+		}
+
+		adopt(hl.GetDescriptor(), d)
+		return hl, nil
+	})
+
+	f.Provide("udp", func(d *arch.LinkDescriptor) (arch.Linkage, error) {
+		ul, err := NewUDPLink(d.Service, d.Address, d.Port)
+
+		if err != nil {
+			return nil, err
+		}
+
+		adopt(ul.GetDescriptor(), d)
+		return ul, nil
+	})
+
+	return f
+}
+
+//adopt gives a link's descriptor the identity and misc details of the descriptor it
+//was resolved from
+func adopt(link, from *arch.LinkDescriptor) {
+	link.UUID = from.UUID
+	link.Zone = from.Zone
+
+	for k, v := range from.Misc {
+		link.Misc[k] = v
+	}
+}
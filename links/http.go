@@ -2,16 +2,17 @@ package links
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 
 	"code.google.com/p/go-uuid/uuid"
 
 	"github.com/influx6/composelab/arch"
+	"github.com/influx6/composelab/trace"
 )
 
 //HTTPLink represents a standard servicelink using http underneath
@@ -45,7 +46,8 @@ func NewHTTPWrap(h *HTTPLink) arch.Linkage {
 	return arch.Linkage(h)
 }
 
-//Discover sends a request to the set server links if a service exists
+//Discover sends a request to the set server links if a service exists, a server
+//answering with an error hands the callback a nil descriptor and the *arch.Error
 func (hl *HTTPLink) Discover(target string, callback func(string, interface{}, interface{})) error {
 	url := fmt.Sprintf("%s/%s", "discover", target)
 
@@ -64,41 +66,68 @@ func (hl *HTTPLink) Discover(target string, callback func(string, interface{}, i
 
 	}, func(rsd ...interface{}) {
 
-		body, ok := rsd[0].([]byte)
+		body, _ := rsd[0].([]byte)
+		res, ok := rsd[1].(*http.Response)
 
 		if !ok {
-			log.Fatal("body not available", body)
+			hl.Logger().Warn("discover reply has no response", arch.Fields{"target": target})
+			callback(target, nil, nil)
 			return
 		}
 
-		res, ok := rsd[1].(*http.Response)
+		if err := arch.LinkError(rsd...); err != nil {
+			callback(target, nil, err)
+			return
+		}
 
-		if !ok {
-			log.Fatal("response object not available", res, ok)
+		jsn := new(arch.LinkDescriptor)
+
+		if err := json.Unmarshal(body, jsn); err != nil {
+			hl.Logger().Warn("invalid discover reply", arch.Fields{"target": target, "status": res.StatusCode, "err": err})
+			callback(target, nil, res)
 			return
 		}
 
-		req, ok := rsd[2].(*http.Request)
+		callback(target, jsn, res)
+	})
+}
+
+//Providers requests the descriptors of every provider of a service from the server,
+//a server answering with an error hands the callback the *arch.Error
+func (hl *HTTPLink) Providers(target string, callback func(string, []*arch.LinkDescriptor, interface{})) error {
+	url := fmt.Sprintf("%s/%s", "providers", target)
+
+	return hl.Request(url, target, nil, func(sets ...interface{}) {
+		req, ok := sets[0].(*http.Request)
 
 		if !ok {
-			log.Fatal("request object not available", req)
 			return
 		}
 
-		status := res.StatusCode
+		req.Header.Set("X-Request-UUID", uuid.New())
+		req.Header.Set("Content-Type", "application/json")
+
+	}, func(rsd ...interface{}) {
+		body, _ := rsd[0].([]byte)
+		res, ok := rsd[1].(*http.Response)
 
-		if status == 200 || status == 201 || status == 304 {
+		if !ok {
+			callback(target, nil, nil)
+			return
+		}
 
-			jsn := new(arch.LinkDescriptor)
-			err := json.Unmarshal(body, jsn)
+		if err := arch.LinkError(rsd...); err != nil {
+			callback(target, nil, err)
+			return
+		}
 
-			if err != nil {
-				log.Fatal("json umarshalling error with /discover", err, req, res)
-				return
-			}
+		var providers []*arch.LinkDescriptor
 
-			callback(target, jsn, res)
+		if err := json.Unmarshal(body, &providers); err != nil {
+			hl.Logger().Warn("invalid providers reply", arch.Fields{"target": target, "err": err})
 		}
+
+		callback(target, providers, res)
 	})
 }
 
@@ -163,6 +192,13 @@ func (hl *HTTPLink) Unregister(target string, meta *arch.LinkDescriptor, cb func
 
 //Request provides a means of providing a generic requests to the server
 func (hl *HTTPLink) Request(fpath, target string, body io.Reader, before func(r ...interface{}), after func(r ...interface{})) error {
+	return hl.RequestContext(context.Background(), fpath, target, body, before, after)
+}
+
+//RequestContext sends a request as Request does under the context, which cancels it
+//and whose trace context, as set by trace.NewContext or routes.OutgoingContext, is
+//sent in the trace headers
+func (hl *HTTPLink) RequestContext(ctx context.Context, fpath, target string, body io.Reader, before func(r ...interface{}), after func(r ...interface{})) error {
 	path := fmt.Sprintf("%s://%s/%s/%s", hl.GetDescriptor().Scheme, hl.GetPath(), hl.GetPrefix(), fpath)
 	var req *http.Request
 	var err error
@@ -182,15 +218,16 @@ func (hl *HTTPLink) Request(fpath, target string, body io.Reader, before func(r
 		}
 	}
 
+	req = req.WithContext(ctx)
 	req.Header.Set("X-Service-Request", hl.GetPath())
 	req.Header.Set("X-Service-Request-Target", target)
+	trace.Inject(req.Header, trace.FromContext(ctx))
 
 	before(req, target)
 
 	res, err := hl.client.Do(req)
 
 	if err != nil {
-		log.Fatal("Response errored:", fpath, target, err)
 		return err
 	}
 
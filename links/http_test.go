@@ -1,10 +1,16 @@
 package links
 
 import (
+	"context"
 	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
 	"testing"
 
 	"github.com/franela/goblin"
+	"github.com/influx6/composelab/trace"
 )
 
 func TestHTTPClient(t *testing.T) {
@@ -13,4 +19,26 @@ func TestHTTPClient(t *testing.T) {
 	g.Describe("Create HttpClient", func() {
 		log.Println("new client")
 	})
+
+	g.Describe("HTTPLink requests", func() {
+
+		g.It("can requests carry the trace context they are made in", func() {
+			var got trace.Context
+			srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				got = trace.Extract(r.Header)
+				rw.Write([]byte(`{}`))
+			}))
+			defer srv.Close()
+
+			u, _ := url.Parse(srv.URL)
+			port, _ := strconv.Atoi(u.Port())
+			link := NewHTTPLink("models", u.Hostname(), port)
+
+			ctx := trace.NewContext(context.Background(), trace.Context{TraceID: "t1", SpanID: "s1"})
+			err := link.RequestContext(ctx, "models/3", "models", nil, func(...interface{}) {}, func(...interface{}) {})
+
+			g.Assert(err == nil).IsTrue("request was sent")
+			g.Assert(got).Eql(trace.Context{TraceID: "t1", SpanID: "s1"})
+		})
+	})
 }
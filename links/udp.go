@@ -1,19 +1,24 @@
 package links
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net"
 
 	"code.google.com/p/go-uuid/uuid"
 
 	"github.com/influx6/composelab/arch"
+	"github.com/influx6/composelab/trace"
 	"github.com/influx6/goutils"
 )
 
+//ErrNotDialed is returned by requests made over a udp link which is not dialed
+var ErrNotDialed = errors.New("udp link is not dialed")
+
 //UDPLink handles udp level communication
 type UDPLink struct {
 	*arch.ServiceLink
@@ -30,14 +35,12 @@ func NewUDPLink(serviceName string, addr string, port int) (*UDPLink, error) {
 	udpAddr, err := net.ResolveUDPAddr("udp4", address)
 
 	if err != nil {
-		log.Fatalf("Error generating udp address: %v %s %s %d", err, address, addr, port)
 		return nil, err
 	}
 
 	cAddr, err := net.ResolveUDPAddr("udp4", ":0")
 
 	if err != nil {
-		log.Fatal("Error generating custom client udp address: ", err, cAddr)
 		return nil, err
 	}
 
@@ -48,8 +51,8 @@ func NewUDPLink(serviceName string, addr string, port int) (*UDPLink, error) {
 		nil,
 		udpAddr,
 		cAddr,
-		make([]byte, 1024),
-		make(chan interface{}),
+		make([]byte, 64<<10),
+		nil,
 	}, nil
 }
 
@@ -58,27 +61,34 @@ func NewUDPWrap(h *UDPLink) arch.Linkage {
 	return arch.Linkage(h)
 }
 
-//ReceiveDatagrams reads data from the server
+//ReceiveDatagrams reads data from the server till the link ends or the connection
+//fails, a failed connection is logged
 func (u *UDPLink) ReceiveDatagrams() {
+	u.receive(u.Conn, u.closer)
+}
+
+func (u *UDPLink) receive(conn *net.UDPConn, closer chan interface{}) {
 	for {
-		select {
-		case <-u.closer:
-			u.Conn.Close()
-		default:
-			len, _, err := u.Conn.ReadFromUDP(u.buffer)
-
-			if err != nil {
-				log.Fatal("Error reading udp", err)
-				// u.closer <- 1
-				return
-			}
+		len, _, err := conn.ReadFromUDP(u.buffer)
 
-			u.Send(u.buffer[:len])
+		if err != nil {
+			select {
+			case <-closer:
+			default:
+				u.Logger().Error("udp link stopped reading", arch.Fields{"link": u.GetPath(), "err": err})
+			}
+			return
 		}
+
+		//the buffer is read into again before the reply is handled
+		data := make([]byte, len)
+		copy(data, u.buffer[:len])
+		u.Send(data)
 	}
 }
 
-//Dial startup the service link
+//Dial startup the service link, a link which can not connect is logged and left
+//undialed
 func (u *UDPLink) Dial() {
 	if u.Conn != nil {
 		return
@@ -87,27 +97,34 @@ func (u *UDPLink) Dial() {
 	conn, err := net.DialUDP("udp", u.MyAddr, u.ToAddr)
 
 	if err != nil {
-		log.Fatalf("Error creating udp connection: %v %s", err, u.GetPath())
+		u.Logger().Error("unable to dial udp link", arch.Fields{"link": u.GetPath(), "err": err})
 		return
 	}
 
+	u.closer = make(chan interface{})
 	u.Conn = conn
 	//bootup and listen for data
-	go u.ReceiveDatagrams()
+	go u.receive(conn, u.closer)
+}
+
+//Connected returns true if the link is dialed and not ended, it meets arch.Connected
+func (u *UDPLink) Connected() bool {
+	return u.Conn != nil
 }
 
 //End calls to disconnect the udp link
 func (u *UDPLink) End() {
-	if u.closer == nil {
+	if u.Conn == nil {
 		return
 	}
 
-	u.closer <- 1
 	close(u.closer)
-	u.closer = nil
+	u.Conn.Close()
+	u.Conn = nil
 }
 
-//Discover meets the Linkage interface to request discovery from a server
+//Discover meets the Linkage interface to request discovery from a server, a server
+//answering with an error hands the callback a nil descriptor and the *arch.Error
 func (u *UDPLink) Discover(target string, callback func(string, interface{}, interface{})) error {
 	return u.Request("discover", target, nil, nil, func(d ...interface{}) {
 		//do something interesting
@@ -117,22 +134,54 @@ func (u *UDPLink) Discover(target string, callback func(string, interface{}, int
 		jsx, ok := rsm.(*arch.UDPPack)
 
 		if !ok {
-			log.Fatalf("response is not a UDPPack %v from %v ", rsm, jsm)
+			u.Logger().Warn("discover reply is not a udp pack", arch.Fields{"target": target, "request": jsm})
+			callback(target, nil, rsm)
 			return
 		}
 
-		var data interface{}
+		if err := arch.LinkError(jsx); err != nil {
+			callback(target, nil, err)
+			return
+		}
 
-		err := json.Unmarshal(jsx.Data, data)
+		desc := new(arch.LinkDescriptor)
+		err := json.Unmarshal(jsx.Data, desc)
 
-		if err != nil {
+		if err != nil || desc.Service == "" {
 			smx := goutils.MorphString.Morph(jsx.Data)
 			callback(target, smx, jsx)
 			return
 		}
 
-		callback(target, data, jsx)
+		callback(target, desc, jsx)
+
+	})
+}
+
+//Providers requests the descriptors of every provider of a service from the server,
+//a server answering with an error hands the callback the *arch.Error
+func (u *UDPLink) Providers(target string, callback func(string, []*arch.LinkDescriptor, interface{})) error {
+	return u.Request("providers", target, nil, nil, func(d ...interface{}) {
+		jsx, ok := d[0].(*arch.UDPPack)
+
+		if !ok {
+			callback(target, nil, d[0])
+			return
+		}
+
+		if err := arch.LinkError(jsx); err != nil {
+			callback(target, nil, err)
+			return
+		}
+
+		var providers []*arch.LinkDescriptor
 
+		if err := json.Unmarshal(jsx.Data, &providers); err != nil {
+			callback(target, nil, jsx)
+			return
+		}
+
+		callback(target, providers, jsx)
 	})
 }
 
@@ -142,7 +191,6 @@ func (u *UDPLink) Unregister(target string, meta *arch.LinkDescriptor, callback
 	// jsm, err := meta.MarshalJSON()
 
 	if err != nil {
-		log.Fatalf("error occured in coverting map with json %v %v", meta, err)
 		return err
 	}
 
@@ -169,7 +217,6 @@ func (u *UDPLink) Register(target string, meta *arch.LinkDescriptor, callback fu
 	// jsm, err := meta.MarshalJSON()
 
 	if err != nil {
-		log.Fatalf("error occured in coverting map with json %v %v", meta, err)
 		return err
 	}
 
@@ -190,8 +237,24 @@ func (u *UDPLink) Register(target string, meta *arch.LinkDescriptor, callback fu
 	return err
 }
 
-//Request sends information to the server for a response
+//Request sends information to the server for a response, requests too large for a
+//datagram are refused with arch.ErrDatagramTooLarge
 func (u *UDPLink) Request(tpath, target string, body io.Reader, before func(st ...interface{}), after func(smt ...interface{})) error {
+	return u.RequestContext(context.Background(), tpath, target, body, before, after)
+}
+
+//RequestContext sends a request as Request does, the pack carries the trace context
+//of the context, as set by trace.NewContext or routes.OutgoingContext, and is not sent
+//once the context is done
+func (u *UDPLink) RequestContext(ctx context.Context, tpath, target string, body io.Reader, before func(st ...interface{}), after func(smt ...interface{})) error {
+	if u.Conn == nil {
+		return ErrNotDialed
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	path := fmt.Sprintf("%s/%s", u.GetPrefix(), tpath)
 
 	dataChan := make(chan []byte)
@@ -215,6 +278,10 @@ func (u *UDPLink) Request(tpath, target string, body io.Reader, before func(st .
 
 	jp := arch.NewUDPPack(path, target, uuid.New(), dat, u.MyAddr)
 
+	if tc := trace.FromContext(ctx); tc.Valid() {
+		jp.Trace, jp.Span = tc.TraceID, tc.SpanID
+	}
+
 	if before != nil {
 		before(jp, target)
 	}
@@ -226,7 +293,13 @@ func (u *UDPLink) Request(tpath, target string, body io.Reader, before func(st .
 		return err
 	}
 
-	u.Conn.Write(jsn)
+	if len(jsn) > arch.MaxDatagram {
+		return arch.ErrDatagramTooLarge
+	}
+
+	if _, err := u.Conn.Write(jsn); err != nil {
+		return err
+	}
 
 	ind := u.Size() + 1
 
@@ -235,7 +308,7 @@ func (u *UDPLink) Request(tpath, target string, body io.Reader, before func(st .
 		bo, ok := data.([]byte)
 
 		if !ok {
-			log.Fatal("Incorrect packet comming in", data, bo)
+			u.Logger().Warn("dropped incorrect udp reply", arch.Fields{"link": u.GetPath(), "reply": data})
 			return
 		}
 
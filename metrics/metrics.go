@@ -0,0 +1,450 @@
+//Package metrics keeps counters, gauges and latency histograms for services and
+//writes them in the prometheus text exposition format
+
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//DefaultBuckets are the upper bounds in seconds of histograms created without buckets
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+//ContentType is the content type of the text exposition format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+//family is a metric and the values of each of its label sets
+type family interface {
+	write(w *bufio.Writer)
+}
+
+//Registry holds the metrics of a process, metrics are written in the order they were
+//added to the registry
+type Registry struct {
+	lock     sync.Mutex
+	names    map[string]family
+	families []family
+}
+
+//NewRegistry returns a new empty registry
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]family)}
+}
+
+//add returns the family with the name, creating it if it does not exist
+func (r *Registry) add(name string, create func() family) family {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if f, ok := r.names[name]; ok {
+		return f
+	}
+
+	f := create()
+	r.names[name] = f
+	r.families = append(r.families, f)
+	return f
+}
+
+//Counter returns the counter with the name, adding it with the help and label names
+//if the registry does not have it
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	f := r.add(name, func() family {
+		return &Counter{meta: newMeta(name, help, "counter", labels)}
+	})
+
+	c, ok := f.(*Counter)
+
+	if !ok {
+		panic(fmt.Sprintf("metric %s is not a counter", name))
+	}
+
+	return c
+}
+
+//Gauge returns the gauge with the name, adding it with the help and label names if
+//the registry does not have it
+func (r *Registry) Gauge(name, help string, labels ...string) *Gauge {
+	f := r.add(name, func() family {
+		return &Gauge{meta: newMeta(name, help, "gauge", labels)}
+	})
+
+	g, ok := f.(*Gauge)
+
+	if !ok {
+		panic(fmt.Sprintf("metric %s is not a gauge", name))
+	}
+
+	return g
+}
+
+//GaugeFunc adds a gauge whose values are read when the registry is written, the
+//function sets a value for each label set through set. Functions added under the
+//same name are all read
+func (r *Registry) GaugeFunc(name, help string, fx func(set func(value float64, values ...string)), labels ...string) {
+	r.collect(name, help, "gauge", fx, labels)
+}
+
+//CounterFunc adds a counter whose values are read when the registry is written, as
+//with GaugeFunc
+func (r *Registry) CounterFunc(name, help string, fx func(set func(value float64, values ...string)), labels ...string) {
+	r.collect(name, help, "counter", fx, labels)
+}
+
+//collect adds the function to the collector with the name
+func (r *Registry) collect(name, help, kind string, fx func(func(float64, ...string)), labels []string) {
+	f := r.add(name, func() family {
+		return &collector{meta: newMeta(name, help, kind, labels)}
+	})
+
+	c, ok := f.(*collector)
+
+	if !ok || c.kind != kind {
+		panic(fmt.Sprintf("metric %s is not a %s func", name, kind))
+	}
+
+	c.lock.Lock()
+	c.fxs = append(c.fxs, fx)
+	c.lock.Unlock()
+}
+
+//Histogram returns the histogram with the name, adding it with the help, buckets and
+//label names if the registry does not have it, nil buckets are DefaultBuckets
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+
+	f := r.add(name, func() family {
+		sorted := append([]float64(nil), buckets...)
+		sort.Float64s(sorted)
+		return &Histogram{meta: newMeta(name, help, "histogram", labels), buckets: sorted}
+	})
+
+	h, ok := f.(*Histogram)
+
+	if !ok {
+		panic(fmt.Sprintf("metric %s is not a histogram", name))
+	}
+
+	return h
+}
+
+//WriteText writes every metric of the registry in the text exposition format
+func (r *Registry) WriteText(w io.Writer) error {
+	r.lock.Lock()
+	families := append([]family(nil), r.families...)
+	r.lock.Unlock()
+
+	bw := bufio.NewWriter(w)
+
+	for _, f := range families {
+		f.write(bw)
+	}
+
+	return bw.Flush()
+}
+
+//Text returns the metrics of the registry in the text exposition format
+func (r *Registry) Text() []byte {
+	var buf strings.Builder
+	r.WriteText(&buf)
+	return []byte(buf.String())
+}
+
+//ServeHTTP answers with the metrics of the registry in the text exposition format
+func (r *Registry) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", ContentType)
+	r.WriteText(rw)
+}
+
+//meta holds the description of a metric and the keys of its label sets in the order
+//they were first seen
+type meta struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+	lock   sync.Mutex
+	keys   []string
+}
+
+func newMeta(name, help, kind string, labels []string) meta {
+	return meta{name: name, help: help, kind: kind, labels: labels}
+}
+
+//key returns the key of the label values, panicking if there are not as many values
+//as label names
+func (m *meta) key(values []string) string {
+	if len(values) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s takes %d label values, got %d", m.name, len(m.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+//header writes the help and type lines of the metric
+func (m *meta) header(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, escapeHelp(m.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+}
+
+//sample writes a line of the metric with the suffix, the label values of the key and
+//any extra label
+func (m *meta) sample(w *bufio.Writer, suffix, key string, value float64, extra ...string) {
+	w.WriteString(m.name + suffix)
+
+	var pairs []string
+
+	if len(m.labels) > 0 {
+		for i, v := range strings.Split(key, "\xff") {
+			pairs = append(pairs, m.labels[i]+`="`+escapeLabel(v)+`"`)
+		}
+	}
+
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+escapeLabel(extra[i+1])+`"`)
+	}
+
+	if len(pairs) > 0 {
+		w.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+
+	w.WriteString(" " + formatValue(value) + "\n")
+}
+
+//Counter is a metric which only goes up, such as a count of requests
+type Counter struct {
+	meta
+	values map[string]float64
+}
+
+//Inc adds one to the counter of the label values
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+//Add adds the delta, which must not be negative, to the counter of the label values
+func (c *Counter) Add(delta float64, values ...string) {
+	if delta < 0 {
+		return
+	}
+
+	key := c.key(values)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.values == nil {
+		c.values = make(map[string]float64)
+	}
+
+	if _, ok := c.values[key]; !ok {
+		c.keys = append(c.keys, key)
+	}
+
+	c.values[key] += delta
+}
+
+//Value returns the counter of the label values
+func (c *Counter) Value(values ...string) float64 {
+	key := c.key(values)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.values[key]
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.header(w)
+
+	for _, key := range c.keys {
+		c.sample(w, "", key, c.values[key])
+	}
+}
+
+//Gauge is a metric which goes up and down, such as a count of open connections
+type Gauge struct {
+	meta
+	values map[string]float64
+}
+
+//Set sets the gauge of the label values
+func (g *Gauge) Set(value float64, values ...string) {
+	g.update(values, func(float64) float64 { return value })
+}
+
+//Add adds the delta to the gauge of the label values
+func (g *Gauge) Add(delta float64, values ...string) {
+	g.update(values, func(cur float64) float64 { return cur + delta })
+}
+
+//Value returns the gauge of the label values
+func (g *Gauge) Value(values ...string) float64 {
+	key := g.key(values)
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.values[key]
+}
+
+func (g *Gauge) update(values []string, fx func(float64) float64) {
+	key := g.key(values)
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if g.values == nil {
+		g.values = make(map[string]float64)
+	}
+
+	if _, ok := g.values[key]; !ok {
+		g.keys = append(g.keys, key)
+	}
+
+	g.values[key] = fx(g.values[key])
+}
+
+func (g *Gauge) write(w *bufio.Writer) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.header(w)
+
+	for _, key := range g.keys {
+		g.sample(w, "", key, g.values[key])
+	}
+}
+
+//collector is a metric read from functions each time it is written
+type collector struct {
+	meta
+	fxs []func(set func(value float64, values ...string))
+}
+
+func (c *collector) write(w *bufio.Writer) {
+	c.lock.Lock()
+	fxs := c.fxs
+	c.lock.Unlock()
+
+	c.header(w)
+
+	for _, fx := range fxs {
+		fx(func(value float64, values ...string) {
+			c.sample(w, "", c.key(values), value)
+		})
+	}
+}
+
+//Histogram counts observations, such as request latencies, in buckets
+type Histogram struct {
+	meta
+	buckets []float64
+	series  map[string]*series
+}
+
+//series holds the bucket counts, count and sum of a single label set
+type series struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+//Observe adds the value to the histogram of the label values
+func (h *Histogram) Observe(value float64, values ...string) {
+	key := h.key(values)
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.series == nil {
+		h.series = make(map[string]*series)
+	}
+
+	s, ok := h.series[key]
+
+	if !ok {
+		s = &series{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+		h.keys = append(h.keys, key)
+	}
+
+	for i, bound := range h.buckets {
+		if value <= bound {
+			s.counts[i]++
+		}
+	}
+
+	s.count++
+	s.sum += value
+}
+
+//Count returns the number of observations of the label values
+func (h *Histogram) Count(values ...string) uint64 {
+	key := h.key(values)
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if s, ok := h.series[key]; ok {
+		return s.count
+	}
+
+	return 0
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.header(w)
+
+	for _, key := range h.keys {
+		s := h.series[key]
+
+		for i, bound := range h.buckets {
+			h.sample(w, "_bucket", key, float64(s.counts[i]), "le", formatValue(bound))
+		}
+
+		h.sample(w, "_bucket", key, float64(s.count), "le", "+Inf")
+		h.sample(w, "_sum", key, s.sum)
+		h.sample(w, "_count", key, float64(s.count))
+	}
+}
+
+//formatValue formats a sample value as the text format expects
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+func escapeHelp(v string) string {
+	return helpEscaper.Replace(v)
+}
@@ -0,0 +1,103 @@
+package metrics
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/franela/goblin"
+	"github.com/influx6/composelab/trace"
+)
+
+func TestMetrics(t *testing.T) {
+	g := goblin.Goblin(t)
+
+	g.Describe("Metrics", func() {
+
+		g.It("can counters and gauges be written as text", func() {
+			reg := NewRegistry()
+			reqs := reg.Counter("requests_total", "Requests taken.", "route", "status")
+			reqs.Inc("users", "200")
+			reqs.Add(2, "users", "200")
+			reqs.Inc(`a"b`, "500")
+
+			open := reg.Gauge("open", "Open connections.")
+			open.Set(4)
+			open.Add(-1)
+
+			g.Assert(reqs.Value("users", "200")).Eql(float64(3))
+			g.Assert(reg.Counter("requests_total", "", "route", "status") == reqs).IsTrue("counters are shared by name")
+
+			g.Assert(string(reg.Text())).Eql(strings.Join([]string{
+				"# HELP requests_total Requests taken.",
+				"# TYPE requests_total counter",
+				`requests_total{route="users",status="200"} 3`,
+				`requests_total{route="a\"b",status="500"} 1`,
+				"# HELP open Open connections.",
+				"# TYPE open gauge",
+				"open 3",
+				"",
+			}, "\n"))
+		})
+
+		g.It("can histograms count observations in buckets", func() {
+			reg := NewRegistry()
+			lat := reg.Histogram("latency_seconds", "Latency.", []float64{1, 0.1}, "route")
+			lat.Observe(0.05, "users")
+			lat.Observe(0.5, "users")
+			lat.Observe(5, "users")
+
+			g.Assert(lat.Count("users")).Eql(uint64(3))
+
+			text := string(reg.Text())
+			g.Assert(strings.Contains(text, `latency_seconds_bucket{route="users",le="0.1"} 1`)).IsTrue(text)
+			g.Assert(strings.Contains(text, `latency_seconds_bucket{route="users",le="1"} 2`)).IsTrue(text)
+			g.Assert(strings.Contains(text, `latency_seconds_bucket{route="users",le="+Inf"} 3`)).IsTrue(text)
+			g.Assert(strings.Contains(text, `latency_seconds_sum{route="users"} 5.55`)).IsTrue(text)
+			g.Assert(strings.Contains(text, `latency_seconds_count{route="users"} 3`)).IsTrue(text)
+		})
+
+		g.It("can gauges be read from every function added under a name", func() {
+			reg := NewRegistry()
+
+			for _, name := range []string{"models", "views"} {
+				service := name
+				reg.GaugeFunc("sessions", "Sessions.", func(set func(float64, ...string)) {
+					set(2, service)
+				}, "service")
+			}
+
+			rec := httptest.NewRecorder()
+			reg.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+			g.Assert(rec.Header().Get("Content-Type")).Eql(ContentType)
+			g.Assert(strings.Count(rec.Body.String(), "# TYPE sessions gauge")).Eql(1)
+			g.Assert(strings.Contains(rec.Body.String(), `sessions{service="models"} 2`)).IsTrue()
+			g.Assert(strings.Contains(rec.Body.String(), `sessions{service="views"} 2`)).IsTrue()
+		})
+
+		g.It("can spans be counted and timed", func() {
+			reg := NewRegistry()
+			sm := NewSpanMetrics(reg)
+			tracer := trace.NewTracer("front", sm)
+
+			route := tracer.Start(trace.RouteSpan, "/front/users/4", trace.Context{})
+			route.Set("route", "front/users/{id:int}")
+			route.Set("status", "200")
+			route.Finish()
+
+			link := tracer.Start(trace.LinkSpan, "models/list", route.Context())
+			link.Set("target", "models")
+			link.Fail(errors.New("timed out"))
+			link.Finish()
+
+			tracer.Start(trace.RouteSpan, "/front/missing", trace.Context{}).Finish()
+
+			g.Assert(sm.Routes.Value("front", "front/users/{id:int}", "200")).Eql(float64(1))
+			g.Assert(sm.Routes.Value("front", "unmatched", "none")).Eql(float64(1))
+			g.Assert(sm.Links.Value("front", "models", "error")).Eql(float64(1))
+			g.Assert(sm.LinkDuration.Count("front", "models")).Eql(uint64(1))
+		})
+	})
+}
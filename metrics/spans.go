@@ -0,0 +1,71 @@
+package metrics
+
+import (
+	"github.com/influx6/composelab/trace"
+)
+
+//SpanMetrics counts and times the route and link spans services record, it is an
+//exporter for a service's tracer so the requests a service takes and makes are
+//measured where they are traced
+type SpanMetrics struct {
+	Routes        *Counter
+	RouteDuration *Histogram
+	Links         *Counter
+	LinkDuration  *Histogram
+}
+
+//NewSpanMetrics adds the request metrics of routes and links to the registry
+func NewSpanMetrics(reg *Registry) *SpanMetrics {
+	return &SpanMetrics{
+		Routes:        reg.Counter("composelab_route_requests_total", "Requests taken by the routes of a service.", "service", "route", "status"),
+		RouteDuration: reg.Histogram("composelab_route_request_seconds", "Time taken to answer requests by route.", nil, "service", "route"),
+		Links:         reg.Counter("composelab_link_requests_total", "Requests sent to providers of other services.", "service", "target", "outcome"),
+		LinkDuration:  reg.Histogram("composelab_link_request_seconds", "Time taken by providers to answer requests.", nil, "service", "target"),
+	}
+}
+
+//Export adds the span to the metrics of its kind
+func (m *SpanMetrics) Export(s *trace.Span) error {
+	switch s.Kind {
+	case trace.RouteSpan:
+		route := s.Attr("route")
+
+		if route == "" {
+			route = "unmatched"
+		}
+
+		m.Routes.Inc(s.Service, route, routeStatus(s))
+		m.RouteDuration.Observe(s.Duration.Seconds(), s.Service, route)
+	case trace.LinkSpan:
+		target := s.Attr("target")
+
+		if target == "" {
+			target = s.Name
+		}
+
+		outcome := "ok"
+
+		if s.Failed() {
+			outcome = "error"
+		}
+
+		m.Links.Inc(s.Service, target, outcome)
+		m.LinkDuration.Observe(s.Duration.Seconds(), s.Service, target)
+	}
+
+	return nil
+}
+
+//routeStatus returns the status a route span was answered with, spans without one are
+//'error' if they failed and 'none' if not
+func routeStatus(s *trace.Span) string {
+	if status := s.Attr("status"); status != "" {
+		return status
+	}
+
+	if s.Failed() {
+		return "error"
+	}
+
+	return "none"
+}
@@ -0,0 +1,123 @@
+package routes
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+//wideRoutes returns a route with n static sub-routes each with a pattern sub-route
+func wideRoutes(n int) *Routes {
+	app := NewRoutes("app", true)
+
+	for i := 0; i < n; i++ {
+		app.Branch(fmt.Sprintf(`res%d/{id:[\d]+}`, i), true)
+	}
+
+	return app
+}
+
+//serviceRoutes returns a route built the way services build theirs, never flushed and
+//with n resources taking an id, the terminal of the last resource counts the requests
+//it handles
+func serviceRoutes(n int, handled *int64) *Routes {
+	svc := NewRoutes("svc", false)
+	svc.Branch("register", false)
+	svc.Branch("unregister", false)
+	svc.Branch("discover", false)
+
+	for i := 0; i < n; i++ {
+		svc.Branch(fmt.Sprintf(`res%d/{id:[\d]+}`, i), false)
+	}
+
+	last, _ := svc.Select(fmt.Sprintf("res%d/id", n-1))
+	last.Terminal().Only(func(_ interface{}, _ *RouteFinalizer) {
+		atomic.AddInt64(handled, 1)
+	})
+
+	return svc
+}
+
+func BenchmarkMatchStatic(b *testing.B) {
+	app := wideRoutes(1000)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if app.match("res999") == nil {
+			b.Fatal("no route matched")
+		}
+	}
+}
+
+func BenchmarkMatchPattern(b *testing.B) {
+	app := NewRoutes("app", true)
+	for i := 0; i < 100; i++ {
+		app.Branch(fmt.Sprintf(`{id%d:[a-z]+%d}`, i, i), true)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		app.match("user99")
+	}
+}
+
+func BenchmarkMatchMiss(b *testing.B) {
+	app := wideRoutes(1000)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if app.match("missing") != nil {
+			b.Fatal("unexpected match")
+		}
+	}
+}
+
+func BenchmarkIssueRequestWide(b *testing.B) {
+	var handled int64
+	svc := serviceRoutes(50, &handled)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		svc.IssueRequestPath("svc/res49/40", nil)
+	}
+
+	b.StopTimer()
+	if atomic.LoadInt64(&handled) != int64(b.N) {
+		b.Fatalf("handled %d of %d requests", handled, b.N)
+	}
+}
+
+func BenchmarkIssueRequestDeep(b *testing.B) {
+	var handled int64
+	svc := NewRoutes("svc", false)
+
+	var parts []string
+	for i := 0; i < 8; i++ {
+		parts = append(parts, fmt.Sprintf("level%d", i))
+	}
+
+	path := strings.Join(parts, "/")
+	svc.Branch(path, false)
+	last, _ := svc.Select(path)
+	last.Terminal().Only(func(_ interface{}, _ *RouteFinalizer) {
+		atomic.AddInt64(&handled, 1)
+	})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		svc.IssueRequestPath("svc/"+path, nil)
+	}
+
+	b.StopTimer()
+	if atomic.LoadInt64(&handled) != int64(b.N) {
+		b.Fatalf("handled %d of %d requests", handled, b.N)
+	}
+}
@@ -0,0 +1,142 @@
+package routes
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/influx6/grids"
+)
+
+//Deadline tracks the time a request has to be answered in, it is carried on the
+//request packet as the 'Deadline' meta and routes with a Timeout shorten it as
+//the request passes through them. The context it provides is cancelled when the
+//deadline passes or is stopped
+type Deadline struct {
+	lock     sync.Mutex
+	at       time.Time
+	timer    *time.Timer
+	ctx      context.Context
+	cancel   context.CancelFunc
+	expired  bool
+	finished bool
+}
+
+//NewDeadline returns a new deadline running out after the given duration, a duration
+//of zero or less gives a deadline which only routes timeouts can set
+func NewDeadline(parent context.Context, d time.Duration) *Deadline {
+	if parent == nil {
+		parent = context.Background()
+	}
+
+	ctx, cancel := context.WithCancel(parent)
+
+	dl := &Deadline{
+		ctx:    ctx,
+		cancel: cancel,
+	}
+
+	if d > 0 {
+		dl.at = time.Now().Add(d)
+		dl.timer = time.AfterFunc(d, dl.Expire)
+	}
+
+	return dl
+}
+
+//Within shortens the deadline to run out within the given duration if that is
+//sooner than its current time
+func (d *Deadline) Within(t time.Duration) {
+	if t <= 0 {
+		return
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.finished {
+		return
+	}
+
+	at := time.Now().Add(t)
+
+	if !d.at.IsZero() && d.at.Before(at) {
+		return
+	}
+
+	d.at = at
+
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+
+	d.timer = time.AfterFunc(t, d.Expire)
+}
+
+//Remaining returns the time left till the deadline, it returns -1 if the deadline
+//has no time set
+func (d *Deadline) Remaining() time.Duration {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.at.IsZero() {
+		return -1
+	}
+
+	return time.Until(d.at)
+}
+
+//Expire runs out the deadline immediately, cancelling its context
+func (d *Deadline) Expire() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.finished {
+		return
+	}
+
+	d.finished = true
+	d.expired = true
+	d.cancel()
+}
+
+//Stop marks the request as answered, releasing the deadline and its context
+func (d *Deadline) Stop() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.finished {
+		return
+	}
+
+	d.finished = true
+
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+
+	d.cancel()
+}
+
+//Expired returns true if the deadline ran out before it was stopped
+func (d *Deadline) Expired() bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.expired
+}
+
+//Done returns a chan which is closed once the deadline is stopped or runs out
+func (d *Deadline) Done() <-chan struct{} {
+	return d.ctx.Done()
+}
+
+//Context returns the context of the request which is cancelled with the deadline
+func (d *Deadline) Context() context.Context {
+	return d.ctx
+}
+
+//PacketDeadline returns the deadline of a request packet if it has one
+func PacketDeadline(g *grids.GridPacket) (*Deadline, bool) {
+	dl, ok := g.Get("Deadline").(*Deadline)
+	return dl, ok
+}
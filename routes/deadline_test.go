@@ -0,0 +1,98 @@
+package routes
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	. "github.com/franela/goblin"
+	"github.com/influx6/grids"
+)
+
+func TestDeadline(t *testing.T) {
+	gob := Goblin(t)
+
+	gob.Describe("Deadline specification", func() {
+
+		gob.It("can a deadline run out", func(done Done) {
+			dl := NewDeadline(nil, 2*time.Millisecond)
+
+			go func() {
+				<-dl.Done()
+				gob.Assert(dl.Expired()).IsTrue("deadline expired")
+				gob.Assert(dl.Context().Err() != nil).IsTrue("context is cancelled")
+				done()
+			}()
+		})
+
+		gob.It("can a stopped deadline not expire", func() {
+			dl := NewDeadline(nil, time.Millisecond)
+			dl.Stop()
+			<-time.After(5 * time.Millisecond)
+			gob.Assert(dl.Expired()).IsFalse("deadline was stopped")
+		})
+
+		gob.It("can a route shorten the deadline", func() {
+			dl := NewDeadline(nil, time.Minute)
+			dl.Within(time.Second)
+			gob.Assert(dl.Remaining() <= time.Second).IsTrue("deadline is within a second")
+
+			dl.Within(time.Hour)
+			gob.Assert(dl.Remaining() <= time.Second).IsTrue("deadline is not extended")
+			dl.Stop()
+		})
+
+		gob.It("can a request passing a route take its timeout", func() {
+			app := NewRoutes("app", true)
+			app.SetTimeout(time.Second)
+
+			dl := NewDeadline(nil, time.Minute)
+			pack := grids.NewPacket()
+			pack.Set("Deadline", dl)
+			app.IssueRequestPacket("app", pack)
+
+			<-time.After(5 * time.Millisecond)
+			gob.Assert(dl.Remaining() <= time.Second).IsTrue("route timeout applied")
+			dl.Stop()
+		})
+
+		gob.It("can requests whose deadline has no time set not be timed out", func() {
+			app := NewRoutes("app", true)
+
+			dl := NewDeadline(nil, 0)
+			pack := grids.NewPacket()
+			pack.Set("Deadline", dl)
+			app.IssueRequestPacket("app", pack)
+
+			<-time.After(20 * time.Millisecond)
+			gob.Assert(dl.Expired()).IsFalse("keepers did not time the request out")
+			dl.Stop()
+		})
+
+		gob.It("can stopping deadlines release the keepers of their requests", func() {
+			app := NewRoutes("app", true)
+			app.Branch("logs/realtime", true)
+
+			base := runtime.NumGoroutine()
+			deadlines := make([]*Deadline, 0, 50)
+
+			for i := 0; i < 50; i++ {
+				dl := NewDeadline(nil, time.Minute)
+				pack := grids.NewPacket()
+				pack.Set("Deadline", dl)
+				app.IssueRequestPacket("app/logs/realtime", pack)
+				deadlines = append(deadlines, dl)
+			}
+
+			<-time.After(20 * time.Millisecond)
+			gob.Assert(runtime.NumGoroutine() > base+50).IsTrue("keepers hold the requests")
+
+			for _, dl := range deadlines {
+				dl.Stop()
+			}
+
+			<-time.After(20 * time.Millisecond)
+			gob.Assert(runtime.NumGoroutine() < base+10).IsTrue("keepers were released")
+		})
+	})
+}
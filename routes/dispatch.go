@@ -0,0 +1,190 @@
+package routes
+
+import (
+	"sync/atomic"
+
+	"github.com/influx6/grids"
+)
+
+//syncDispatch is set as the 'Sync' meta of requests issued in sync mode and counts
+//the terminal handlers run for the request
+type syncDispatch struct {
+	handled int32
+}
+
+//SetSync turns sync mode on or off for requests issued to these route. In sync mode
+//matching, middleware, terminal handlers and diverted routes all run in the
+//goroutine issuing the request and the issue call returns once they are done,
+//telling whether any terminal handler ran. Outputs bound to the routes are still
+//sent the packets but terminal handlers are not run a second time
+func (r *Routes) SetSync(on bool) *Routes {
+	r.lock.Lock()
+	r.sync = on
+	r.lock.Unlock()
+	return r
+}
+
+//Sync returns true if requests issued to these route are dispatched in sync mode
+func (r *Routes) Sync() bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.sync
+}
+
+//issue sends a request packet into the route, in sync mode it is dispatched in the
+//calling goroutine and true is returned if any terminal handler ran
+func (r *Routes) issue(p *grids.GridPacket) bool {
+	if !r.Sync() {
+		r.InSend("Request", p)
+		return false
+	}
+
+	d := &syncDispatch{}
+	p.Set("Sync", d)
+	r.request(p)
+	return atomic.LoadInt32(&d.handled) > 0
+}
+
+//request takes a request packet sent to the route, rejecting it if the route does
+//not match its first path. Packets diverted to the route are taken with their full
+//request path
+func (r *Routes) request(p *grids.GridPacket) {
+	paths, ok := p.Get("Pathways").([]string)
+
+	if _, has := p.Get("RequestPath").([]string); ok && !has {
+		p.Set("RequestPath", paths)
+	}
+
+	if tried, _ := p.Get("Rejected").([]*Routes); len(tried) > 0 {
+		paths, ok = p.Get("RequestPath").([]string)
+	}
+
+	if PacketSpan(p) == nil {
+		r.Root().startSpan(p)
+	}
+
+	if !ok || len(paths) <= 0 || !r.accepts(paths[0]) {
+		r.reject(p)
+		return
+	}
+
+	r.enter(p, paths)
+}
+
+//NotFound sets the handler answering requests which neither the routes of the tree
+//nor the routes it diverts to take, it is kept by the root route
+func (r *Routes) NotFound(fx func(*grids.GridPacket)) *Routes {
+	root := r.Root()
+	root.lock.Lock()
+	root.notFound = fx
+	root.lock.Unlock()
+	return r
+}
+
+//reject sends the packet out of the route's Bad output and hands it to the root route
+//which tries the routes it diverts to and then the NotFound handler
+func (r *Routes) reject(p *grids.GridPacket) {
+	r.OutSend("Bad", p)
+	r.Root().divert(p)
+}
+
+//divert sends a packet rejected by the tree to the next route diverted to, which
+//takes it with its full path. Routes diverted to by the tree are tried before those
+//still pending from the trees which rejected the packet earlier and trees are never
+//tried twice. The packet goes to the NotFound handler of the first tree which
+//rejected it once there are no routes left to try
+func (r *Routes) divert(p *grids.GridPacket) {
+	tried, _ := p.Get("Rejected").([]*Routes)
+	tried = append(tried, r)
+	p.Set("Rejected", tried)
+
+	r.lock.RLock()
+	diverts := r.diverts
+	notFound := r.notFound
+	r.lock.RUnlock()
+
+	if _, ok := p.Get("NotFound").(func(*grids.GridPacket)); !ok && notFound != nil {
+		p.Set("NotFound", notFound)
+	}
+
+	pending, _ := p.Get("Diverts").([]*Routes)
+	pending = append(append([]*Routes{}, diverts...), pending...)
+
+	for len(pending) > 0 {
+		next := pending[0]
+		pending = pending[1:]
+
+		if triedRoute(tried, next.Root()) {
+			continue
+		}
+
+		p.Set("Diverts", pending)
+
+		if isSync(p) {
+			next.request(p)
+		} else {
+			next.InSend("Request", p)
+		}
+
+		return
+	}
+
+	p.Set("Diverts", nil)
+
+	if fx, ok := p.Get("NotFound").(func(*grids.GridPacket)); ok {
+		fx(p)
+		finishPacket(p)
+	}
+}
+
+//triedRoute returns true if the route is in the list
+func triedRoute(tried []*Routes, r *Routes) bool {
+	for _, t := range tried {
+		if t == r {
+			return true
+		}
+	}
+	return false
+}
+
+//deliver sends the packet out of the route's Only or All output, sync packets have
+//the route's terminal handlers run first. Packets sent out of the All output of a
+//route with Any handlers are marked as caught
+func (r *Routes) deliver(out string, p *grids.GridPacket) {
+	if _, any := r.Term.Counts(); out == "All" && any > 0 {
+		p.Set("Caught", true)
+	}
+
+	if d, ok := p.Get("Sync").(*syncDispatch); ok {
+		var ran int
+
+		if out == "Only" {
+			ran = r.Term.run(&r.Term.onlys, r.Term.Strict, p)
+		} else {
+			ran = r.Term.run(&r.Term.anys, r.Term.Loose, p)
+		}
+
+		atomic.AddInt32(&d.handled, int32(ran))
+	}
+
+	r.OutSend(out, p)
+}
+
+//caught returns true if a route the request walked through has Any handlers, which
+//take the requests for paths below their route that no sub-route matches
+func caught(p *grids.GridPacket) bool {
+	c, _ := p.Get("Caught").(bool)
+	return c
+}
+
+//isSync returns true if the packet was issued in sync mode
+func isSync(d interface{}) bool {
+	p, ok := d.(*grids.GridPacket)
+
+	if !ok {
+		return false
+	}
+
+	_, ok = p.Get("Sync").(*syncDispatch)
+	return ok
+}
@@ -0,0 +1,162 @@
+package routes
+
+import (
+	"testing"
+
+	. "github.com/franela/goblin"
+	"github.com/influx6/grids"
+)
+
+func TestSyncDispatch(t *testing.T) {
+	gob := Goblin(t)
+
+	gob.Describe("Sync dispatch specification", func() {
+
+		gob.It("can handlers run before the request returns", func() {
+			app := NewRoutes("app", true).SetSync(true)
+			app.Branch("users/{id:int}", true)
+
+			var order []string
+
+			app.Terminal().Any(ByPackets(func(p *grids.GridPacket) {
+				order = append(order, "app")
+			}))
+
+			id, _ := app.Select("users/id")
+			id.Terminal().Only(ByPackets(func(p *grids.GridPacket) {
+				order = append(order, "id")
+				gob.Assert(PacketParams(p).Get("id")).Equal(4)
+			}))
+
+			gob.Assert(app.IssueRequestPath("app/users/4", nil)).IsTrue()
+			gob.Assert(order).Eql([]string{"app", "id"})
+		})
+
+		gob.It("can an unmatched request return false", func() {
+			app := NewRoutes("app", true).SetSync(true)
+			app.Branch("users", true)
+
+			gob.Assert(app.IssueRequestPath("app/posts", nil)).IsFalse()
+			gob.Assert(app.IssueRequestPath("other", nil)).IsFalse()
+		})
+
+		gob.It("can a route without handlers return false", func() {
+			app := NewRoutes("app", true).SetSync(true)
+			app.Branch("users", true)
+
+			gob.Assert(app.IssueRequestPath("app/users", nil)).IsFalse()
+		})
+
+		gob.It("can rejected requests reach diverted routes", func() {
+			app := NewRoutes("app", true).SetSync(true)
+			var rest interface{}
+
+			app.Divert(NewRoutes("*rest", true)).Terminal().Only(ByPackets(func(p *grids.GridPacket) {
+				rest = PacketParams(p).Get("rest")
+			}))
+
+			gob.Assert(app.IssueRequestPath("missing/page", nil)).IsTrue()
+			gob.Assert(rest).Equal("missing/page")
+		})
+	})
+}
+
+func TestNotFound(t *testing.T) {
+	gob := Goblin(t)
+
+	gob.Describe("Rejected request specification", func() {
+
+		gob.It("can a miss below the root reach the not found handler", func(done Done) {
+			app := NewRoutes("app", true)
+			app.Branch("users/{id:int}", true)
+
+			app.NotFound(func(p *grids.GridPacket) {
+				gob.Assert(p.Get("RequestPath")).Eql([]string{"app", "users", "bob"})
+				gob.Assert(p.Get("Pathways")).Eql([]string{"bob"})
+				done()
+			})
+
+			app.IssueRequestPath("app/users/bob", nil)
+		})
+
+		gob.It("can diverted routes be tried before the not found handler", func() {
+			app := NewRoutes("app", true).SetSync(true)
+			docs := NewRoutes("docs", true)
+			docs.Branch("guide", true)
+
+			var order []string
+
+			app.Divert(docs)
+			app.Divert(NewRoutes("files", true))
+
+			docs.NotFound(func(p *grids.GridPacket) {
+				order = append(order, "docs")
+			})
+
+			app.NotFound(func(p *grids.GridPacket) {
+				order = append(order, "app")
+			})
+
+			guide, _ := docs.Select("guide")
+			guide.Terminal().Only(ByPackets(func(p *grids.GridPacket) {
+				order = append(order, "guide")
+			}))
+
+			gob.Assert(app.IssueRequestPath("docs/guide", nil)).IsTrue()
+			gob.Assert(app.IssueRequestPath("docs/missing", nil)).IsFalse()
+			gob.Assert(order).Eql([]string{"guide", "app"})
+		})
+
+		gob.It("can misses below routes with any handlers be left to them", func() {
+			app := NewRoutes("app", true).SetSync(true)
+			app.Branch("api/users", true)
+
+			var caught, missed int
+			app.Terminal().Any(ByPackets(func(p *grids.GridPacket) {
+				caught++
+			}))
+
+			app.NotFound(func(p *grids.GridPacket) {
+				missed++
+			})
+
+			gob.Assert(app.IssueRequestPath("app/api/missing", nil)).IsTrue()
+			gob.Assert(caught).Equal(1)
+			gob.Assert(missed).Equal(0)
+		})
+
+		gob.It("can rejected requests not be reported handled", func() {
+			app := NewRoutes("app", true).SetSync(true)
+			app.Branch("api/users", true)
+
+			users, _ := app.Select("api/users")
+			users.Terminal().Any(ByPackets(func(p *grids.GridPacket) {
+				gob.Assert(false).IsTrue("routes off the walk must not catch the request")
+			}))
+
+			var missed []string
+			app.NotFound(func(p *grids.GridPacket) {
+				missed = append(missed, "app")
+			})
+
+			gob.Assert(app.IssueRequestPath("app/api/missing", nil)).IsFalse()
+			gob.Assert(missed).Eql([]string{"app"})
+		})
+
+		gob.It("can routes diverting to each other end at the not found handler", func() {
+			app := NewRoutes("app", true).SetSync(true)
+			docs := NewRoutes("docs", true)
+
+			app.Divert(docs)
+			docs.Divert(app)
+
+			var missed int
+			app.NotFound(func(p *grids.GridPacket) {
+				missed++
+			})
+
+			app.IssueRequestPath("other", nil)
+			gob.Assert(missed).Equal(1)
+		})
+	})
+}
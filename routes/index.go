@@ -0,0 +1,57 @@
+package routes
+
+//routeIndex is the lookup table a route selects its sub-routes from, it is built
+//again whenever sub-routes are added, removed or replaced and never changed after
+type routeIndex struct {
+	static   map[string]*Routes
+	pattern  []*Routes
+	catch    *Routes
+	optional *Routes
+}
+
+//emptyIndex is the index of routes without sub-routes
+var emptyIndex = buildIndex(nil)
+
+//buildIndex returns the index of the given sub-routes
+func buildIndex(branches []*Routes) *routeIndex {
+	idx := &routeIndex{static: make(map[string]*Routes)}
+
+	for _, b := range branches {
+		switch b.kind {
+		case StaticSegment:
+			if _, ok := idx.static[b.Path]; !ok {
+				idx.static[b.Path] = b
+			}
+		case PatternSegment:
+			idx.pattern = append(idx.pattern, b)
+		case CatchAllSegment:
+			if idx.catch == nil {
+				idx.catch = b
+			}
+		}
+
+		if b.optional && idx.optional == nil {
+			idx.optional = b
+		}
+	}
+
+	return idx
+}
+
+//reindex rebuilds the route's index, callers must hold the route's lock
+func (r *Routes) reindex() {
+	r.index = buildIndex(r.branches)
+}
+
+//lookup returns the route's current index
+func (r *Routes) lookup() *routeIndex {
+	r.lock.RLock()
+	idx := r.index
+	r.lock.RUnlock()
+
+	if idx == nil {
+		return emptyIndex
+	}
+
+	return idx
+}
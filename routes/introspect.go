@@ -0,0 +1,148 @@
+package routes
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"runtime"
+	"strings"
+)
+
+//RouteInfo describes a single route and its sub-routes as exported by Describe
+type RouteInfo struct {
+	Path     string       `json:"path"`
+	Segment  string       `json:"segment"`
+	Pattern  string       `json:"pattern,omitempty"`
+	Kind     string       `json:"kind"`
+	Optional bool         `json:"optional,omitempty"`
+	Only     int          `json:"only"`
+	Any      int          `json:"any"`
+	Before   []string     `json:"before,omitempty"`
+	After    []string     `json:"after,omitempty"`
+	Timeout  string       `json:"timeout,omitempty"`
+	Routes   []*RouteInfo `json:"routes,omitempty"`
+	Mount    *RouteInfo   `json:"mount,omitempty"`
+}
+
+//Describe returns the route tree from these route downwards
+func (r *Routes) Describe() *RouteInfo {
+	return r.describe("")
+}
+
+func (r *Routes) describe(parent string) *RouteInfo {
+	return r.describeAt(parent + "/" + r.raw)
+}
+
+//describeAt describes the route as found at the path, mounted trees are found at the
+//path of the route they are mounted on
+func (r *Routes) describeAt(path string) *RouteInfo {
+	only, any := r.Term.Counts()
+
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	info := &RouteInfo{
+		Path:     path,
+		Segment:  r.Path,
+		Kind:     r.kind.String(),
+		Optional: r.optional,
+		Only:     only,
+		Any:      any,
+		Before:   middlewareNames(r.before),
+		After:    middlewareNames(r.after),
+	}
+
+	if r.kind != StaticSegment {
+		info.Pattern = r.raw
+	}
+
+	if r.Timeout > 0 {
+		info.Timeout = r.Timeout.String()
+	}
+
+	for _, b := range r.branches {
+		info.Routes = append(info.Routes, b.describe(info.Path))
+	}
+
+	if r.mount != nil {
+		info.Mount = r.mount.describeAt(info.Path)
+	}
+
+	return info
+}
+
+//DescribeJSON returns the route tree from these route downwards as json
+func (r *Routes) DescribeJSON() ([]byte, error) {
+	return json.Marshal(r.Describe())
+}
+
+//DescribeText returns the route tree from these route downwards as indented text
+func (r *Routes) DescribeText() string {
+	return r.Describe().Text()
+}
+
+//Text returns the route tree as indented text with a line per route
+func (ri *RouteInfo) Text() string {
+	var buf bytes.Buffer
+	ri.text(&buf, 0)
+	return buf.String()
+}
+
+func (ri *RouteInfo) text(buf *bytes.Buffer, depth int) {
+	fmt.Fprintf(buf, "%s%s [%s", strings.Repeat("  ", depth), ri.Path, ri.Kind)
+
+	if ri.Optional {
+		buf.WriteString(" optional")
+	}
+
+	buf.WriteString("]")
+
+	if ri.Only > 0 {
+		fmt.Fprintf(buf, " only:%d", ri.Only)
+	}
+
+	if ri.Any > 0 {
+		fmt.Fprintf(buf, " any:%d", ri.Any)
+	}
+
+	if len(ri.Before) > 0 {
+		fmt.Fprintf(buf, " before:%s", strings.Join(ri.Before, ","))
+	}
+
+	if len(ri.After) > 0 {
+		fmt.Fprintf(buf, " after:%s", strings.Join(ri.After, ","))
+	}
+
+	if ri.Timeout != "" {
+		fmt.Fprintf(buf, " timeout:%s", ri.Timeout)
+	}
+
+	buf.WriteString("\n")
+
+	for _, sub := range ri.Routes {
+		sub.text(buf, depth+1)
+	}
+
+	if ri.Mount != nil {
+		fmt.Fprintf(buf, "%smounted:\n", strings.Repeat("  ", depth+1))
+		ri.Mount.text(buf, depth+2)
+	}
+}
+
+//middlewareNames returns the function names of the middleware
+func middlewareNames(mw []Middleware) []string {
+	var names []string
+
+	for _, m := range mw {
+		name := "unknown"
+
+		if fn := runtime.FuncForPC(reflect.ValueOf(m).Pointer()); fn != nil {
+			name = fn.Name()
+		}
+
+		names = append(names, name)
+	}
+
+	return names
+}
@@ -0,0 +1,58 @@
+package routes
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/franela/goblin"
+	"github.com/influx6/grids"
+)
+
+func TestIntrospection(t *testing.T) {
+	gob := Goblin(t)
+
+	app := NewRoutes("app", true)
+	app.Branch(`api/{id:[\d]+}`, true)
+	app.Branch("static/*path", true)
+
+	api, _ := app.Select("api")
+	api.SetTimeout(time.Second)
+	api.Before(func(p *grids.GridPacket) error { return nil })
+
+	id, _ := app.Select("api/id")
+	id.Terminal().Only(ByPackets(func(p *grids.GridPacket) {}))
+
+	gob.Describe("can i describe a route tree", func() {
+		gob.It("can i get the route tree", func() {
+			info := app.Describe()
+			gob.Assert(info.Path).Equal("/app")
+			gob.Assert(len(info.Routes)).Equal(2)
+
+			apinfo := info.Routes[0]
+			gob.Assert(apinfo.Path).Equal("/app/api")
+			gob.Assert(len(apinfo.Before)).Equal(1)
+			gob.Assert(apinfo.Timeout).Equal("1s")
+
+			idinfo := apinfo.Routes[0]
+			gob.Assert(idinfo.Kind).Equal("pattern")
+			gob.Assert(idinfo.Only).Equal(1)
+		})
+
+		gob.It("can i get the route tree as json", func() {
+			bin, err := app.DescribeJSON()
+			gob.Assert(err == nil).IsTrue()
+
+			info := new(RouteInfo)
+			gob.Assert(json.Unmarshal(bin, info) == nil).IsTrue()
+			gob.Assert(info.Routes[1].Routes[0].Kind).Equal("catchall")
+		})
+
+		gob.It("can i get the route tree as text", func() {
+			lines := strings.Split(strings.TrimSpace(app.DescribeText()), "\n")
+			gob.Assert(len(lines)).Equal(5)
+			gob.Assert(strings.HasPrefix(lines[1], "  /app/api [static]")).IsTrue()
+		})
+	})
+}
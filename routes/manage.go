@@ -0,0 +1,221 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+)
+
+//ErrRootRoute is returned when removing or replacing the route a call is made on
+var ErrRootRoute = errors.New("route cannot remove or replace itself")
+
+//Remove removes the sub-route at the path along with its own sub-routes, requests
+//for it are then rejected as for any unknown path. Names given to the removed
+//routes are dropped
+func (r *Routes) Remove(path string) error {
+	old, parent, err := r.detachable(path)
+
+	if err != nil {
+		return err
+	}
+
+	r.dropNames(old)
+
+	parent.lock.Lock()
+	for i, b := range parent.branches {
+		if b == old {
+			parent.branches = append(parent.branches[:i:i], parent.branches[i+1:]...)
+			break
+		}
+	}
+	parent.reindex()
+	parent.Links.Remove(old.Path)
+	parent.lock.Unlock()
+
+	old.lock.Lock()
+	old.parent = nil
+	old.lock.Unlock()
+
+	return nil
+}
+
+//Replace swaps the sub-route at the path for the given route, requests already in
+//the old route finish there while new requests go to the new one. Names given to
+//the old routes are dropped and those given within the new route are kept
+func (r *Routes) Replace(path string, rw *Routes) error {
+	if rw == nil {
+		return fmt.Errorf("no route to replace %s with", path)
+	}
+
+	old, parent, err := r.detachable(path)
+
+	if err != nil {
+		return err
+	}
+
+	if old == rw {
+		return nil
+	}
+
+	r.dropNames(old)
+
+	rw.lock.Lock()
+	rw.parent = parent
+	rw.lock.Unlock()
+
+	parent.lock.Lock()
+	for i, b := range parent.branches {
+		if b == old {
+			//copy so matches being made keep the list they were given
+			branches := make([]*Routes, len(parent.branches))
+			copy(branches, parent.branches)
+			branches[i] = rw
+			parent.branches = branches
+			break
+		}
+	}
+	parent.reindex()
+	parent.Links.Remove(old.Path)
+	parent.Links.Set(rw.Path, rw)
+	parent.lock.Unlock()
+
+	old.lock.Lock()
+	old.parent = nil
+	old.lock.Unlock()
+
+	r.adoptNames(rw)
+	return nil
+}
+
+//detachable returns the sub-route at the path and its parent if it can be removed
+//or replaced
+func (r *Routes) detachable(path string) (*Routes, *Routes, error) {
+	old, err := r.Select(path)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if old == nil || old == r {
+		return nil, nil, ErrRootRoute
+	}
+
+	old.lock.RLock()
+	parent := old.parent
+	old.lock.RUnlock()
+
+	//the route was detached by another call since it was selected
+	if parent == nil {
+		return nil, nil, fmt.Errorf("route %s was already removed", path)
+	}
+
+	return old, parent, nil
+}
+
+//within returns true if the route is the given route or one of its sub-routes
+func (r *Routes) within(top *Routes) bool {
+	for cur := r; cur != nil; {
+		if cur == top {
+			return true
+		}
+
+		cur.lock.RLock()
+		parent := cur.parent
+		cur.lock.RUnlock()
+		cur = parent
+	}
+
+	return false
+}
+
+//dropNames removes the names the root keeps for the route and its sub-routes
+func (r *Routes) dropNames(top *Routes) {
+	root := r.Root()
+
+	root.lock.RLock()
+	var drop []string
+	named := make(map[string]*Routes, len(root.names))
+	for name, rt := range root.names {
+		named[name] = rt
+	}
+	root.lock.RUnlock()
+
+	for name, rt := range named {
+		if rt.within(top) {
+			drop = append(drop, name)
+		}
+	}
+
+	if len(drop) <= 0 {
+		return
+	}
+
+	root.lock.Lock()
+	for _, name := range drop {
+		if root.names[name] == named[name] {
+			delete(root.names, name)
+		}
+	}
+	root.lock.Unlock()
+}
+
+//adoptNames moves the names kept by a route that was a root into the root of these
+//route's tree
+func (r *Routes) adoptNames(sub *Routes) {
+	sub.lock.Lock()
+	names := sub.names
+	sub.names = nil
+	sub.lock.Unlock()
+
+	if len(names) <= 0 {
+		return
+	}
+
+	root := r.Root()
+
+	root.lock.Lock()
+	if root.names == nil {
+		root.names = make(map[string]*Routes)
+	}
+	for name, rt := range names {
+		root.names[name] = rt
+	}
+	root.lock.Unlock()
+}
+
+//Mount hands requests for the prefix below these route to the given route tree as if
+//they were issued to it, the mounted tree keeps its own middleware, params, names and
+//handlers and can still be served on its own. Requests it rejects go to its own
+//diverted routes and NotFound handler
+func (r *Routes) Mount(prefix string, sub *Routes) error {
+	if sub == nil {
+		return fmt.Errorf("no route to mount under %s", prefix)
+	}
+
+	if sub.within(r) || r.within(sub) {
+		return fmt.Errorf("route %s cannot be mounted within its own tree", sub.Path)
+	}
+
+	r.Branch(prefix, r.Term.Strict.flush)
+
+	at, err := r.Select(prefix)
+
+	if err != nil {
+		return err
+	}
+
+	if at == r {
+		return fmt.Errorf("no prefix to mount %s under", sub.Path)
+	}
+
+	at.lock.Lock()
+	at.mount = sub
+	at.lock.Unlock()
+	return nil
+}
+
+//Mounted returns the route tree mounted at these route or nil if there is none
+func (r *Routes) Mounted() *Routes {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.mount
+}
@@ -0,0 +1,174 @@
+package routes
+
+import (
+	"sync"
+	"testing"
+
+	. "github.com/franela/goblin"
+	"github.com/influx6/grids"
+)
+
+func TestRouteRemoval(t *testing.T) {
+	gob := Goblin(t)
+
+	gob.Describe("Route removal and replacement specification", func() {
+
+		gob.It("can a removed route reject requests", func(done Done) {
+			app := NewRoutes("app", true)
+			app.Branch("beta/users", true)
+
+			beta, _ := app.Select("beta")
+			beta.Name("beta")
+			beta.Terminal().Only(ByPackets(func(p *grids.GridPacket) {
+				gob.Assert(false).IsTrue("removed route must not get requests")
+			}))
+
+			gob.Assert(app.Remove("beta")).Equal(nil)
+			gob.Assert(app.Has("beta")).IsFalse()
+			gob.Assert(app.Has("beta/users")).IsFalse()
+
+			_, err := app.Named("beta")
+			gob.Assert(err != nil).IsTrue()
+
+			app.Divert(NewRoutes("*missing", true)).Terminal().Only(ByPackets(func(p *grids.GridPacket) {
+				gob.Assert(PacketParams(p).Get("missing")).Equal("app/beta")
+				done()
+			}))
+
+			app.IssueRequestPath("app/beta", nil)
+		})
+
+		gob.It("can a replaced route take new requests", func(done Done) {
+			app := NewRoutes("app", true)
+			app.Branch("api/users", true)
+
+			api, _ := app.Select("api")
+			api.Terminal().Only(ByPackets(func(p *grids.GridPacket) {
+				gob.Assert(false).IsTrue("replaced route must not get requests")
+			}))
+
+			v2 := NewRoutes("api", true)
+			v2.Branch("accounts", true)
+			accounts, _ := v2.Select("accounts")
+			accounts.Name("accounts")
+			accounts.Terminal().Only(ByPackets(func(p *grids.GridPacket) {
+				done()
+			}))
+
+			gob.Assert(app.Replace("api", v2)).Equal(nil)
+			gob.Assert(app.Has("api/users")).IsFalse()
+			gob.Assert(app.Names()["accounts"]).Equal("api/accounts")
+
+			app.IssueRequestPath("app/api/accounts", nil)
+		})
+
+		gob.It("can a route not remove itself", func() {
+			app := NewRoutes("app", true)
+			gob.Assert(app.Remove("")).Equal(ErrRootRoute)
+		})
+
+		gob.It("can a route be removed and replaced at once", func() {
+			app := NewRoutes("app", true)
+			app.Branch("beta", true)
+
+			var wg sync.WaitGroup
+			errs := make(chan error, 2)
+
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				errs <- app.Remove("beta")
+			}()
+			go func() {
+				defer wg.Done()
+				errs <- app.Replace("beta", NewRoutes("beta", true))
+			}()
+			wg.Wait()
+			close(errs)
+
+			var failed int
+			for err := range errs {
+				if err != nil {
+					failed++
+				}
+			}
+
+			gob.Assert(failed <= 1).IsTrue("one of the calls succeeds")
+		})
+
+		gob.It("can i detach terminal handlers", func(done Done) {
+			app := NewRoutes("app", true)
+
+			off := app.Terminal().Only(ByPackets(func(p *grids.GridPacket) {
+				gob.Assert(false).IsTrue("detached handler must not run")
+			}))
+
+			app.Terminal().Only(ByPackets(func(p *grids.GridPacket) {
+				done()
+			}))
+
+			off()
+			off()
+
+			only, _ := app.Terminal().Counts()
+			gob.Assert(only).Equal(1)
+
+			app.IssueRequestPath("app", nil)
+		})
+	})
+}
+
+func TestRouteMount(t *testing.T) {
+	gob := Goblin(t)
+
+	gob.Describe("Route mounting specification", func() {
+
+		gob.It("can a mounted tree take requests below the prefix", func() {
+			gateway := NewRoutes("gateway", true).SetSync(true)
+			models := NewRoutes("models", true)
+			models.Branch("{id:int}", true)
+
+			var order []string
+
+			models.Before(func(p *grids.GridPacket) error {
+				order = append(order, "models")
+				return nil
+			})
+
+			id, _ := models.Select("id")
+			id.Terminal().Only(ByPackets(func(p *grids.GridPacket) {
+				order = append(order, "id")
+				gob.Assert(PacketParams(p).Get("id")).Equal(3)
+			}))
+
+			gob.Assert(gateway.Mount("api/models", models)).Equal(nil)
+			gob.Assert(gateway.IssueRequestPath("gateway/api/models/3", nil)).IsTrue()
+			gob.Assert(order).Eql([]string{"models", "id"})
+
+			info := gateway.Describe()
+			gob.Assert(info.Routes[0].Routes[0].Mount.Routes[0].Path).Equal("/gateway/api/models/{id:int}")
+		})
+
+		gob.It("can a mounted tree answer its own misses", func() {
+			gateway := NewRoutes("gateway", true).SetSync(true)
+			models := NewRoutes("models", true)
+
+			var missed []string
+			models.NotFound(func(p *grids.GridPacket) {
+				missed = append(missed, "models")
+			})
+
+			gateway.Mount("models", models)
+			gateway.IssueRequestPath("gateway/models/missing", nil)
+			gob.Assert(missed).Eql([]string{"models"})
+		})
+
+		gob.It("can a tree not be mounted within itself", func() {
+			app := NewRoutes("app", true)
+			app.Branch("sub", true)
+			sub, _ := app.Select("sub")
+
+			gob.Assert(sub.Mount("loop", app) != nil).IsTrue()
+		})
+	})
+}
@@ -0,0 +1,155 @@
+package routes
+
+import (
+	"context"
+	"errors"
+
+	"github.com/influx6/goutils"
+	"github.com/influx6/grids"
+)
+
+//ErrHandled is returned by middleware which has answered the request itself
+var ErrHandled = errors.New("request handled by middleware")
+
+//Middleware is run on every request passing through the route it is added to,
+//returning a non-nil error stops the request from going any further
+type Middleware func(*grids.GridPacket) error
+
+//Halt is returned by middleware to stop a request with the given status and message
+type Halt struct {
+	Status  int
+	Message string
+}
+
+//NewHalt returns a new Halt error
+func NewHalt(status int, message string) *Halt {
+	return &Halt{status, message}
+}
+
+//Error returns the message of the halt
+func (h *Halt) Error() string {
+	return h.Message
+}
+
+//Before adds middleware which runs when a request enters these route, before any of
+//its terminal handlers or sub-routes. Middleware of outer routes run before those of
+//inner routes and those of the same route run in the order they were added
+func (r *Routes) Before(mw ...Middleware) *Routes {
+	r.lock.Lock()
+	r.before = append(r.before, mw...)
+	r.lock.Unlock()
+	return r
+}
+
+//After adds middleware which runs once a request that passed through these route
+//is finished, that is when its Deadline is done or straight after its terminal
+//handlers when it has none. Middleware of inner routes run before those of outer routes
+func (r *Routes) After(mw ...Middleware) *Routes {
+	r.lock.Lock()
+	r.after = append(r.after, mw...)
+	r.lock.Unlock()
+	return r
+}
+
+//runBefore runs the before middleware of the route, halting the packet on the first
+//error and returning false
+func (r *Routes) runBefore(p *grids.GridPacket) bool {
+	r.lock.RLock()
+	mw := r.before
+	r.lock.RUnlock()
+
+	for _, m := range mw {
+		if err := m(p); err != nil {
+			HaltPacket(p, err)
+			return false
+		}
+	}
+
+	return true
+}
+
+//stackAfter adds the route's after middleware to the packet's stack
+func (r *Routes) stackAfter(p *grids.GridPacket) {
+	r.lock.RLock()
+	mw := r.after
+	r.lock.RUnlock()
+
+	if len(mw) <= 0 {
+		return
+	}
+
+	stack, _ := p.Get("After").([]Middleware)
+	stack = append(stack, mw...)
+	p.Set("After", stack)
+}
+
+//finishPacket runs the packet's after middleware once the request is finished
+func finishPacket(p *grids.GridPacket) {
+	finishSpan(p)
+
+	stack, ok := p.Get("After").([]Middleware)
+
+	if !ok || len(stack) <= 0 {
+		return
+	}
+
+	p.Set("After", nil)
+
+	run := func() {
+		for i := len(stack) - 1; i >= 0; i-- {
+			if err := stack[i](p); err != nil {
+				return
+			}
+		}
+	}
+
+	if dl, ok := PacketDeadline(p); ok {
+		go func() {
+			<-dl.Done()
+			run()
+		}()
+		return
+	}
+
+	run()
+}
+
+//HaltPacket stops a request, handing the error to the packet's 'OnHalt' callback
+//which transports set to answer the request
+func HaltPacket(p *grids.GridPacket, err error) {
+	if err != ErrHandled {
+		PacketSpan(p).Fail(err)
+	}
+
+	finishSpan(p)
+
+	if fx, ok := p.Get("OnHalt").(func(error)); ok {
+		fx(err)
+	}
+}
+
+//PacketParams returns the params map of a request packet
+func PacketParams(p *grids.GridPacket) *goutils.Map {
+	params, ok := p.Get("Params").(*goutils.Map)
+
+	if !ok {
+		params = goutils.NewMap()
+		p.Set("Params", params)
+	}
+
+	return params
+}
+
+//PacketContext returns the context of a request packet or a background context if
+//it has none
+func PacketContext(p *grids.GridPacket) context.Context {
+	if ctx, ok := p.Get("Context").(context.Context); ok {
+		return ctx
+	}
+	return context.Background()
+}
+
+//WithValue adds a value to the context of a request packet
+func WithValue(p *grids.GridPacket, key, value interface{}) {
+	p.Set("Context", context.WithValue(PacketContext(p), key, value))
+}
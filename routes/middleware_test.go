@@ -0,0 +1,88 @@
+package routes
+
+import (
+	"testing"
+
+	. "github.com/franela/goblin"
+	"github.com/influx6/grids"
+)
+
+func TestMiddleware(t *testing.T) {
+	gob := Goblin(t)
+
+	gob.Describe("Route middleware specification", func() {
+
+		gob.It("can middleware run from outermost to innermost", func(done Done) {
+			app := NewRoutes("app", true)
+			app.Branch("api/users", true)
+
+			var order []string
+
+			app.Before(func(p *grids.GridPacket) error {
+				order = append(order, "app")
+				return nil
+			})
+
+			api, _ := app.Select("api")
+			api.Before(func(p *grids.GridPacket) error {
+				order = append(order, "api")
+				PacketParams(p).Set("user", "bob")
+				return nil
+			})
+
+			users, _ := app.Select("api/users")
+			users.Terminal().Only(ByPackets(func(p *grids.GridPacket) {
+				gob.Assert(order).Eql([]string{"app", "api"})
+				gob.Assert(PacketParams(p).Get("user")).Equal("bob")
+				done()
+			}))
+
+			app.IssueRequestPath("app/api/users", nil)
+		})
+
+		gob.It("can middleware halt a request", func(done Done) {
+			app := NewRoutes("app", true)
+			app.Branch("admin", true)
+
+			admin, _ := app.Select("admin")
+			admin.Before(func(p *grids.GridPacket) error {
+				return NewHalt(403, "forbidden")
+			})
+
+			admin.Terminal().Only(ByPackets(func(p *grids.GridPacket) {
+				gob.Assert(false).IsTrue("halted request must not reach handlers")
+			}))
+
+			app.IssueRequestPath("app/admin", func(p *grids.GridPacket) {
+				p.Set("OnHalt", func(err error) {
+					h, ok := err.(*Halt)
+					gob.Assert(ok).IsTrue("error is a halt")
+					gob.Assert(h.Status).Equal(403)
+					done()
+				})
+			})
+		})
+
+		gob.It("can after middleware run innermost first", func(done Done) {
+			app := NewRoutes("app", true)
+			app.Branch("logs", true)
+
+			var order []string
+
+			app.After(func(p *grids.GridPacket) error {
+				order = append(order, "app")
+				gob.Assert(order).Eql([]string{"logs", "app"})
+				done()
+				return nil
+			})
+
+			logs, _ := app.Select("logs")
+			logs.After(func(p *grids.GridPacket) error {
+				order = append(order, "logs")
+				return nil
+			})
+
+			app.IssueRequestPath("app/logs", nil)
+		})
+	})
+}
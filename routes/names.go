@@ -0,0 +1,163 @@
+package routes
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/influx6/goutils"
+	"github.com/influx6/reggy"
+)
+
+//Name names these route so paths to it can be built with URL, names are kept by the
+//root route and a name given twice belongs to the last route it was given to
+func (r *Routes) Name(name string) *Routes {
+	root := r.Root()
+
+	root.lock.Lock()
+	if root.names == nil {
+		root.names = make(map[string]*Routes)
+	}
+	root.names[name] = r
+	root.lock.Unlock()
+
+	return r
+}
+
+//Root returns the top most route of the tree these route belongs to
+func (r *Routes) Root() *Routes {
+	cur := r
+
+	for {
+		cur.lock.RLock()
+		parent := cur.parent
+		cur.lock.RUnlock()
+
+		if parent == nil {
+			return cur
+		}
+
+		cur = parent
+	}
+}
+
+//Named returns the route with the given name
+func (r *Routes) Named(name string) (*Routes, error) {
+	root := r.Root()
+
+	root.lock.RLock()
+	defer root.lock.RUnlock()
+
+	rt, ok := root.names[name]
+
+	if !ok {
+		return nil, fmt.Errorf("no route named %s", name)
+	}
+
+	return rt, nil
+}
+
+//Template returns the path of these route from below the root route, with pattern
+//segments in their {name:pattern} form e.g 'users/{id:[\d]+}'
+func (r *Routes) Template() string {
+	var parts []string
+
+	for cur := r; ; {
+		cur.lock.RLock()
+		parent := cur.parent
+		cur.lock.RUnlock()
+
+		if parent == nil {
+			break
+		}
+
+		seg := cur.raw
+		if cur.optional {
+			seg += "?"
+		}
+
+		parts = append([]string{seg}, parts...)
+		cur = parent
+	}
+
+	return strings.Join(parts, "/")
+}
+
+//Names returns the templates of every named route in the tree keyed by name
+func (r *Routes) Names() map[string]string {
+	root := r.Root()
+
+	root.lock.RLock()
+	named := make(map[string]*Routes, len(root.names))
+	for name, rt := range root.names {
+		named[name] = rt
+	}
+	root.lock.RUnlock()
+
+	templates := make(map[string]string, len(named))
+	for name, rt := range named {
+		templates[name] = rt.Template()
+	}
+
+	return templates
+}
+
+//URL builds the path, from below the root route, to the route with the given name
+//filling its pattern and catch-all segments from params
+func (r *Routes) URL(name string, params map[string]string) (string, error) {
+	rt, err := r.Named(name)
+
+	if err != nil {
+		return "", err
+	}
+
+	return BuildPath(rt.Template(), params)
+}
+
+//BuildPath fills a route template with the params, every value is checked against
+//the pattern of its segment. Optional segments without a value are left out and
+//catch-all segments take a value of one or more segments
+func BuildPath(template string, params map[string]string) (string, error) {
+	var parts []string
+
+	for _, raw := range goutils.SplitPattern(template) {
+		sg := parseSegment(raw)
+
+		switch sg.kind {
+		case StaticSegment:
+			parts = append(parts, sg.raw)
+		case CatchAllSegment:
+			name := strings.TrimPrefix(sg.raw, "*")
+			val, ok := params[name]
+
+			if !ok || val == "" {
+				if sg.optional {
+					continue
+				}
+				return "", fmt.Errorf("missing param %s for %s", name, template)
+			}
+
+			for _, v := range goutils.SplitPattern(val) {
+				parts = append(parts, url.PathEscape(v))
+			}
+		case PatternSegment:
+			matcher := reggy.GenerateClassicMatcher(sg.pattern)
+			val, ok := params[matcher.Original]
+
+			if !ok || val == "" {
+				if sg.optional {
+					continue
+				}
+				return "", fmt.Errorf("missing param %s for %s", matcher.Original, template)
+			}
+
+			if !matcher.Validate(val) {
+				return "", fmt.Errorf("param %s value %q does not match %s", matcher.Original, val, sg.raw)
+			}
+
+			parts = append(parts, url.PathEscape(val))
+		}
+	}
+
+	return strings.Join(parts, "/"), nil
+}
@@ -0,0 +1,55 @@
+package routes
+
+import (
+	"testing"
+
+	. "github.com/franela/goblin"
+)
+
+func TestNamedRoutes(t *testing.T) {
+	gob := Goblin(t)
+
+	app := NewRoutes("app", true)
+	app.Branch(`users/{id:[\d]+}`, true)
+	app.Branch("static/*path", true)
+	app.Branch(`posts/{page:[\d]+}?`, true)
+
+	user, _ := app.Select("users/id")
+	user.Name("user")
+
+	static, _ := app.Select("static/*path")
+	static.Name("static")
+
+	page, _ := app.Select("posts/page")
+	page.Name("posts")
+
+	gob.Describe("can i build paths from route names", func() {
+		gob.It("can i get the route template", func() {
+			gob.Assert(user.Template()).Equal(`users/{id:[\d]+}`)
+			gob.Assert(app.Names()["static"]).Equal("static/*path")
+		})
+
+		gob.It("can i build a path with params", func() {
+			path, err := app.URL("user", map[string]string{"id": "40"})
+			gob.Assert(err == nil).IsTrue()
+			gob.Assert(path).Equal("users/40")
+		})
+
+		gob.It("can a param not matching its pattern fail", func() {
+			_, err := app.URL("user", map[string]string{"id": "bob"})
+			gob.Assert(err != nil).IsTrue()
+		})
+
+		gob.It("can i build a catch-all path", func() {
+			path, err := app.URL("static", map[string]string{"path": "css/site.css"})
+			gob.Assert(err == nil).IsTrue()
+			gob.Assert(path).Equal("static/css/site.css")
+		})
+
+		gob.It("can i leave out an optional segment", func() {
+			path, err := app.URL("posts", nil)
+			gob.Assert(err == nil).IsTrue()
+			gob.Assert(path).Equal("posts")
+		})
+	})
+}
@@ -0,0 +1,113 @@
+package routes
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//Converter turns the segment matched by a typed route into the value set under the
+//route's name in the packet's 'Params', returning an error for segments it cannot convert
+type Converter func(seg string) (interface{}, error)
+
+//paramType is a segment type usable in routes as '{name:type}'
+type paramType struct {
+	pattern string
+	convert Converter
+}
+
+var typeLock sync.RWMutex
+
+//paramTypes holds the segment types by name, 'int' and 'float' convert to int and
+//float64, 'uuid' to a lowercase string and 'slug' and 'string' keep the segment
+var paramTypes = map[string]*paramType{
+	"int":    {`-?[\d]+`, convertInt},
+	"float":  {`-?[\d]+(\.[\d]+)?`, convertFloat},
+	"uuid":   {`[\da-fA-F]+-[\da-fA-F]+-[\da-fA-F]+-[\da-fA-F]+-[\da-fA-F]+`, convertUUID},
+	"slug":   {`[a-z\d]+(-[a-z\d]+)*`, convertString},
+	"string": {`[^/]+`, convertString},
+}
+
+//RegisterType adds a segment type routes can declare as '{name:type}'. Segments not
+//matching the reggy pattern are a route miss, those the converter fails on are
+//halted with a 400. Registering a type again replaces it for routes branched after
+func RegisterType(name, pattern string, convert Converter) {
+	if convert == nil {
+		convert = convertString
+	}
+
+	typeLock.Lock()
+	paramTypes[name] = &paramType{pattern, convert}
+	typeLock.Unlock()
+}
+
+//lookupType returns the segment type with the given name
+func lookupType(name string) (*paramType, bool) {
+	typeLock.RLock()
+	defer typeLock.RUnlock()
+	t, ok := paramTypes[name]
+	return t, ok
+}
+
+//typedSegment expands a '{name:type}' segment into its reggy pattern and converter
+func typedSegment(raw string) (string, Converter, bool) {
+	if !strings.HasPrefix(raw, "{") || !strings.HasSuffix(raw, "}") {
+		return raw, nil, false
+	}
+
+	parts := strings.SplitN(raw[1:len(raw)-1], ":", 2)
+
+	if len(parts) != 2 {
+		return raw, nil, false
+	}
+
+	t, ok := lookupType(parts[1])
+
+	if !ok {
+		return raw, nil, false
+	}
+
+	return "{" + parts[0] + ":" + t.pattern + "}", t.convert, true
+}
+
+//convertParam returns the segment converted by the route's converter or a 400 halt
+//when the converter fails
+func (r *Routes) convertParam(seg string) (interface{}, error) {
+	val, err := r.convert(seg)
+
+	if err != nil {
+		return nil, NewHalt(400, fmt.Sprintf("invalid %s %q: %s", r.Param(), seg, err))
+	}
+
+	return val, nil
+}
+
+func convertInt(seg string) (interface{}, error) {
+	return strconv.Atoi(seg)
+}
+
+func convertFloat(seg string) (interface{}, error) {
+	return strconv.ParseFloat(seg, 64)
+}
+
+func convertString(seg string) (interface{}, error) {
+	return seg, nil
+}
+
+func convertUUID(seg string) (interface{}, error) {
+	parts := strings.Split(seg, "-")
+	sizes := []int{8, 4, 4, 4, 12}
+
+	if len(parts) != len(sizes) {
+		return nil, fmt.Errorf("not a uuid")
+	}
+
+	for i, part := range parts {
+		if len(part) != sizes[i] {
+			return nil, fmt.Errorf("not a uuid")
+		}
+	}
+
+	return strings.ToLower(seg), nil
+}
@@ -0,0 +1,81 @@
+package routes
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	. "github.com/franela/goblin"
+	"github.com/influx6/grids"
+)
+
+func TestTypedParams(t *testing.T) {
+	gob := Goblin(t)
+
+	gob.Describe("Typed route params specification", func() {
+
+		gob.It("can a typed segment expand to its pattern", func() {
+			sg := parseSegment("{id:int}")
+			gob.Assert(sg.kind).Equal(PatternSegment)
+			gob.Assert(sg.raw).Equal("{id:int}")
+			gob.Assert(sg.pattern).Equal(`{id:-?[\d]+}`)
+			gob.Assert(sg.convert != nil).IsTrue()
+		})
+
+		gob.It("can handlers get converted values", func(done Done) {
+			app := NewRoutes("app", true)
+			app.Branch("users/{id:int}", true)
+
+			id, _ := app.Select("users/id")
+			id.Terminal().Only(ByPackets(func(p *grids.GridPacket) {
+				gob.Assert(PacketParams(p).Get("id")).Equal(40)
+				done()
+			}))
+
+			app.IssueRequestPath("app/users/40", nil)
+		})
+
+		gob.It("can a failed conversion halt with a 400", func(done Done) {
+			app := NewRoutes("app", true)
+			app.Branch("users/{id:int}", true)
+
+			app.IssueRequestPath("app/users/99999999999999999999999", func(p *grids.GridPacket) {
+				p.Set("OnHalt", func(err error) {
+					h, ok := err.(*Halt)
+					gob.Assert(ok).IsTrue("error is a halt")
+					gob.Assert(h.Status).Equal(400)
+					done()
+				})
+			})
+		})
+
+		gob.It("can i register a type", func(done Done) {
+			RegisterType("upper", `[a-zA-Z]+`, func(seg string) (interface{}, error) {
+				if seg == "" {
+					return nil, fmt.Errorf("empty")
+				}
+				return strings.ToUpper(seg), nil
+			})
+
+			app := NewRoutes("app", true)
+			app.Branch("codes/{code:upper}", true)
+
+			code, _ := app.Select("codes/code")
+			code.Terminal().Only(ByPackets(func(p *grids.GridPacket) {
+				gob.Assert(PacketParams(p).Get("code")).Equal("ABC")
+				done()
+			}))
+
+			app.IssueRequestPath("app/codes/abc", nil)
+		})
+
+		gob.It("can i build a path for a typed segment", func() {
+			path, err := BuildPath("users/{id:int}", map[string]string{"id": "40"})
+			gob.Assert(err == nil).IsTrue()
+			gob.Assert(path).Equal("users/40")
+
+			_, err = BuildPath("users/{id:int}", map[string]string{"id": "bob"})
+			gob.Assert(err != nil).IsTrue()
+		})
+	})
+}
@@ -7,8 +7,10 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/influx6/composelab/trace"
 	"github.com/influx6/evroll"
 	"github.com/influx6/goutils"
 	"github.com/influx6/grids"
@@ -34,6 +36,7 @@ type RouteKeeper struct {
 	timeout       time.Duration
 	buffered      bool
 	done          bool
+	stop          <-chan struct{}
 }
 
 //Release returns grids.GridPacket,Error
@@ -66,24 +69,36 @@ func (rk *RouteKeeper) Release(cbx func(*grids.GridPacket)) error {
 // 	}
 // }
 
-//Secure collects the gridPacket to be kept by the routekeeper
+//Secure collects the gridPacket to be kept by the routekeeper, unbuffered keepers
+//hold it till it is released, their stop chan is closed or their timeout passes and
+//the default action is run
 func (rk *RouteKeeper) Secure(g *grids.GridPacket) {
+	if rk.buffered {
+		rk.block <- g
+		return
+	}
+
 	go func() {
-		go func() {
-			rk.block <- g
-		}()
+		var timeout <-chan time.Time
 
-		<-time.After(rk.timeout)
+		if rk.timeout > 0 {
+			timer := time.NewTimer(rk.timeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
 
-		if !rk.buffered {
-			defer close(rk.block)
+		select {
+		case rk.block <- g:
+			return
+		case <-rk.stop:
+		case <-timeout:
 			if rk.defaultAction != nil {
-				rk.defaultAction(<-rk.block)
-			} else {
-				<-rk.block
+				rk.defaultAction(g)
 			}
-			rk.done = true
 		}
+
+		close(rk.block)
+		rk.done = true
 	}()
 }
 
@@ -106,11 +121,10 @@ func NewRouteKeeper(timeout int, fail func(*grids.GridPacket)) *RouteKeeper {
 	ms = time.Duration(timeout) * time.Millisecond
 
 	return &RouteKeeper{
-		mc,
-		fail,
-		ms,
-		buf,
-		false,
+		block:         mc,
+		defaultAction: fail,
+		timeout:       ms,
+		buffered:      buf,
 	}
 
 }
@@ -123,19 +137,40 @@ func NewRouteFinalizer(f bool, fail func(g *grids.GridPacket)) *RouteFinalizer {
 		evroll.NewEvent("Added"),
 	}
 
+	//keepers are not added to the box, they end with their release, stop or timeout
+	//and holding them would keep every request a long lived route has handled
 	rf.Added.Listen(grids.ByPackets(func(data *grids.GridPacket) {
-		ms, ok := data.Get("timeout").(int)
+		keeperFor(data, fail).Secure(data)
+	}))
+
+	return rf
+}
+
+//keeperFor returns the keeper of a request packet. Packets with a deadline are kept
+//till it is stopped or runs out, which times the request out itself, and are not
+//kept waiting at all when it has no time set. Other packets are kept for their
+//'timeout' meta in milliseconds or 6ms
+func keeperFor(g *grids.GridPacket, fail func(*grids.GridPacket)) *RouteKeeper {
+	dl, ok := PacketDeadline(g)
+
+	if !ok {
+		ms, ok := g.Get("timeout").(int)
 
 		if !ok {
 			ms = 6
 		}
 
-		kp := NewRouteKeeper(ms, fail)
-		rf.Box.Add(kp, nil)
-		kp.Secure(data)
-	}))
+		return NewRouteKeeper(ms, fail)
+	}
 
-	return rf
+	if dl.Remaining() < 0 {
+		return NewRouteKeeper(0, fail)
+	}
+
+	return &RouteKeeper{
+		block: make(chan *grids.GridPacket),
+		stop:  dl.Done(),
+	}
 }
 
 //Drop adds a new request gridPacket to the routefinalizer stack for treatment
@@ -170,6 +205,16 @@ func (rf *RouteFinalizer) Effect(cb func(g *grids.GridPacket)) {
 //Callable represents a func with a interface as argument
 type Callable func(data interface{}, r *RouteFinalizer)
 
+//ByPackets wraps a function taking only the request packet into a Callable,
+//ignoring data that are not *grids.GridPacket
+func ByPackets(fx func(*grids.GridPacket)) Callable {
+	return func(data interface{}, _ *RouteFinalizer) {
+		if g, ok := data.(*grids.GridPacket); ok {
+			fx(g)
+		}
+	}
+}
+
 //RouteTypes is the standard defining interface for all routables
 type RouteTypes interface {
 	Select(string) (*Routes, error)
@@ -180,8 +225,17 @@ type RouteTypes interface {
 
 //TerminalType describes the set of terminal must functions
 type TerminalType interface {
-	Only(Callable)
-	Any(Callable)
+	Only(Callable) Detach
+	Any(Callable) Detach
+}
+
+//Detach removes the terminal handler it was returned for, calling it again does nothing
+type Detach func()
+
+//handler is a terminal handler kept with the id it is detached by
+type handler struct {
+	id int
+	fx Callable
 }
 
 //Terminal defines a means of providing events that simplifies the
@@ -190,49 +244,132 @@ type Terminal struct {
 	Loose  *RouteFinalizer //is emitted when path is within terminal's route
 	Strict *RouteFinalizer //is emitted only when path is terminal's route
 	// Route      *Routes
+	lock  sync.RWMutex
+	ids   int
+	anys  []handler
+	onlys []handler
 }
 
 //Any adds a callback to listen to all events passing the AllEvents handler
-func (t *Terminal) Any(c Callable) {
-	t.Loose.Added.Listen(func(d interface{}) {
-		c(d, t.Loose)
-	})
+func (t *Terminal) Any(c Callable) Detach {
+	return t.attach(&t.anys, c)
 }
 
 //Only adds a callback to listen to events on the OnlyEvent handler
-func (t *Terminal) Only(c Callable) {
-	t.Strict.Added.Listen(func(d interface{}) {
-		c(d, t.Strict)
-	})
+func (t *Terminal) Only(c Callable) Detach {
+	return t.attach(&t.onlys, c)
+}
+
+//Clear detaches every handler of the terminal
+func (t *Terminal) Clear() {
+	t.lock.Lock()
+	t.anys = nil
+	t.onlys = nil
+	t.lock.Unlock()
+}
+
+//Counts returns the number of Only and Any handlers attached to the terminal
+func (t *Terminal) Counts() (only int, any int) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return len(t.onlys), len(t.anys)
+}
+
+//attach adds the callback to the handler list returning its Detach
+func (t *Terminal) attach(list *[]handler, c Callable) Detach {
+	t.lock.Lock()
+	t.ids++
+	id := t.ids
+	*list = append(*list, handler{id, c})
+	t.lock.Unlock()
+
+	return func() {
+		t.lock.Lock()
+		defer t.lock.Unlock()
+
+		for i, h := range *list {
+			if h.id == id {
+				//copy so handlers being run keep the list they were given
+				rest := make([]handler, 0, len(*list)-1)
+				rest = append(rest, (*list)[:i]...)
+				*list = append(rest, (*list)[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+//handle returns a listener running the handlers of the list with the finalizer,
+//sync packets are skipped as their handlers have already run
+func (t *Terminal) handle(list *[]handler, f *RouteFinalizer) func(interface{}) {
+	return func(d interface{}) {
+		if isSync(d) {
+			return
+		}
+
+		t.run(list, f, d)
+	}
+}
+
+//run calls the handlers of the list with the data returning how many ran
+func (t *Terminal) run(list *[]handler, f *RouteFinalizer, d interface{}) int {
+	t.lock.RLock()
+	hs := *list
+	t.lock.RUnlock()
+
+	for _, h := range hs {
+		h.fx(d, f)
+	}
+
+	return len(hs)
 }
 
 //Routes is the base struct for defining interlinking routes
 type Routes struct {
 	*grids.Grid
-	Path    string
-	Pattern *reggy.ClassicMatcher
-	Links   *goutils.Map
-	Term    *Terminal
+	Path     string
+	Pattern  *reggy.ClassicMatcher
+	Links    *goutils.Map
+	Term     *Terminal
+	Timeout  time.Duration
+	raw      string
+	kind     SegmentKind
+	optional bool
+	param    interface{}
+	convert  Converter
+	lock     sync.RWMutex
+	parent   *Routes
+	names    map[string]*Routes
+	branches []*Routes
+	index    *routeIndex
+	diverts  []*Routes
+	mount    *Routes
+	notFound func(*grids.GridPacket)
+	sync     bool
+	tracer   *trace.Tracer
+	before   []Middleware
+	after    []Middleware
 }
 
 //IssueRequestPath takes a string path and a data to issue an auto packet request
-//payload
-func (r *Routes) IssueRequestPath(path string, before func(*grids.GridPacket)) {
+//payload, in sync mode it returns true if any terminal handler ran for the request
+func (r *Routes) IssueRequestPath(path string, before func(*grids.GridPacket)) bool {
 	pack := grids.NewPacket()
 	pack.Set("Pathways", goutils.SplitPatternAndRemovePrefix(path))
 	//send off the request
 	if before != nil {
 		before(pack)
 	}
-	r.InSend("Request", pack)
+	return r.issue(pack)
 }
 
-//IssueRequestPacket takes a string path and a packet and pushes off as a request
-func (r *Routes) IssueRequestPacket(path string, pack *grids.GridPacket) {
+//IssueRequestPacket takes a string path and a packet and pushes off as a request,
+//in sync mode it returns true if any terminal handler ran for the request
+func (r *Routes) IssueRequestPacket(path string, pack *grids.GridPacket) bool {
 	//add the Pathways meta data
 	pack.Set("Pathways", goutils.SplitPatternAndRemovePrefix(path))
 	//send off the request
-	r.InSend("Request", pack)
+	return r.issue(pack)
 }
 
 //IssueRequest takes a packet and pushes off as a request if it has
@@ -242,19 +379,25 @@ func (r *Routes) IssueRequest(pack *grids.GridPacket) error {
 		return fmt.Errorf("packet has no %s meta", "Pathways")
 	}
 	//send off the request
-	r.InSend("Request", pack)
+	r.issue(pack)
 	return nil
 }
 
 //Divert takes another member route and when these routes rejects
-//requests its sent to this,it returns the supplied *Routes for chaining
+//requests its sent to this,it returns the supplied *Routes for chaining.
+//Routes diverted to are kept by the root route, tried in the order given and get the
+//full request path
 func (r *Routes) Divert(rw *Routes) *Routes {
-	r.OutBind("Bad", rw.In("Request"))
+	root := r.Root()
+	root.lock.Lock()
+	root.diverts = append(root.diverts, rw)
+	root.lock.Unlock()
 	return rw
 }
 
 //Branch defines the member function of a route that defines the set
-//of given pathways
+//of given pathways, segments already branched are reused. A segment of
+//'*name' captures the rest of the path and a trailing '?' makes a segment optional
 func (r *Routes) Branch(path string, drop bool) {
 	if path == "" {
 		return
@@ -266,12 +409,23 @@ func (r *Routes) Branch(path string, drop bool) {
 		return
 	}
 
-	first := parts[0]
-	cur := NewRoutes(first, drop)
+	sg := parseSegment(parts[0])
 	rem := parts[1:]
+	cur := newRoutesFor(sg, drop)
 
-	r.Links.Set(cur.Path, cur)
-	r.OutBind("All", cur.In("Request"))
+	if old, ok := r.Links.Get(cur.Path).(*Routes); ok {
+		cur = old
+	} else {
+		cur.lock.Lock()
+		cur.parent = r
+		cur.lock.Unlock()
+
+		r.lock.Lock()
+		r.branches = append(r.branches[:len(r.branches):len(r.branches)], cur)
+		r.reindex()
+		r.lock.Unlock()
+		r.Links.Set(cur.Path, cur)
+	}
 
 	if len(rem) <= 0 {
 		return
@@ -337,6 +491,20 @@ func (r *Routes) Select(path string) (*Routes, error) {
 	return cur.Select(strings.Join(rem, "/"))
 }
 
+//applyDeadline shortens the packet's deadline to the route's timeout
+func (r *Routes) applyDeadline(p *grids.GridPacket) {
+	if dl, ok := PacketDeadline(p); ok {
+		dl.Within(r.Timeout)
+	}
+}
+
+//SetTimeout sets the time requests passing through these route have to be answered
+//in, requests keep the shortest timeout of the routes they pass through
+func (r *Routes) SetTimeout(t time.Duration) *Routes {
+	r.Timeout = t
+	return r
+}
+
 //Terminal returns the *Terminal set for these Route
 func (r *Routes) Terminal() *Terminal {
 	return r.Term
@@ -345,27 +513,29 @@ func (r *Routes) Terminal() *Terminal {
 //NewTerm returns a terminal connected to a specific route
 func NewTerm(drop bool) *Terminal {
 	term := &Terminal{
-		NewRouteFinalizer(drop),
-		NewRouteFinalizer(drop),
-		// route,
+		Loose:  NewRouteFinalizer(drop, nil),
+		Strict: NewRouteFinalizer(drop, nil),
 	}
+
+	term.Loose.Added.Listen(term.handle(&term.anys, term.Loose))
+	term.Strict.Added.Listen(term.handle(&term.onlys, term.Strict))
 	return term
 }
 
 //NewRoutes returns a new route for a specific path
 func NewRoutes(path string, drop bool) *Routes {
-	matcher := reggy.GenerateClassicMatcher(path)
-	return NewRoutesBy(matcher.Original, matcher, drop)
+	return newRoutesFor(parseSegment(path), drop)
 }
 
 //NewRoutesBy returns a new route for a specific path but allows giving your own matcher
 func NewRoutesBy(path string, pattern *reggy.ClassicMatcher, drop bool) *Routes {
 	r := &Routes{
-		grids.NewGrid("Composelab/Routes/" + path),
-		path,
-		pattern,
-		goutils.NewMap(),
-		NewTerm(drop),
+		Grid:    grids.NewGrid("Composelab/Routes/" + path),
+		Path:    path,
+		Pattern: pattern,
+		Links:   goutils.NewMap(),
+		Term:    NewTerm(drop),
+		param:   path,
 	}
 	// r.Term = NewTerm(r)
 
@@ -391,45 +561,7 @@ func NewRoutesBy(path string, pattern *reggy.ClassicMatcher, drop bool) *Routes
 			return
 		}
 
-		paths, ok := p.Get("Pathways").([]string)
-
-		if len(paths) <= 0 {
-			r.OutSend("Bad", p)
-			return
-		}
-
-		if !ok {
-			r.OutSend("Bad", p)
-			return
-		}
-
-		first := paths[0]
-
-		if !r.Pattern.Validate(first) {
-			r.OutSend("Bad", p)
-			next(p)
-			return
-		}
-
-		if !p.Has("Params") {
-			p.Set("Params", goutils.NewMap())
-		}
-
-		params, ok := p.Get("Params").(*goutils.Map)
-
-		if ok {
-			params.Set(r.Path, first)
-		}
-
-		rem := paths[1:]
-		p.Set("Pathways", rem)
-
-		if len(rem) <= 0 {
-			r.OutSend("Only", p)
-		}
-
-		r.OutSend("All", p)
-
+		r.request(p)
 		next(p)
 	})
 
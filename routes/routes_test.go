@@ -28,6 +28,30 @@ func TestRouteKeeper(t *testing.T) {
 
 			k.Secure(grids.NewPacket())
 		})
+
+		gob.It("can routes which are never flushed not keep every request", func() {
+			svc := NewRoutes("svc", false)
+			svc.Branch("items", false)
+			items, _ := svc.Select("items")
+			items.Terminal().Only(func(_ interface{}, _ *RouteFinalizer) {})
+
+			for i := 0; i < 200; i++ {
+				svc.IssueRequestPath("svc/items", nil)
+			}
+
+			kept := 0
+			count := func(_ interface{}, _ interface{}) interface{} {
+				kept++
+				return nil
+			}
+
+			for _, r := range []*Routes{svc, items} {
+				r.Terminal().Loose.Box.Each(count, nil)
+				r.Terminal().Strict.Box.Each(count, nil)
+			}
+
+			gob.Assert(kept).Eql(0)
+		})
 	})
 
 }
@@ -102,3 +126,76 @@ func TestRoute(t *testing.T) {
 	})
 
 }
+
+func TestRouteSegments(t *testing.T) {
+	gob := Goblin(t)
+
+	files := NewRoutes("files", true)
+	files.Branch("*path", true)
+	files.Branch("readme", true)
+	files.Branch(`{id:[\d]+}`, true)
+
+	posts := NewRoutes("posts", true)
+	posts.Branch(`{page:[\d]+}?`, true)
+
+	gob.Describe("can i create wildcard and optional routes", func() {
+		gob.It("can i create a catch-all route", func() {
+			gob.Assert(files.Has("*path")).IsTrue()
+			rest, err := files.Select("*path")
+			gob.Assert(err == nil).IsTrue()
+			gob.Assert(rest.Kind()).Equal(CatchAllSegment)
+			gob.Assert(rest.Param()).Equal("path")
+		})
+
+		gob.It("can i create an optional route", func() {
+			page, err := posts.Select("page")
+			gob.Assert(err == nil).IsTrue()
+			gob.Assert(page.Optional()).IsTrue()
+		})
+	})
+
+	gob.Describe("can i send a request for", func() {
+		gob.It("sending request for /files/css/site.css", func(done Done) {
+			rest, _ := files.Select("*path")
+
+			rest.Terminal().Only(ByPackets(func(p *grids.GridPacket) {
+				gob.Assert(PacketParams(p).Get("path")).Equal("css/site.css")
+				done()
+			}))
+
+			files.IssueRequestPath("files/css/site.css", nil)
+		})
+
+		gob.It("sending request for /files/readme prefers the static route", func(done Done) {
+			readme, _ := files.Select("readme")
+
+			readme.Terminal().Only(ByPackets(func(p *grids.GridPacket) {
+				done()
+			}))
+
+			files.IssueRequestPath("files/readme", nil)
+		})
+
+		gob.It("sending request for /files/20 prefers the pattern route", func(done Done) {
+			id, _ := files.Select("id")
+
+			id.Terminal().Only(ByPackets(func(p *grids.GridPacket) {
+				gob.Assert(PacketParams(p).Get("id")).Equal("20")
+				done()
+			}))
+
+			files.IssueRequestPath("files/20", nil)
+		})
+
+		gob.It("sending request for /posts reaches the optional route", func(done Done) {
+			page, _ := posts.Select("page")
+
+			page.Terminal().Only(ByPackets(func(p *grids.GridPacket) {
+				gob.Assert(PacketParams(p).Has("page")).IsFalse()
+				done()
+			}))
+
+			posts.IssueRequestPath("posts", nil)
+		})
+	})
+}
@@ -0,0 +1,234 @@
+package routes
+
+import (
+	"strings"
+
+	"github.com/influx6/grids"
+	"github.com/influx6/reggy"
+)
+
+//SegmentKind describes how a route matches its path segment
+type SegmentKind int
+
+//The kinds of segments a route can match, when several sub-routes could take a
+//segment static routes win over pattern routes which win over catch-all routes
+const (
+	//StaticSegment matches a segment equal to the route path e.g 'logs'
+	StaticSegment SegmentKind = iota
+	//PatternSegment matches a segment with a reggy pattern e.g '{id:[\d]+}'
+	PatternSegment
+	//CatchAllSegment matches all remaining segments e.g '*rest'
+	CatchAllSegment
+)
+
+//String returns the name of the kind
+func (s SegmentKind) String() string {
+	switch s {
+	case PatternSegment:
+		return "pattern"
+	case CatchAllSegment:
+		return "catchall"
+	default:
+		return "static"
+	}
+}
+
+//segment holds the parsed form of a single route path segment
+type segment struct {
+	raw      string
+	pattern  string
+	kind     SegmentKind
+	optional bool
+	convert  Converter
+}
+
+//parseSegment parses a route path segment, a leading '*' marks a catch-all segment
+//capturing the rest of the path, a trailing '?' marks an optional segment and a
+//pattern of a registered type such as '{id:int}' marks a typed segment
+func parseSegment(raw string) *segment {
+	sg := &segment{raw: raw}
+
+	if strings.HasSuffix(raw, "?") {
+		sg.optional = true
+		sg.raw = strings.TrimSuffix(raw, "?")
+	}
+
+	switch {
+	case strings.HasPrefix(sg.raw, "*"):
+		sg.kind = CatchAllSegment
+		if sg.raw == "*" {
+			sg.raw = "*rest"
+		}
+	case strings.Contains(sg.raw, "{"):
+		sg.kind = PatternSegment
+	default:
+		sg.kind = StaticSegment
+	}
+
+	sg.pattern = sg.raw
+
+	if sg.kind == PatternSegment {
+		sg.pattern, sg.convert, _ = typedSegment(sg.raw)
+	}
+
+	return sg
+}
+
+//Kind returns the kind of segment the route matches
+func (r *Routes) Kind() SegmentKind {
+	return r.kind
+}
+
+//Optional returns true if requests ending at the parent route are also taken by
+//these route
+func (r *Routes) Optional() bool {
+	return r.optional
+}
+
+//Param returns the name the route's matched segment is set under in the packet's
+//'Params', catch-all routes set the rest of the path joined by '/' and typed routes
+//set the converted segment
+func (r *Routes) Param() string {
+	if r.kind == CatchAllSegment {
+		return strings.TrimPrefix(r.Path, "*")
+	}
+	return r.Path
+}
+
+//accepts returns true if the route takes the segment
+func (r *Routes) accepts(seg string) bool {
+	switch r.kind {
+	case StaticSegment:
+		return r.Path == seg || r.Pattern.Validate(seg)
+	case PatternSegment:
+		return r.Pattern.Validate(seg)
+	default:
+		return true
+	}
+}
+
+//match returns the sub-route a path segment should go to, static routes are found
+//by their path first then pattern routes are tried in the order they were added and
+//then the catch-all route takes the segment
+func (r *Routes) match(seg string) *Routes {
+	idx := r.lookup()
+
+	if b, ok := idx.static[seg]; ok {
+		return b
+	}
+
+	for _, b := range idx.pattern {
+		if b.accepts(seg) {
+			return b
+		}
+	}
+
+	return idx.catch
+}
+
+//optionalBranch returns the first optional sub-route
+func (r *Routes) optionalBranch() *Routes {
+	return r.lookup().optional
+}
+
+//enter takes a request into the route, consuming the first of the paths which the
+//route has matched. A request ending here goes to an optional sub-route if there is
+//one else to the route's Only terminal, a request with paths left goes to the
+//sub-route matching its next segment or, if none do and no route on the walk has
+//Any handlers to catch it, the route's Bad output.
+//Only the route a request is issued to receives it as a grids event, the rest of
+//the walk down the tree happens in the same call. A request reaching a route with a
+//tree mounted on it enters the mounted tree with its remaining paths
+func (r *Routes) enter(p *grids.GridPacket, paths []string) {
+	var rem []string
+
+	if len(paths) > 0 {
+		rem = paths[1:]
+
+		switch {
+		case r.kind == CatchAllSegment:
+			PacketParams(p).Set(r.param, strings.Join(paths, "/"))
+			rem = nil
+		case r.kind == StaticSegment && paths[0] == r.Path:
+			//the segment is the route's own path which is kept boxed
+			PacketParams(p).Set(r.param, r.param)
+		case r.convert != nil:
+			val, err := r.convertParam(paths[0])
+
+			if err != nil {
+				HaltPacket(p, err)
+				return
+			}
+
+			PacketParams(p).Set(r.param, val)
+		default:
+			PacketParams(p).Set(r.param, paths[0])
+		}
+	}
+
+	r.applyDeadline(p)
+
+	if !r.runBefore(p) {
+		return
+	}
+
+	r.stackAfter(p)
+	p.Set("Pathways", rem)
+
+	if sub := r.Mounted(); sub != nil {
+		r.deliver("All", p)
+		sub.enter(p, append([]string{sub.Path}, rem...))
+		return
+	}
+
+	if len(rem) <= 0 {
+		if opt := r.optionalBranch(); opt != nil {
+			r.deliver("All", p)
+			opt.enter(p, nil)
+			return
+		}
+
+		r.markSpan(p)
+		r.deliver("Only", p)
+		finishPacket(p)
+		r.deliver("All", p)
+		return
+	}
+
+	next := r.match(rem[0])
+
+	if next == nil {
+		//requests caught by Any handlers on the walk are theirs to answer
+		if _, any := r.Term.Counts(); any <= 0 && !caught(p) {
+			r.reject(p)
+			return
+		}
+
+		r.deliver("All", p)
+		return
+	}
+
+	r.deliver("All", p)
+
+	//the sub-route has accepted the segment so it is entered directly
+	next.enter(p, rem)
+}
+
+//newRoutesFor returns a new route for a parsed path segment
+func newRoutesFor(sg *segment, drop bool) *Routes {
+	var r *Routes
+
+	if sg.kind == CatchAllSegment {
+		r = NewRoutesBy(sg.raw, reggy.GenerateClassicMatcher(strings.TrimPrefix(sg.raw, "*")), drop)
+	} else {
+		matcher := reggy.GenerateClassicMatcher(sg.pattern)
+		r = NewRoutesBy(matcher.Original, matcher, drop)
+	}
+
+	r.raw = sg.raw
+	r.convert = sg.convert
+	r.kind = sg.kind
+	r.optional = sg.optional
+	r.param = r.Param()
+	return r
+}
@@ -0,0 +1,112 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/influx6/composelab/trace"
+	"github.com/influx6/grids"
+)
+
+//errExpired is the error of route spans whose request ran past its deadline
+var errExpired = errors.New("request deadline expired")
+
+//Trace sets the tracer recording a route span for every request issued to the tree,
+//it is kept by the root route
+func (r *Routes) Trace(t *trace.Tracer) *Routes {
+	root := r.Root()
+	root.lock.Lock()
+	root.tracer = t
+	root.lock.Unlock()
+	return r
+}
+
+//Tracer returns the tracer of the tree or nil if it has none
+func (r *Routes) Tracer() *trace.Tracer {
+	root := r.Root()
+	root.lock.RLock()
+	defer root.lock.RUnlock()
+	return root.tracer
+}
+
+//PacketSpan returns the route span of a request packet or nil if it has none
+func PacketSpan(p *grids.GridPacket) *trace.Span {
+	span, _ := p.Get("Span").(*trace.Span)
+	return span
+}
+
+//PacketTrace returns the trace context of a request packet, transports set it to the
+//context the request came in with and it is replaced with the context of the route
+//span once one is started, requests made while handling the packet belong under it
+func PacketTrace(p *grids.GridPacket) trace.Context {
+	tc, _ := p.Get("Trace").(trace.Context)
+	return tc
+}
+
+//OutgoingContext returns the context of a request packet carrying the packet's trace
+//context, links given it send their requests within the request's trace
+func OutgoingContext(p *grids.GridPacket) context.Context {
+	return trace.NewContext(PacketContext(p), PacketTrace(p))
+}
+
+//startSpan starts the route span of a request under its trace context, a request
+//with a deadline has its span finished when the deadline is done
+func (r *Routes) startSpan(p *grids.GridPacket) {
+	r.lock.RLock()
+	tracer := r.tracer
+	r.lock.RUnlock()
+
+	if tracer == nil {
+		return
+	}
+
+	paths, _ := p.Get("RequestPath").([]string)
+	span := tracer.Start(trace.RouteSpan, "/"+strings.Join(paths, "/"), PacketTrace(p))
+
+	p.Set("Span", span)
+	p.Set("Trace", span.Context())
+
+	dl, ok := PacketDeadline(p)
+
+	if !ok {
+		return
+	}
+
+	go func() {
+		<-dl.Done()
+
+		if dl.Expired() {
+			span.Fail(errExpired)
+		}
+
+		span.Finish()
+	}()
+}
+
+//markSpan records the template of the route taking the request on its span, as
+//'route' e.g 'app/users/{id:int}'
+func (r *Routes) markSpan(p *grids.GridPacket) {
+	span := PacketSpan(p)
+
+	if span == nil {
+		return
+	}
+
+	route := r.Root().Path
+
+	if tmpl := r.Template(); tmpl != "" {
+		route += "/" + tmpl
+	}
+
+	span.Set("route", route)
+}
+
+//finishSpan finishes the route span of a request without a deadline
+func finishSpan(p *grids.GridPacket) {
+	if _, ok := PacketDeadline(p); ok {
+		return
+	}
+
+	PacketSpan(p).Finish()
+}
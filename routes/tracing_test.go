@@ -0,0 +1,84 @@
+package routes
+
+import (
+	"errors"
+	"testing"
+
+	. "github.com/franela/goblin"
+	"github.com/influx6/composelab/trace"
+	"github.com/influx6/grids"
+)
+
+func TestTracing(t *testing.T) {
+	gob := Goblin(t)
+
+	gob.Describe("Route tracing specification", func() {
+
+		gob.It("can a route span be recorded under the incoming trace", func() {
+			var spans []*trace.Span
+			tracer := trace.NewTracer("app", trace.ExporterFunc(func(s *trace.Span) error {
+				spans = append(spans, s)
+				return nil
+			}))
+
+			app := NewRoutes("app", true).SetSync(true).Trace(tracer)
+			app.Branch("users", true)
+
+			var inner trace.Context
+
+			users, _ := app.Select("users")
+			users.Terminal().Only(ByPackets(func(p *grids.GridPacket) {
+				inner = PacketTrace(p)
+			}))
+
+			app.IssueRequestPath("app/users", func(p *grids.GridPacket) {
+				p.Set("Trace", trace.Context{TraceID: "t1", SpanID: "s1"})
+			})
+
+			gob.Assert(len(spans)).Equal(1)
+			gob.Assert(spans[0].Kind).Equal(trace.RouteSpan)
+			gob.Assert(spans[0].Name).Equal("/app/users")
+			gob.Assert(spans[0].TraceID).Equal("t1")
+			gob.Assert(spans[0].ParentID).Equal("s1")
+			gob.Assert(inner).Equal(spans[0].Context())
+		})
+
+		gob.It("can requests made for a packet carry its context and trace", func() {
+			p := grids.NewPacket()
+			p.Set("Trace", trace.Context{TraceID: "t1", SpanID: "s1"})
+			WithValue(p, "user", "ann")
+
+			ctx := OutgoingContext(p)
+			gob.Assert(trace.FromContext(ctx)).Equal(trace.Context{TraceID: "t1", SpanID: "s1"})
+			gob.Assert(ctx.Value("user")).Equal("ann")
+		})
+
+		gob.It("can a halted request fail its span", func() {
+			var spans []*trace.Span
+			tracer := trace.NewTracer("app", trace.ExporterFunc(func(s *trace.Span) error {
+				spans = append(spans, s)
+				return nil
+			}))
+
+			app := NewRoutes("app", true).SetSync(true).Trace(tracer)
+			app.Before(func(p *grids.GridPacket) error {
+				return errors.New("denied")
+			})
+
+			app.IssueRequestPath("app", nil)
+
+			gob.Assert(len(spans)).Equal(1)
+			gob.Assert(spans[0].Error).Equal("denied")
+			gob.Assert(spans[0].ParentID).Equal("")
+		})
+
+		gob.It("can requests be issued without a tracer", func() {
+			app := NewRoutes("app", true).SetSync(true)
+			app.Terminal().Only(ByPackets(func(p *grids.GridPacket) {
+				gob.Assert(PacketSpan(p) == nil).IsTrue()
+			}))
+
+			gob.Assert(app.IssueRequestPath("app", nil)).IsTrue()
+		})
+	})
+}
@@ -1,13 +1,16 @@
 package services
 
 import (
+	"bytes"
 	"encoding/json"
 	"io"
-	"log"
+	"io/ioutil"
 	"net/http"
 	"strings"
 
 	"github.com/influx6/composelab/arch"
+	"github.com/influx6/composelab/routes"
+	"github.com/influx6/composelab/trace"
 	"github.com/influx6/grids"
 )
 
@@ -23,8 +26,61 @@ type HTTPService struct {
 	cert *HTTPCert
 }
 
-//CollectHTTPBody takes a requests and retrieves the body from the into a gridpacket object
-func CollectHTTPBody(r *http.Request, g *grids.GridPacket) {
+//MaxBodySize is the largest request body in bytes services read, requests with larger
+//bodies are answered with ErrBodyTooLarge
+var MaxBodySize int64 = 32 << 20
+
+//ErrBodyTooLarge answers requests with a body larger than MaxBodySize
+var ErrBodyTooLarge = arch.NewError(http.StatusRequestEntityTooLarge, "request body is too large")
+
+//readHTTPBody reads the body of the request, bodies larger than MaxBodySize are
+//refused with ErrBodyTooLarge
+func readHTTPBody(r *http.Request) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, MaxBodySize+1))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(data)) > MaxBodySize {
+		return nil, ErrBodyTooLarge
+	}
+
+	return data, nil
+}
+
+//bufferHTTPBody reads the body of the request before it is routed so it can be
+//collected and parsed, requests with bodies which can not be read or are too large
+//are refused with the error body of the error and true is returned
+func bufferHTTPBody(rw http.ResponseWriter, r *http.Request) bool {
+	if r.Body == nil {
+		return false
+	}
+
+	data, err := readHTTPBody(r)
+	r.Body.Close()
+
+	if err != nil {
+		if err != ErrBodyTooLarge {
+			err = arch.NewError(http.StatusBadRequest, "unable to read request body")
+		}
+
+		failResponse(NewResponse(rw), arch.AsError(err), r.Header.Get("X-Request-UUID"))
+		return true
+	}
+
+	r.Body = ioutil.NopCloser(bytes.NewReader(data))
+	r.ContentLength = int64(len(data))
+	return false
+}
+
+//CollectHTTPBody takes a requests and retrieves the body from the into a gridpacket object,
+//bodies which can not be read are logged to the logger or the DefaultLogger if it is nil
+func CollectHTTPBody(r *http.Request, g *grids.GridPacket, log arch.Logger) {
+	if log == nil {
+		log = arch.DefaultLogger
+	}
+
 	content, ok := r.Header["Content-Type"]
 	muxcontent := strings.Join(content, ";")
 	wind := strings.Index(muxcontent, "application/x-www-form-urlencode")
@@ -41,7 +97,7 @@ func CollectHTTPBody(r *http.Request, g *grids.GridPacket) {
 
 		if wind != -1 {
 			if err := r.ParseForm(); err != nil {
-				log.Println("Request Read Form Error", err)
+				log.Warn("unable to parse request form", arch.Fields{"path": r.URL.Path, "err": err})
 			} else {
 				form := r.Form
 				pform := r.PostForm
@@ -55,7 +111,7 @@ func CollectHTTPBody(r *http.Request, g *grids.GridPacket) {
 
 		if mind != -1 {
 			if err := r.ParseMultipartForm(32 << 20); err != nil {
-				log.Println("Request Read MultipartForm Error", err)
+				log.Warn("unable to parse multipart request form", arch.Fields{"path": r.URL.Path, "err": err})
 			} else {
 				g.Set("Data", true)
 				g.Set("Form", false)
@@ -66,48 +122,89 @@ func CollectHTTPBody(r *http.Request, g *grids.GridPacket) {
 
 		if mind == -1 && wind == -1 && r.Body != nil {
 
-			data := make([]byte, r.ContentLength)
-			total, err := r.Body.Read(data)
+			data, err := readHTTPBody(r)
 
 			if err != nil {
-				if err != io.EOF {
-					log.Println("Request Read Body Error", err)
-					return
-				}
+				log.Warn("unable to read request body", arch.Fields{"path": r.URL.Path, "err": err})
+				return
 			}
 
 			g.Set("Data", true)
 			g.Set("Form", false)
-			g.Set("Value", total)
+			g.Set("Value", len(data))
 			g.Set("Body", data)
 
 		}
 	}
 }
 
+//UseTLS serves the service over tls with the certificate and gives its descriptor
+//the https scheme
+func (m *HTTPService) UseTLS(cert *HTTPCert) {
+	m.cert = cert
+	m.GetDescriptor().Scheme = "https"
+}
+
 //Dial beings the service connection
 func (m *HTTPService) Dial() error {
-	if m.cert != nil {
-		// return http.ListenAndServe(m.GetPath(), http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
-		// 	m.Route.IssueRequestPath(r.URL.Path, func(pack *grids.GridPacket) {
-		// 		pack.Set("Req", r)
-		// 		pack.Set("Res", rw)
-		// 		CollectHTTPBody(r, pack)
-		// 	})
-		// }))
-		return http.ListenAndServe(m.GetPath(), http.HandlerFunc(m.ProcessPackets))
-	}
-	return http.ListenAndServeTLS(m.GetPath(), m.cert.Cert, m.cert.Key, http.HandlerFunc(m.ProcessPackets))
+	return m.Serve(m.ProcessPackets)
+}
+
+//Serve starts listening on the service address with the given handler, using tls
+//when the service was given a certificate
+func (m *HTTPService) Serve(handler http.HandlerFunc) error {
+	if m.cert == nil {
+		return http.ListenAndServe(m.GetPath(), handler)
+	}
+	return http.ListenAndServeTLS(m.GetPath(), m.cert.Cert, m.cert.Key, handler)
 }
 
 //ProcessPackets takes the req and response objects from the http server and wraps them in a grid packet
-//for use in the service framework
+//for use in the service framework, it waits till the route handlers end the response
+//and answers with a 504 if the request deadline passes first. Handlers which write
+//the response without ending it are not held to the deadline, the response ends once
+//they stop writing for ResponseIdle
 func (m *HTTPService) ProcessPackets(rw http.ResponseWriter, r *http.Request) {
+	if bufferHTTPBody(rw, r) {
+		return
+	}
+
+	res := NewResponse(rw)
+	dl := m.NewDeadline(r.Context())
+
+	var id string
+
 	m.Route.IssueRequestPath(r.URL.Path, func(pack *grids.GridPacket) {
 		pack.Set("Req", r)
-		pack.Set("Res", rw)
-		CollectHTTPBody(r, pack)
+		id = arch.RequestID(pack)
+		pack.Set("Res", res)
+		pack.Set("Trace", trace.Extract(r.Header))
+		pack.Set("Deadline", dl)
+		pack.Set("Context", dl.Context())
+		pack.Set("Reply", replyResponse(res))
+		pack.Set("OnHalt", haltResponse(res, id))
+		CollectHTTPBody(r, pack, m.Logger())
 	})
+
+	m.awaitResponse(res, dl, r, id)
+}
+
+//awaitResponse waits for the response to end, ending it with a 504 error body if the
+//deadline passes before anything is written
+func (m *HTTPService) awaitResponse(res *Response, dl *routes.Deadline, r *http.Request, id string) {
+	select {
+	case <-res.Done():
+		dl.Stop()
+	case <-res.Wrote():
+		dl.Stop()
+		res.EndIdle(ResponseIdle, r.Context().Done())
+	case <-dl.Done():
+		if dl.Expired() {
+			m.RecordTimeout(r.URL.Path)
+			failResponse(res, arch.NewError(http.StatusGatewayTimeout, "request timed out"), id)
+		}
+		res.End()
+	}
 }
 
 //WhenServiceJSON checks a gridpacket for the json flag and gets the body sorted from the
@@ -129,14 +226,15 @@ var WhenServiceJSON = func(g *grids.GridPacket, next func(li *arch.LinkDescripto
 	err := json.Unmarshal(body, li)
 
 	if err != nil {
-		log.Fatal("Error occured when unmarshalling json to linkdescriptor", err, li)
+		arch.ReplyError(g, arch.NewError(400, "invalid link descriptor: "+err.Error()))
 		return
 	}
 
 	next(li, g)
 }
 
-//ExtractReqRes collects the request and response from a gridpacket
+//ExtractReqRes collects the request and response from a gridpacket, ending the
+//response once next returns
 var ExtractReqRes = func(g *grids.GridPacket, next func(res http.ResponseWriter, req *http.Request)) {
 	req, ok := g.Get("Req").(*http.Request)
 
@@ -151,62 +249,63 @@ var ExtractReqRes = func(g *grids.GridPacket, next func(res http.ResponseWriter,
 	}
 
 	next(res, req)
+	EndResponse(res)
 }
 
 //NewHTTPFactory creates a new slave service struct
-func NewHTTPFactory(serviceName string, slaveAddr string, slavePort int, cert *HTTPCert, master arch.Linkage) *HTTPService {
+func NewHTTPFactory(serviceName string, slaveAddr string, slavePort int, cert *HTTPCert, master arch.Linkage, opts ...arch.ServiceOption) *HTTPService {
 	var scheme string
 
 	if cert != nil {
-		scheme = "http://"
+		scheme = "https"
 	} else {
-		scheme = "https://"
+		scheme = "http"
 	}
 
 	desc := arch.NewDescriptor("http", serviceName, slaveAddr, slavePort, "0", scheme)
-	var sm = &HTTPService{arch.NewService(desc, master), cert}
+	var sm = &HTTPService{arch.NewService(desc, master, opts...), cert}
 
 	reg, err := sm.Select("register")
 
 	if err == nil {
-		reg.Terminal().Only(grids.ByPackets(func(g *grids.GridPacket) {
+		reg.Terminal().Only(routes.ByPackets(func(g *grids.GridPacket) {
 			WhenServiceJSON(g, func(li *arch.LinkDescriptor, _ *grids.GridPacket) {
 				sm.Register(li.Service, li)
+
+				if !sm.HasProvider(li.Service, li.UUID) {
+					arch.ReplyError(g, arch.NewError(404, "provider was not registered").With("service", li.Service))
+					return
+				}
+
 				ExtractReqRes(g, func(res http.ResponseWriter, req *http.Request) {
-					if sm.HasRegistered(li.Service) {
-						res.WriteHeader(200)
-					} else {
-						res.WriteHeader(404)
-					}
+					res.WriteHeader(200)
 				})
 			})
 		}))
 	}
 
-	disc, err := sm.Select("discover")
+	disc, err := sm.Select("discover/*service")
 
 	if err == nil {
-		disc.Terminal().Any(grids.ByPackets(func(g *grids.GridPacket) {
-			path, _ := g.Get("Pathways").([]string)
-			service := path[0]
+		disc.Terminal().Only(routes.ByPackets(func(g *grids.GridPacket) {
+			service, _ := routes.PacketParams(g).Get("service").(string)
 
-			ExtractReqRes(g, func(res http.ResponseWriter, req *http.Request) {
-				li, err := sm.GetServiceProvider(service)
+			li, err := sm.GetServiceProvider(service)
 
-				if err != nil {
-					log.Fatal("Unable to find service", service)
-					res.WriteHeader(404)
-					return
-				}
+			if err != nil {
+				arch.ReplyError(g, arch.NewError(404, err.Error()).With("service", service))
+				return
+			}
 
-				bin, err := json.Marshal(li)
+			bin, err := json.Marshal(li)
 
-				if err != nil {
-					log.Fatal("Unable to jsonify service linkdescriptor: ", err, li)
-					res.WriteHeader(404)
-					return
-				}
+			if err != nil {
+				sm.Logger().Error("unable to encode link descriptor", arch.Fields{"service": service, "err": err})
+				arch.ReplyError(g, err)
+				return
+			}
 
+			ExtractReqRes(g, func(res http.ResponseWriter, req *http.Request) {
 				res.Header().Set("Content-Type", "charset=utf-8;application/json")
 				res.WriteHeader(200)
 				res.Write(bin)
@@ -216,18 +315,43 @@ func NewHTTPFactory(serviceName string, slaveAddr string, slavePort int, cert *H
 		}))
 	}
 
+	provs, err := sm.Select("providers/*service")
+
+	if err == nil {
+		provs.Terminal().Only(routes.ByPackets(func(g *grids.GridPacket) {
+			service, _ := routes.PacketParams(g).Get("service").(string)
+			providers, err := sm.GetServiceProviders(service)
+
+			if err != nil {
+				arch.ReplyError(g, arch.NewError(404, err.Error()).With("service", service))
+				return
+			}
+
+			bin, err := json.Marshal(providers)
+
+			if err != nil {
+				arch.ReplyError(g, err)
+				return
+			}
+
+			arch.Reply(g, 200, bin)
+		}))
+	}
+
 	unreg, err := sm.Select("unregister")
 
 	if err == nil {
-		unreg.Terminal().Only(grids.ByPackets(func(g *grids.GridPacket) {
+		unreg.Terminal().Only(routes.ByPackets(func(g *grids.GridPacket) {
 			WhenServiceJSON(g, func(li *arch.LinkDescriptor, _ *grids.GridPacket) {
 				sm.Unregister(li.Service, li)
+
+				if sm.HasProvider(li.Service, li.UUID) {
+					arch.ReplyError(g, arch.NewError(404, "provider is still registered").With("service", li.Service))
+					return
+				}
+
 				ExtractReqRes(g, func(res http.ResponseWriter, req *http.Request) {
-					if !sm.HasRegistered(li.Service) {
-						res.WriteHeader(200)
-					} else {
-						res.WriteHeader(404)
-					}
+					res.WriteHeader(200)
 				})
 			})
 		}))
@@ -237,11 +361,11 @@ func NewHTTPFactory(serviceName string, slaveAddr string, slavePort int, cert *H
 }
 
 //NewHTTPService creates a new http service struct
-func NewHTTPService(service, addr string, port int, master arch.Linkage) *HTTPService {
-	return NewHTTPFactory(service, addr, port, nil, master)
+func NewHTTPService(service, addr string, port int, master arch.Linkage, opts ...arch.ServiceOption) *HTTPService {
+	return NewHTTPFactory(service, addr, port, nil, master, opts...)
 }
 
 //NewHTTPSecureService creates a new secure http service struct
-func NewHTTPSecureService(service, addr string, port int, cert *HTTPCert, master arch.Linkage) *HTTPService {
-	return NewHTTPFactory(service, addr, port, cert, master)
+func NewHTTPSecureService(service, addr string, port int, cert *HTTPCert, master arch.Linkage, opts ...arch.ServiceOption) *HTTPService {
+	return NewHTTPFactory(service, addr, port, cert, master, opts...)
 }
@@ -0,0 +1,114 @@
+package services
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/franela/goblin"
+	"github.com/influx6/composelab/arch"
+	"github.com/influx6/composelab/routes"
+	"github.com/influx6/grids"
+)
+
+func TestHTTPService(t *testing.T) {
+	g := goblin.Goblin(t)
+
+	hs := NewHTTPService("site", "127.0.0.1", 3320, nil)
+	hs.RequestTimeout = time.Second
+	hs.Branch("ended")
+	hs.Branch("written")
+	hs.Branch("silent")
+
+	ended, _ := hs.Select("ended")
+	ended.Terminal().Only(routes.ByPackets(func(p *grids.GridPacket) {
+		arch.Reply(p, 201, []byte("made"))
+	}))
+
+	written, _ := hs.Select("written")
+	written.Terminal().Only(routes.ByPackets(func(p *grids.GridPacket) {
+		res, _ := p.Get("Res").(*Response)
+		res.WriteHeader(202)
+		res.Write([]byte("queued"))
+	}))
+
+	g.Describe("HTTPService", func() {
+
+		g.It("can replies end the response", func() {
+			rw := httptest.NewRecorder()
+			hs.ProcessPackets(rw, httptest.NewRequest("GET", "/site/ended", nil))
+			g.Assert(rw.Code).Eql(201)
+			g.Assert(rw.Body.String()).Eql("made")
+		})
+
+		g.It("can handlers which write without ending answer without waiting on the deadline", func() {
+			start := time.Now()
+			rw := httptest.NewRecorder()
+			hs.ProcessPackets(rw, httptest.NewRequest("GET", "/site/written", nil))
+
+			g.Assert(time.Since(start) < hs.RequestTimeout).IsTrue("the deadline was not waited on")
+			g.Assert(rw.Code).Eql(202)
+			g.Assert(rw.Body.String()).Eql("queued")
+		})
+
+		g.It("can unreadable bodies be logged to the service's logger", func() {
+			var buf bytes.Buffer
+			logged := NewHTTPService("logged", "127.0.0.1", 3321, nil, arch.WithLogger(arch.NewStdLogger(&buf, arch.DebugLevel)))
+
+			req := httptest.NewRequest("POST", "/logged", strings.NewReader("a=%zz"))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			CollectHTTPBody(req, grids.NewPacket(), logged.Logger())
+			g.Assert(strings.Contains(buf.String(), "unable to parse request form")).IsTrue(buf.String())
+		})
+
+		g.It("can chunked and oversized bodies be read or refused", func() {
+			echo := NewHTTPService("echo", "127.0.0.1", 3322, nil)
+			echo.Branch("say")
+			say, _ := echo.Select("say")
+			say.Terminal().Only(routes.ByPackets(func(p *grids.GridPacket) {
+				body, _ := p.Get("Body").([]byte)
+				arch.Reply(p, 200, body)
+			}))
+
+			defer func(max int64) { MaxBodySize = max }(MaxBodySize)
+			MaxBodySize = 16
+
+			req := httptest.NewRequest("POST", "/echo/say", strings.NewReader(`{"chunked":1}`))
+			req.Header.Set("Content-Type", "application/json")
+			req.ContentLength = -1
+
+			rw := httptest.NewRecorder()
+			echo.ProcessPackets(rw, req)
+			g.Assert(rw.Code).Eql(200)
+			g.Assert(rw.Body.String()).Eql(`{"chunked":1}`)
+
+			req = httptest.NewRequest("POST", "/echo/say", strings.NewReader(`{"chunked":"too long"}`))
+			req.Header.Set("Content-Type", "application/json")
+			req.ContentLength = -1
+
+			rw = httptest.NewRecorder()
+			echo.ProcessPackets(rw, req)
+
+			e, ok := arch.ParseError(rw.Body.Bytes())
+			g.Assert(rw.Code).Eql(413)
+			g.Assert(ok).IsTrue(rw.Body.String())
+			g.Assert(e.Code).Eql(413)
+		})
+
+		g.It("can unanswered requests time out", func() {
+			hs.RequestTimeout = 30 * time.Millisecond
+			defer func() { hs.RequestTimeout = time.Second }()
+
+			rw := httptest.NewRecorder()
+			hs.ProcessPackets(rw, httptest.NewRequest("GET", "/site/silent", nil))
+
+			e, ok := arch.ParseError(rw.Body.Bytes())
+			g.Assert(rw.Code).Eql(504)
+			g.Assert(ok).IsTrue(rw.Body.String())
+			g.Assert(e.Code).Eql(504)
+		})
+	})
+}
@@ -1,13 +1,18 @@
-package sevices
+package services
 
 import (
-	"log"
+	"bytes"
+	"encoding/json"
+	"fmt"
 	"net/http"
-	"net/url"
 	"strings"
+	"sync"
+	"time"
 
+	"code.google.com/p/go-uuid/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/influx6/composelab/arch"
+	"github.com/influx6/composelab/trace"
 	"github.com/influx6/grids"
 )
 
@@ -16,101 +21,603 @@ var webSocketUpgrade = websocket.Upgrader{
 	WriteBufferSize: 1024,
 }
 
-//JSONPService represents a service handling the jsonp protocol
-type JSONPService struct {
-	*HTTPService
-	callback string
-}
+//Transport names used by the HybridService
+const (
+	TransportWebSocket   = "websocket"
+	TransportEventSource = "eventsource"
+	TransportPolling     = "polling"
+	TransportJSONP       = "jsonp"
+)
 
-//WebSocketService represents a service handling the websocket protocol
-type WebSocketService struct {
-	*HTTPService
-}
-
-//PollService represents a service handling the http-long polling protocol
-type PollService struct {
-	*HTTPService
+//Session is the transport independent view of a connected client, it is set as the
+//'Session' meta on packets issued by session based services. Send delivers a raw
+//message to the client over whatever transport it is on
+type Session interface {
+	ID() string
+	Send([]byte) error
+	Close()
 }
 
 func isWebSocketRequest(r *http.Request) bool {
 	var _ interface{}
 	_, hasupgrade := r.Header["Upgrade"]
 	_, hassec := r.Header["Sec-Websocket-Version"]
-	_, hasext := r.Header["Sec-Websocket-Extensions"]
 	_, haskey := r.Header["Sec-Websocket-Key"]
-	return hasupgrade && hassec && hasext && haskey
+	return hasupgrade && hassec && haskey
+}
+
+func isEventSourceRequest(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/event-stream")
 }
 
-//ProcessPackets for JSONPService handles checking and validating a request as a
-//valid jsonp request before process it for use
-func (j *JSONPService) ProcessPackets(rw http.ResponseWriter, r *http.Request) {
-	q, _ := url.ParseQuery(r.URL.RawQuery)
+//upgradeHeaders returns the extra headers sent along a websocket upgrade response
+func upgradeHeaders(r *http.Request) http.Header {
+	hd := make(http.Header)
+
+	agent, ok := r.Header["User-Agent"]
+
+	if ok {
+		ag := strings.Join(agent, ";")
+		msie := strings.Index(ag, ";MSIE")
+		trident := strings.Index(ag, "Trident/")
 
-	if _, ok := q["json"]; ok {
-		if _, ok := q[j.callback]; ok {
-			j.HTTPService.processPackets(rw, r)
+		if msie != -1 || trident != -1 {
+			hd.Set("X-XSS-Protection", "0")
 		}
 	}
+
+	origin, ok := r.Header["Origin"]
+
+	if ok {
+		hd.Set("Access-Control-Allow-Credentials", "true")
+		hd.Set("Access-Control-Allow-Origin", strings.Join(origin, ";"))
+	} else {
+		hd.Set("Access-Control-Allow-Origin", "*")
+	}
+
+	return hd
+}
+
+//eventStream is a Session writing messages to a server-sent events response
+type eventStream struct {
+	send   chan []byte
+	closer chan struct{}
+	once   sync.Once
+	id     string
+}
+
+func newEventStream(id string, size int) *eventStream {
+	return &eventStream{
+		send:   make(chan []byte, size),
+		closer: make(chan struct{}),
+		id:     id,
+	}
+}
+
+//ID returns the id of the stream's session
+func (e *eventStream) ID() string {
+	return e.id
+}
+
+//Send queues a message for the stream
+func (e *eventStream) Send(data []byte) error {
+	select {
+	case <-e.closer:
+		return ErrSessionClosed
+	default:
+	}
+
+	select {
+	case e.send <- data:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+//Close ends the stream
+func (e *eventStream) Close() {
+	e.once.Do(func() {
+		close(e.closer)
+	})
+}
+
+//HybridSession is a client session of the HybridService, it outlives the transport
+//the client is using and queues messages while the client has no open stream
+type HybridSession struct {
+	*PollSession
+	slock     sync.Mutex
+	transport string
+	stream    Session
+}
+
+//Transport returns the name of the transport the client is currently on
+func (h *HybridSession) Transport() string {
+	h.slock.Lock()
+	defer h.slock.Unlock()
+	return h.transport
 }
 
-//ProcessPackets for JSONPService handles checking and validating a request as a
-//valid jsonp request before process it for use
-func (w *WebSocketService) ProcessPackets(rw http.ResponseWriter, r *http.Request) {
-	q, _ := url.ParseQuery(r.URL.RawQuery)
+//Push delivers the message over the open stream or queues it for the next poll,
+//websocket clients get it as an Envelope on the path as WSConn.Push sends it so
+//they can tell it from the replies to their own envelopes. The message is sent under
+//the session lock so a stream attaching can not leave it queued
+func (h *HybridSession) Push(path string, data []byte) error {
+	h.slock.Lock()
+	defer h.slock.Unlock()
 
-	if isWebSocketRequest(r) {
-		rw.Header().Set("Upgrades", strings.Join(proc, ";"))
+	if h.stream != nil {
+		if err := pushTo(h.stream, path, data); err == nil {
+			return nil
+		}
 
-		agent, ok := r.Header["User-Agent"]
+		h.stream = nil
+		h.transport = TransportPolling
+	}
 
-		if ok {
-			ag := strings.Join(agent, ";")
-			msie := strings.Index(ag, ";MSIE")
-			trident := strings.Index(ag, "Trident/")
+	return h.PollSession.Send(data)
+}
 
-			if msie != -1 || trident != -1 {
-				rw.Header().Set("X-XSS-Protection", "0")
+//pushTo sends the message over the stream, as an Envelope on the path to websockets
+func pushTo(st Session, path string, data []byte) error {
+	if con, ok := st.(*WSConn); ok {
+		return con.Push(path, data)
+	}
+	return st.Send(data)
+}
+
+//Send delivers the message as Push does on the DefaultPushPath
+func (h *HybridSession) Send(data []byte) error {
+	return h.Push(DefaultPushPath, data)
+}
+
+//Close ends the session and its open stream
+func (h *HybridSession) Close() {
+	h.slock.Lock()
+	st := h.stream
+	h.stream = nil
+	h.slock.Unlock()
+
+	if st != nil {
+		st.Close()
+	}
+
+	h.PollSession.Close()
+}
+
+//streaming returns true if the session has an open stream
+func (h *HybridSession) streaming() bool {
+	h.slock.Lock()
+	defer h.slock.Unlock()
+	return h.stream != nil
+}
+
+//attach switches the session to the stream, flushing queued messages into it under
+//the same lock so none are pushed to the queue after it is drained. Messages the
+//stream does not take are queued again and the session falls back to polling
+func (h *HybridSession) attach(transport string, st Session) {
+	h.slock.Lock()
+	old := h.stream
+	h.stream = st
+	h.transport = transport
+
+	queued := h.PollSession.drain()
+
+	for i, m := range queued {
+		if err := pushTo(st, DefaultPushPath, m); err != nil {
+			for _, rest := range queued[i:] {
+				h.PollSession.Send(rest)
 			}
+
+			h.stream = nil
+			h.transport = TransportPolling
+			break
 		}
+	}
+	h.slock.Unlock()
+
+	if old != nil && old != st {
+		old.Close()
+	}
+}
+
+//detach falls the session back to polling if the stream is still the active one
+func (h *HybridSession) detach(st Session) {
+	h.slock.Lock()
+	defer h.slock.Unlock()
+
+	if h.stream == st {
+		h.stream = nil
+		h.transport = TransportPolling
+	}
+
+	h.PollSession.Touch()
+}
 
-		origin, ok := r.Header["Origin"]
+//DefaultPushPath is the path websocket clients of a HybridService get the messages
+//sent to their session without a path on, such as those queued before they upgraded
+var DefaultPushPath = "message"
+
+//handshake represents the reply sent to a client starting a new session
+type handshake struct {
+	Session  string   `json:"session"`
+	Upgrades []string `json:"upgrades"`
+}
+
+//HybridService serves websocket, server-sent events, long-polling and jsonp clients
+//on a single listener. Each request is negotiated to the best transport the client
+//can use and clients keep their session id when upgrading between transports.
+//Route handlers see every client through the Session set on the packet
+type HybridService struct {
+	*HTTPService
+	ws          *WebSocketService
+	callback    string
+	PollTimeout time.Duration
+	IdleTimeout time.Duration
+	lock        sync.RWMutex
+	sessions    map[string]*HybridSession
+	closer      chan struct{}
+}
 
-		if ok {
-			rw.Header().Set("Access-Control-Allow-Credentials", "true")
-			rw.Header().Set("Access-Control-Allow-Origin", strings.Join(origin, ";"))
-		} else {
-			rw.Header().Set("Access-Control-Allow-Origin", "*")
+//Dial starts the session expiry routine and begins the service connection
+func (h *HybridService) Dial() error {
+	go h.expireSessions()
+	return h.Serve(h.ProcessPackets)
+}
+
+//Drop stops the expiry routine and closes all sessions
+func (h *HybridService) Drop() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	select {
+	case <-h.closer:
+		return
+	default:
+		close(h.closer)
+	}
+
+	for id, s := range h.sessions {
+		s.Close()
+		delete(h.sessions, id)
+	}
+}
+
+//ProcessPackets negotiates the transport for the request in the order websocket,
+//server-sent events, jsonp and long-polling. POST requests carry upstream messages
+//whatever the transport the client receives on
+func (h *HybridService) ProcessPackets(rw http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	id := q.Get("session")
+
+	if id == "" {
+		id = r.Header.Get("X-Poll-Session")
+	}
+
+	session, ok := h.Session(id)
+	cb := q.Get(h.callback)
+
+	switch {
+	case isWebSocketRequest(r):
+		if !ok {
+			session = h.NewSession()
+		}
+		h.serveWebSocket(rw, r, session)
+	case r.Method == "POST":
+		if !ok {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if bufferHTTPBody(rw, r) {
+			return
+		}
+		h.upstream(r, session, nil)
+		rw.WriteHeader(http.StatusAccepted)
+	case isEventSourceRequest(r):
+		if !ok {
+			session = h.NewSession()
+		}
+		h.serveEventSource(rw, r, session)
+	case cb != "":
+		if !ValidCallback(cb) {
+			rw.WriteHeader(http.StatusBadRequest)
+			rw.Write([]byte("invalid jsonp callback"))
+			return
+		}
+		h.serveJSONP(rw, r, session, ok, cb)
+	case r.Method == "GET":
+		if !ok {
+			h.greet(rw, h.NewSession(), "")
+			return
 		}
+		h.reply(rw, session, "", session.Collect(h.pollTimeout(), r.Context().Done()))
+	default:
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *HybridService) serveWebSocket(rw http.ResponseWriter, r *http.Request, s *HybridSession) {
+	u, err := webSocketUpgrade.Upgrade(rw, r, upgradeHeaders(r))
+
+	if err != nil {
+		h.Logger().Warn("websocket upgrade failed", arch.Fields{"session": s.ID(), "err": err})
+		return
+	}
+
+	con := h.ws.Accept(u, r, s.ID(), s)
+	s.attach(TransportWebSocket, con)
+
+	con.Push("session", []byte(fmt.Sprintf("%q", s.ID())))
+
+	go func() {
+		<-con.Closed()
+		s.detach(con)
+	}()
+}
+
+func (h *HybridService) serveEventSource(rw http.ResponseWriter, r *http.Request, s *HybridSession) {
+	flusher, ok := rw.(http.Flusher)
+
+	if !ok {
+		rw.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.Header().Set("X-Poll-Session", s.ID())
+	rw.WriteHeader(http.StatusOK)
+
+	fmt.Fprintf(rw, "event: session\ndata: %s\n\n", s.ID())
+	flusher.Flush()
 
-		u, err := webSocketUpgrade.Upgrade(rw, r, nil)
+	st := newEventStream(s.ID(), DefaultQueueSize)
+	s.attach(TransportEventSource, st)
 
-		if err != nil {
-			log.Println(err)
+	ticker := time.NewTicker(h.pollTimeout())
+
+	defer func() {
+		ticker.Stop()
+		st.Close()
+		s.detach(st)
+	}()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-st.closer:
 			return
+		case <-ticker.C:
+			fmt.Fprint(rw, ": ping\n\n")
+			flusher.Flush()
+		case m := <-st.send:
+			for _, line := range bytes.Split(m, []byte("\n")) {
+				fmt.Fprintf(rw, "data: %s\n", line)
+			}
+			fmt.Fprint(rw, "\n")
+			flusher.Flush()
 		}
+	}
+}
+
+func (h *HybridService) serveJSONP(rw http.ResponseWriter, r *http.Request, s *HybridSession, known bool, cb string) {
+	if !known {
+		h.greet(rw, h.NewSession(), cb)
+		return
+	}
+
+	//jsonp can not post so upstream messages come in the 'message' query
+	if msg := r.URL.Query().Get("message"); msg != "" {
+		h.upstream(r, s, []byte(msg))
+		h.reply(rw, s, cb, nil)
+		return
+	}
+
+	h.reply(rw, s, cb, s.Collect(h.pollTimeout(), r.Context().Done()))
+}
+
+//upstream issues a client message into the service routes, replies are pushed to
+//the session on the path of the message
+func (h *HybridService) upstream(r *http.Request, s *HybridSession, msg []byte) {
+	s.Touch()
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+
+	h.Route.IssueRequestPath(r.URL.Path, func(pack *grids.GridPacket) {
+		pack.Set("Req", r)
+		pack.Set("Session", s)
+		pack.Set("Trace", trace.Extract(r.Header))
+		pack.Set("Reply", pushReply(s, path))
+
+		if msg == nil {
+			CollectHTTPBody(r, pack, h.Logger())
+			return
+		}
+
+		pack.Set("Type", "json")
+		pack.Set("JSON", true)
+		pack.Set("Data", true)
+		pack.Set("Body", msg)
+	})
+}
+
+//greet writes the handshake for a new session, wrapped in the callback for jsonp clients
+func (h *HybridService) greet(rw http.ResponseWriter, s *HybridSession, cb string) {
+	bin, err := json.Marshal(&handshake{s.ID(), h.Upgrades()})
+
+	if err != nil {
+		h.Logger().Error("unable to encode session handshake", arch.Fields{"session": s.ID(), "err": err})
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	h.write(rw, s, cb, bin)
+}
+
+//reply writes the poll reply, wrapped in the callback for jsonp clients
+func (h *HybridService) reply(rw http.ResponseWriter, s *HybridSession, cb string, msgs [][]byte) {
+	rp := &pollReply{s.ID(), make([]json.RawMessage, 0, len(msgs))}
+
+	for _, m := range msgs {
+		rp.Messages = append(rp.Messages, rawMessage(m))
+	}
+
+	bin, err := json.Marshal(rp)
 
-		w.Route.IssueRequestPath(r.URL.Path, func(pack *grids.GridPacket) {
-			pack.Set("Ws", u)
-			pack.Set("Req", r)
-			pack.Set("Res", rw)
-			CollectHTTPBody(r, pack)
-		})
+	if err != nil {
+		h.Logger().Error("unable to encode poll reply", arch.Fields{"session": s.ID(), "err": err})
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
 	}
+
+	h.write(rw, s, cb, bin)
+}
+
+func (h *HybridService) write(rw http.ResponseWriter, s *HybridSession, cb string, bin []byte) {
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.Header().Set("X-Poll-Session", s.ID())
+
+	if cb == "" {
+		rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+		rw.WriteHeader(http.StatusOK)
+		rw.Write(bin)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/javascript; charset=utf-8")
+	rw.Header().Set("X-Content-Type-Options", "nosniff")
+	rw.WriteHeader(http.StatusOK)
+	rw.Write([]byte("/**/" + cb + "("))
+	rw.Write(bin)
+	rw.Write([]byte(");"))
+}
+
+//Upgrades returns the transports a client can upgrade to in order of preference
+func (h *HybridService) Upgrades() []string {
+	return []string{TransportWebSocket, TransportEventSource, TransportPolling, TransportJSONP}
+}
+
+//NewSession creates and adds a new session to the service
+func (h *HybridService) NewSession() *HybridSession {
+	s := &HybridSession{
+		PollSession: NewPollSession(uuid.New()),
+		transport:   TransportPolling,
+	}
+
+	h.lock.Lock()
+	h.sessions[s.ID()] = s
+	h.lock.Unlock()
+
+	return s
 }
 
-//NewJSONPService returns a new jsonp based service struct
-func NewJSONPService(service, addr string, port int, master arch.Linkage, callbackName sring) {
-	hs := NewHTTPService(service, addr, port, master)
-	var cb string
+//Session returns the session with the given id
+func (h *HybridService) Session(id string) (*HybridSession, bool) {
+	if id == "" {
+		return nil, false
+	}
+
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	s, ok := h.sessions[id]
+	return s, ok
+}
+
+//Sessions returns the total number of live sessions
+func (h *HybridService) Sessions() int {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return len(h.sessions)
+}
+
+//Push sends a message on the given path to the client with the session id over
+//whatever transport it is on, only websocket clients get the path
+func (h *HybridService) Push(id, path string, data []byte) error {
+	s, ok := h.Session(id)
+
+	if !ok {
+		return ErrSessionNotFound
+	}
+
+	return s.Push(path, data)
+}
+
+//pollTimeout returns the PollTimeout of the service or DefaultPollTimeout if it is
+//not above zero
+func (h *HybridService) pollTimeout() time.Duration {
+	if h.PollTimeout <= 0 {
+		return DefaultPollTimeout
+	}
+	return h.PollTimeout
+}
+
+//idleTimeout returns the IdleTimeout of the service or DefaultIdleTimeout if it is
+//not above zero
+func (h *HybridService) idleTimeout() time.Duration {
+	if h.IdleTimeout <= 0 {
+		return DefaultIdleTimeout
+	}
+	return h.IdleTimeout
+}
+
+//expireSessions runs until the service is dropped closing sessions without an open
+//stream that have been idle past the IdleTimeout
+func (h *HybridService) expireSessions() {
+	idle := h.idleTimeout()
+	tick := idle / 2
+
+	if tick <= 0 {
+		tick = idle
+	}
+
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.closer:
+			return
+		case <-ticker.C:
+			h.lock.Lock()
+			for id, s := range h.sessions {
+				if s.streaming() {
+					s.Touch()
+					continue
+				}
+
+				if s.Idle() > idle {
+					s.Close()
+					delete(h.sessions, id)
+				}
+			}
+			h.lock.Unlock()
+		}
+	}
+}
+
+//NewHybridService returns a new hybrid service struct, callbackName is the query
+//parameter jsonp clients use to name their callback and defaults to 'callback'
+func NewHybridService(service, addr string, port int, master arch.Linkage, callbackName string, opts ...arch.ServiceOption) *HybridService {
+	hs := NewHTTPService(service, addr, port, master, opts...)
 
 	if callbackName == "" {
-		cb = "Callback"
-	} else {
-		cb = callbackName
+		callbackName = "callback"
 	}
 
-	return JSONPService{
-		hs,
-		cb,
+	return &HybridService{
+		HTTPService: hs,
+		ws: &WebSocketService{
+			HTTPService: hs,
+			PongWait:    DefaultPongWait,
+			QueueSize:   DefaultQueueSize,
+			conns:       make(map[string]*WSConn),
+		},
+		callback:    callbackName,
+		PollTimeout: DefaultPollTimeout,
+		IdleTimeout: DefaultIdleTimeout,
+		sessions:    make(map[string]*HybridSession),
+		closer:      make(chan struct{}),
 	}
 }
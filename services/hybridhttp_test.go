@@ -0,0 +1,218 @@
+package services
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/franela/goblin"
+	"github.com/gorilla/websocket"
+	"github.com/influx6/composelab/arch"
+	"github.com/influx6/composelab/routes"
+	"github.com/influx6/grids"
+)
+
+func TestHybridService(t *testing.T) {
+	g := goblin.Goblin(t)
+
+	hs := NewHybridService("hub", "127.0.0.1", 3340, nil, "")
+	hs.PollTimeout = 50 * time.Millisecond
+	defer hs.Drop()
+
+	hs.Branch("say")
+	say, _ := hs.Select("say")
+	say.Terminal().Only(routes.ByPackets(func(p *grids.GridPacket) {
+		body, _ := p.Get("Body").([]byte)
+		arch.Reply(p, 200, body)
+	}))
+
+	srv := httptest.NewServer(http.HandlerFunc(hs.ProcessPackets))
+	defer srv.Close()
+
+	do := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(`{"said":1}`))
+		req.Header.Set("Content-Type", "application/json")
+
+		rw := httptest.NewRecorder()
+		hs.ProcessPackets(rw, req)
+		return rw
+	}
+
+	g.Describe("HybridService", func() {
+
+		g.It("can new clients get a session and its upgrades", func() {
+			rw := do("GET", "/hub")
+
+			shake := new(handshake)
+			json.Unmarshal(rw.Body.Bytes(), shake)
+
+			g.Assert(shake.Session != "").IsTrue("a session was started")
+			g.Assert(rw.Header().Get("X-Poll-Session")).Eql(shake.Session)
+			g.Assert(shake.Upgrades).Eql([]string{TransportWebSocket, TransportEventSource, TransportPolling, TransportJSONP})
+
+			g.Assert(do("POST", "/hub/say?session=none").Code).Eql(404)
+			g.Assert(do("PUT", "/hub?session="+shake.Session).Code).Eql(405)
+		})
+
+		g.It("can polling clients collect pushes and replies", func() {
+			s := hs.NewSession()
+			g.Assert(hs.Push(s.ID(), "news", []byte(`"hot"`)) == nil).IsTrue("message was queued")
+			g.Assert(hs.Push("none", "news", nil)).Eql(ErrSessionNotFound)
+			g.Assert(do("POST", "/hub/say?session="+s.ID()).Code).Eql(202)
+
+			time.Sleep(20 * time.Millisecond)
+
+			rw := do("GET", "/hub?session="+s.ID())
+			g.Assert(rw.Body.String()).Eql(`{"session":"` + s.ID() + `","messages":["hot",{"said":1}]}`)
+			g.Assert(s.Transport()).Eql(TransportPolling)
+		})
+
+		g.It("can jsonp clients get wrapped sessions and send in the query", func() {
+			rw := do("GET", "/hub?callback=cb")
+			g.Assert(strings.HasPrefix(rw.Body.String(), `/**/cb({"session":`)).IsTrue(rw.Body.String())
+
+			g.Assert(do("GET", "/hub?callback=alert(1)").Code).Eql(400)
+
+			s := hs.NewSession()
+			rw = do("GET", "/hub/say?callback=cb&session="+s.ID()+"&message=%22hi%22")
+			g.Assert(rw.Body.String()).Eql(`/**/cb({"session":"` + s.ID() + `","messages":[]});`)
+
+			time.Sleep(20 * time.Millisecond)
+
+			rw = do("GET", "/hub?callback=cb&session="+s.ID())
+			g.Assert(rw.Body.String()).Eql(`/**/cb({"session":"` + s.ID() + `","messages":["hi"]});`)
+		})
+
+		g.It("can event source clients be streamed to", func() {
+			s := hs.NewSession()
+
+			req, _ := http.NewRequest("GET", srv.URL+"/hub?session="+s.ID(), nil)
+			req.Header.Set("Accept", "text/event-stream")
+
+			res, err := http.DefaultClient.Do(req)
+			g.Assert(err == nil).IsTrue("stream was opened")
+			defer res.Body.Close()
+
+			lines := bufio.NewReader(res.Body)
+			line, _ := lines.ReadString('\n')
+			g.Assert(line).Eql("event: session\n")
+			line, _ = lines.ReadString('\n')
+			g.Assert(line).Eql("data: " + s.ID() + "\n")
+			lines.ReadString('\n')
+
+			g.Assert(s.Transport()).Eql(TransportEventSource)
+			hs.Push(s.ID(), "news", []byte(`"hot"`))
+
+			//pings are sent every poll timeout till the message arrives
+			for {
+				line, _ = lines.ReadString('\n')
+				if strings.HasPrefix(line, "data: ") {
+					break
+				}
+			}
+
+			g.Assert(line).Eql("data: \"hot\"\n")
+		})
+
+		g.It("can websocket clients tell pushes and replies by their path", func() {
+			s := hs.NewSession()
+			s.Send([]byte(`"queued"`))
+
+			c, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/hub?session="+s.ID(), nil)
+			g.Assert(err == nil).IsTrue("client connected")
+			defer c.Close()
+
+			env, _ := readEnvelope(c)
+			g.Assert(env.Path).Eql(DefaultPushPath)
+			g.Assert(string(env.Data)).Eql(`"queued"`)
+
+			env, _ = readEnvelope(c)
+			g.Assert(env.Path).Eql("session")
+			g.Assert(string(env.Data)).Eql(`"` + s.ID() + `"`)
+			g.Assert(s.Transport()).Eql(TransportWebSocket)
+
+			hs.Push(s.ID(), "news", []byte(`"hot"`))
+
+			env, _ = readEnvelope(c)
+			g.Assert(env.Path).Eql("news")
+			g.Assert(string(env.Data)).Eql(`"hot"`)
+
+			g.Assert(do("POST", "/hub/say?session="+s.ID()).Code).Eql(202)
+
+			env, _ = readEnvelope(c)
+			g.Assert(env.Path).Eql("hub/say")
+			g.Assert(string(env.Data)).Eql(`{"said":1}`)
+
+			c.WriteJSON(&Envelope{Path: "hub/say", UUID: "w1", Data: json.RawMessage(`"up"`)})
+
+			env, _ = readEnvelope(c)
+			g.Assert(env.UUID).Eql("w1")
+			g.Assert(env.Status).Eql(200)
+		})
+
+		g.It("can pushes racing a stream attaching not be left queued", func() {
+			for run := 0; run < 200; run++ {
+				s := hs.NewSession()
+				st := newEventStream(s.ID(), 400)
+				start := make(chan struct{})
+
+				var wg sync.WaitGroup
+
+				for p := 0; p < 4; p++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						<-start
+						for i := 0; i < 100; i++ {
+							s.Send([]byte("hello"))
+						}
+					}()
+				}
+
+				close(start)
+				s.attach(TransportEventSource, st)
+				wg.Wait()
+
+				g.Assert(len(s.drain())).Eql(0)
+				g.Assert(len(st.send)).Eql(400)
+			}
+		})
+
+		g.It("can messages a stream does not take be queued again", func() {
+			s := hs.NewSession()
+			s.Send([]byte("one"))
+			s.Send([]byte("two"))
+			s.Send([]byte("three"))
+
+			st := newEventStream(s.ID(), 1)
+			s.attach(TransportEventSource, st)
+
+			g.Assert(string(<-st.send)).Eql("one")
+			g.Assert(s.Transport()).Eql(TransportPolling)
+
+			queued := s.drain()
+			g.Assert(len(queued)).Eql(2)
+			g.Assert(string(queued[0])).Eql("two")
+		})
+
+		g.It("can sessions expire with timeouts too small to tick on", func() {
+			for _, idle := range []time.Duration{0, -time.Second, time.Nanosecond} {
+				other := NewHybridService("idle", "127.0.0.1", 3341, nil, "")
+				other.IdleTimeout = idle
+				other.PollTimeout = idle
+				other.NewSession()
+
+				g.Assert(other.pollTimeout() > 0).IsTrue()
+
+				go other.expireSessions()
+				time.Sleep(5 * time.Millisecond)
+				other.Drop()
+			}
+		})
+	})
+}
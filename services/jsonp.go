@@ -0,0 +1,105 @@
+package services
+
+import (
+	"net/http"
+	"regexp"
+
+	"github.com/influx6/composelab/arch"
+	"github.com/influx6/composelab/trace"
+	"github.com/influx6/grids"
+)
+
+//callbackPattern matches safe javascript identifiers and dotted member paths such
+//as 'done' or 'app.handlers.done'
+var callbackPattern = regexp.MustCompile(`^[a-zA-Z_$][0-9a-zA-Z_$]*(\.[a-zA-Z_$][0-9a-zA-Z_$]*)*$`)
+
+//ValidCallback returns true if the name is a safe jsonp callback name
+func ValidCallback(name string) bool {
+	return len(name) <= 128 && callbackPattern.MatchString(name)
+}
+
+//JSONPService represents a service handling the jsonp protocol, route handlers write
+//their responses as usual and the service wraps them in a call to the callback
+//named in the request query
+type JSONPService struct {
+	*HTTPService
+	callback string
+}
+
+//Dial beings the service connection
+func (j *JSONPService) Dial() error {
+	return j.Serve(j.ProcessPackets)
+}
+
+//ProcessPackets for JSONPService handles checking and validating a request as a
+//valid jsonp request before process it for use
+func (j *JSONPService) ProcessPackets(rw http.ResponseWriter, r *http.Request) {
+	cb := r.URL.Query().Get(j.callback)
+
+	if !ValidCallback(cb) {
+		rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write([]byte("invalid jsonp callback"))
+		return
+	}
+
+	buf := newBufferedResponse()
+
+	var id string
+
+	if !bufferHTTPBody(buf, r) {
+		res := NewResponse(buf)
+		dl := j.NewDeadline(r.Context())
+
+		j.Route.IssueRequestPath(r.URL.Path, func(pack *grids.GridPacket) {
+			pack.Set("Req", r)
+			id = arch.RequestID(pack)
+			pack.Set("Res", res)
+			pack.Set("Trace", trace.Extract(r.Header))
+			pack.Set("Deadline", dl)
+			pack.Set("Context", dl.Context())
+			pack.Set("Reply", replyResponse(res))
+			pack.Set("OnHalt", haltResponse(res, id))
+			pack.Set("Callback", cb)
+			CollectHTTPBody(r, pack, j.Logger())
+		})
+
+		j.awaitResponse(res, dl, r, id)
+	}
+
+	if r.Context().Err() != nil {
+		return
+	}
+
+	body := rawMessage(buf.body.Bytes())
+
+	if buf.status >= 400 {
+		body = errorReply(buf.status, buf.body.Bytes(), id)
+	}
+
+	//jsonp responses must always load so the callback can see errors
+	rw.Header().Set("Content-Type", "application/javascript; charset=utf-8")
+	rw.Header().Set("X-Content-Type-Options", "nosniff")
+	rw.WriteHeader(http.StatusOK)
+	rw.Write([]byte("/**/" + cb + "("))
+	rw.Write(body)
+	rw.Write([]byte(");"))
+}
+
+//NewJSONPService returns a new jsonp based service struct, callbackName is the
+//query parameter holding the callback name and defaults to 'callback'
+func NewJSONPService(service, addr string, port int, master arch.Linkage, callbackName string, opts ...arch.ServiceOption) *JSONPService {
+	hs := NewHTTPService(service, addr, port, master, opts...)
+	var cb string
+
+	if callbackName == "" {
+		cb = "callback"
+	} else {
+		cb = callbackName
+	}
+
+	return &JSONPService{
+		hs,
+		cb,
+	}
+}
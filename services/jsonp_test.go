@@ -0,0 +1,111 @@
+package services
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/franela/goblin"
+	"github.com/influx6/composelab/arch"
+	"github.com/influx6/composelab/routes"
+	"github.com/influx6/grids"
+)
+
+func TestJSONPService(t *testing.T) {
+	g := goblin.Goblin(t)
+
+	js := NewJSONPService("api", "127.0.0.1", 3310, nil, "")
+	js.Branch("echo")
+	js.Branch("text")
+	js.Branch("fail")
+	js.Branch("legacy")
+
+	echo, _ := js.Select("echo")
+	echo.Terminal().Only(routes.ByPackets(func(p *grids.GridPacket) {
+		arch.Reply(p, 200, []byte(`{"n":1}`))
+	}))
+
+	text, _ := js.Select("text")
+	text.Terminal().Only(routes.ByPackets(func(p *grids.GridPacket) {
+		arch.Reply(p, 200, []byte(`say "hi"`))
+	}))
+
+	fail, _ := js.Select("fail")
+	fail.Terminal().Only(routes.ByPackets(func(p *grids.GridPacket) {
+		arch.ReplyError(p, arch.NewError(409, "taken"))
+	}))
+
+	legacy, _ := js.Select("legacy")
+	legacy.Terminal().Only(routes.ByPackets(func(p *grids.GridPacket) {
+		res, _ := p.Get("Res").(*Response)
+		res.WriteHeader(200)
+		res.Write([]byte(`[1,2]`))
+	}))
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		js.ProcessPackets(rw, httptest.NewRequest("GET", path, nil))
+		return rw
+	}
+
+	g.Describe("JSONPService", func() {
+
+		g.It("can callback names be validated", func() {
+			for _, name := range []string{"done", "app.handlers.done", "$cb_1", "_"} {
+				g.Assert(ValidCallback(name)).IsTrue(name)
+			}
+
+			for _, name := range []string{"", "alert(1)", "a..b", "1cb", "a.", "cb;x", strings.Repeat("a", 129)} {
+				g.Assert(ValidCallback(name)).IsFalse(name)
+			}
+		})
+
+		g.It("can requests with invalid callbacks be refused", func() {
+			rw := get("/api/echo?callback=alert(1)")
+			g.Assert(rw.Code).Eql(400)
+
+			rw = get("/api/echo")
+			g.Assert(rw.Code).Eql(400)
+		})
+
+		g.It("can replies be wrapped in the callback", func() {
+			rw := get("/api/echo?callback=app.done")
+			g.Assert(rw.Code).Eql(200)
+			g.Assert(rw.Header().Get("Content-Type")).Eql("application/javascript; charset=utf-8")
+			g.Assert(rw.Header().Get("X-Content-Type-Options")).Eql("nosniff")
+			g.Assert(rw.Body.String()).Eql(`/**/app.done({"n":1});`)
+
+			rw = get("/api/text?callback=cb")
+			g.Assert(rw.Body.String()).Eql(`/**/cb("say \"hi\"");`)
+		})
+
+		g.It("can errors reach the callback with a loading response", func() {
+			rw := get("/api/fail?callback=cb")
+			g.Assert(rw.Code).Eql(200)
+
+			body := strings.TrimSuffix(strings.TrimPrefix(rw.Body.String(), "/**/cb("), ");")
+			e, ok := arch.ParseError([]byte(body))
+			g.Assert(ok).IsTrue(rw.Body.String())
+			g.Assert(e.Code).Eql(409)
+			g.Assert(e.Message).Eql("taken")
+		})
+
+		g.It("can handlers which never end their response be wrapped", func() {
+			rw := get("/api/legacy?callback=cb")
+			g.Assert(rw.Body.String()).Eql(`/**/cb([1,2]);`)
+		})
+
+		g.It("can the callback query be named", func() {
+			named := NewJSONPService("api", "127.0.0.1", 3311, nil, "jsonp")
+			named.Branch("echo")
+			ne, _ := named.Select("echo")
+			ne.Terminal().Only(routes.ByPackets(func(p *grids.GridPacket) {
+				arch.Reply(p, 200, []byte(`true`))
+			}))
+
+			rw := httptest.NewRecorder()
+			named.ProcessPackets(rw, httptest.NewRequest("GET", "/api/echo?jsonp=ok", nil))
+			g.Assert(rw.Body.String()).Eql(`/**/ok(true);`)
+		})
+	})
+}
@@ -0,0 +1,386 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/influx6/composelab/arch"
+	"github.com/influx6/composelab/trace"
+	"github.com/influx6/grids"
+)
+
+//ErrSessionClosed is returned when sending to a session that has expired or been closed
+var ErrSessionClosed = errors.New("session closed")
+
+//ErrSessionNotFound is returned when a session id has no matching session
+var ErrSessionNotFound = errors.New("session not found")
+
+//DefaultPollTimeout is the time a poll request is held open waiting for messages
+var DefaultPollTimeout = 25 * time.Second
+
+//DefaultIdleTimeout is the time a session can go without a request before it expires
+var DefaultIdleTimeout = 60 * time.Second
+
+//PollSession represents a single long-polling client, it holds the messages pushed
+//to the client until its next poll request collects them
+type PollSession struct {
+	id       string
+	lock     sync.Mutex
+	queue    [][]byte
+	notify   chan struct{}
+	lastSeen time.Time
+	polls    int
+	closed   bool
+}
+
+//NewPollSession returns a new session with the given id
+func NewPollSession(id string) *PollSession {
+	return &PollSession{
+		id:       id,
+		notify:   make(chan struct{}, 1),
+		lastSeen: time.Now(),
+	}
+}
+
+//ID returns the id of the session
+func (p *PollSession) ID() string {
+	return p.id
+}
+
+//Send queues a message for the session's client
+func (p *PollSession) Send(data []byte) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.closed {
+		return ErrSessionClosed
+	}
+
+	p.queue = append(p.queue, data)
+	p.wake()
+	return nil
+}
+
+//Collect returns the queued messages, waiting up to the given duration for messages
+//to arrive if none are queued or until the cancel chan is closed. The session is not
+//idle while it collects
+func (p *PollSession) Collect(wait time.Duration, cancel <-chan struct{}) [][]byte {
+	p.lock.Lock()
+	p.polls++
+	p.lastSeen = time.Now()
+	p.lock.Unlock()
+
+	defer func() {
+		p.lock.Lock()
+		p.polls--
+		p.lastSeen = time.Now()
+		p.lock.Unlock()
+	}()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for {
+		p.lock.Lock()
+		if len(p.queue) > 0 || p.closed {
+			msgs := p.queue
+			p.queue = nil
+			p.lock.Unlock()
+			return msgs
+		}
+		p.lock.Unlock()
+
+		select {
+		case <-p.notify:
+		case <-timer.C:
+			return nil
+		case <-cancel:
+			return nil
+		}
+	}
+}
+
+//drain returns and clears the queued messages without waiting
+func (p *PollSession) drain() [][]byte {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	msgs := p.queue
+	p.queue = nil
+	return msgs
+}
+
+//Touch marks the session as active
+func (p *PollSession) Touch() {
+	p.lock.Lock()
+	p.lastSeen = time.Now()
+	p.lock.Unlock()
+}
+
+//Idle returns the time since the session was last active, sessions with a poll in
+//progress are never idle
+func (p *PollSession) Idle() time.Duration {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.polls > 0 {
+		return 0
+	}
+
+	return time.Since(p.lastSeen)
+}
+
+//Closed returns true if the session has been closed
+func (p *PollSession) Closed() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.closed
+}
+
+//Close ends the session and releases any waiting poll request
+func (p *PollSession) Close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.closed {
+		return
+	}
+
+	p.closed = true
+	p.wake()
+}
+
+func (p *PollSession) wake() {
+	select {
+	case p.notify <- struct{}{}:
+	default:
+	}
+}
+
+//pollReply represents the json reply sent for every poll request
+type pollReply struct {
+	Session  string            `json:"session"`
+	Messages []json.RawMessage `json:"messages"`
+}
+
+//rawMessage returns the data as a json value, data that are not valid json are
+//sent as a json string
+func rawMessage(data []byte) json.RawMessage {
+	if json.Valid(data) {
+		return json.RawMessage(data)
+	}
+
+	bin, _ := json.Marshal(string(data))
+	return json.RawMessage(bin)
+}
+
+//PollService represents a service handling the http-long polling protocol. Clients
+//poll with GET requests carrying their session id in the 'session' query or the
+//X-Poll-Session header, a request without a known session starts a new one.
+//POST requests carry upstream messages into the service routes with the session
+//set as the 'Session' meta of the packet
+type PollService struct {
+	*HTTPService
+	PollTimeout time.Duration
+	IdleTimeout time.Duration
+	lock        sync.RWMutex
+	sessions    map[string]*PollSession
+	closer      chan struct{}
+}
+
+//Dial starts the session expiry routine and begins the service connection
+func (p *PollService) Dial() error {
+	go p.expireSessions()
+	return p.Serve(p.ProcessPackets)
+}
+
+//Drop stops the expiry routine and closes all sessions
+func (p *PollService) Drop() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	select {
+	case <-p.closer:
+		return
+	default:
+		close(p.closer)
+	}
+
+	for id, s := range p.sessions {
+		s.Close()
+		delete(p.sessions, id)
+	}
+}
+
+//ProcessPackets handles the poll and upstream requests of the long-polling protocol
+func (p *PollService) ProcessPackets(rw http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("session")
+
+	if id == "" {
+		id = r.Header.Get("X-Poll-Session")
+	}
+
+	session, ok := p.Session(id)
+
+	switch r.Method {
+	case "GET":
+		if !ok {
+			session = p.NewSession()
+			p.reply(rw, session, nil)
+			return
+		}
+
+		msgs := session.Collect(p.pollTimeout(), r.Context().Done())
+		p.reply(rw, session, msgs)
+	case "POST":
+		if !ok {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if bufferHTTPBody(rw, r) {
+			return
+		}
+
+		session.Touch()
+
+		p.Route.IssueRequestPath(r.URL.Path, func(pack *grids.GridPacket) {
+			pack.Set("Req", r)
+			pack.Set("Session", session)
+			pack.Set("Trace", trace.Extract(r.Header))
+			pack.Set("Reply", sessionReply(session))
+			CollectHTTPBody(r, pack, p.Logger())
+		})
+
+		rw.WriteHeader(http.StatusAccepted)
+	default:
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (p *PollService) reply(rw http.ResponseWriter, s *PollSession, msgs [][]byte) {
+	rp := &pollReply{s.ID(), make([]json.RawMessage, 0, len(msgs))}
+
+	for _, m := range msgs {
+		rp.Messages = append(rp.Messages, rawMessage(m))
+	}
+
+	bin, err := json.Marshal(rp)
+
+	if err != nil {
+		p.Logger().Error("unable to encode poll reply", arch.Fields{"session": s.ID(), "err": err})
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.Header().Set("X-Poll-Session", s.ID())
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(bin)
+}
+
+//NewSession creates and adds a new session to the service
+func (p *PollService) NewSession() *PollSession {
+	s := NewPollSession(uuid.New())
+
+	p.lock.Lock()
+	p.sessions[s.ID()] = s
+	p.lock.Unlock()
+
+	return s
+}
+
+//Session returns the session with the given id
+func (p *PollService) Session(id string) (*PollSession, bool) {
+	if id == "" {
+		return nil, false
+	}
+
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	s, ok := p.sessions[id]
+	return s, ok
+}
+
+//Sessions returns the total number of live sessions
+func (p *PollService) Sessions() int {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return len(p.sessions)
+}
+
+//Push queues a message for the client with the given session id
+func (p *PollService) Push(id string, data []byte) error {
+	s, ok := p.Session(id)
+
+	if !ok {
+		return ErrSessionNotFound
+	}
+
+	return s.Send(data)
+}
+
+//pollTimeout returns the PollTimeout of the service or DefaultPollTimeout if it is
+//not above zero
+func (p *PollService) pollTimeout() time.Duration {
+	if p.PollTimeout <= 0 {
+		return DefaultPollTimeout
+	}
+	return p.PollTimeout
+}
+
+//idleTimeout returns the IdleTimeout of the service or DefaultIdleTimeout if it is
+//not above zero
+func (p *PollService) idleTimeout() time.Duration {
+	if p.IdleTimeout <= 0 {
+		return DefaultIdleTimeout
+	}
+	return p.IdleTimeout
+}
+
+//expireSessions runs until the service is dropped closing sessions that have
+//been idle past the IdleTimeout
+func (p *PollService) expireSessions() {
+	idle := p.idleTimeout()
+	tick := idle / 2
+
+	if tick <= 0 {
+		tick = idle
+	}
+
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.closer:
+			return
+		case <-ticker.C:
+			p.lock.Lock()
+			for id, s := range p.sessions {
+				if s.Idle() > idle {
+					s.Close()
+					delete(p.sessions, id)
+				}
+			}
+			p.lock.Unlock()
+		}
+	}
+}
+
+//NewPollService returns a new long-polling service struct
+func NewPollService(service, addr string, port int, master arch.Linkage, opts ...arch.ServiceOption) *PollService {
+	return &PollService{
+		HTTPService: NewHTTPService(service, addr, port, master, opts...),
+		PollTimeout: DefaultPollTimeout,
+		IdleTimeout: DefaultIdleTimeout,
+		sessions:    make(map[string]*PollSession),
+		closer:      make(chan struct{}),
+	}
+}
@@ -0,0 +1,123 @@
+package services
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/franela/goblin"
+	"github.com/influx6/composelab/arch"
+	"github.com/influx6/composelab/routes"
+	"github.com/influx6/grids"
+)
+
+func TestPollService(t *testing.T) {
+	g := goblin.Goblin(t)
+
+	g.Describe("PollService", func() {
+
+		g.It("can messages be queued for a session and collected", func() {
+			ps := NewPollService("feed", "127.0.0.1", 3300, nil)
+			ps.PollTimeout = 50 * time.Millisecond
+
+			rw := httptest.NewRecorder()
+			ps.ProcessPackets(rw, httptest.NewRequest("GET", "/feed", nil))
+
+			id := rw.Header().Get("X-Poll-Session")
+			g.Assert(id != "").IsTrue("a session was started")
+			g.Assert(ps.Sessions()).Eql(1)
+
+			g.Assert(ps.Push(id, []byte(`{"n":1}`)) == nil).IsTrue("json was queued")
+			g.Assert(ps.Push(id, []byte("two")) == nil).IsTrue("text was queued")
+			g.Assert(ps.Push("none", nil)).Eql(ErrSessionNotFound)
+
+			rw = httptest.NewRecorder()
+			ps.ProcessPackets(rw, httptest.NewRequest("GET", "/feed?session="+id, nil))
+			g.Assert(rw.Body.String()).Eql(`{"session":"` + id + `","messages":[{"n":1},"two"]}`)
+
+			start := time.Now()
+			rw = httptest.NewRecorder()
+			ps.ProcessPackets(rw, httptest.NewRequest("GET", "/feed?session="+id, nil))
+			g.Assert(time.Since(start) >= ps.PollTimeout).IsTrue("empty polls are held open")
+			g.Assert(rw.Body.String()).Eql(`{"session":"` + id + `","messages":[]}`)
+		})
+
+		g.It("can upstream messages reach the routes with their session", func(done goblin.Done) {
+			ps := NewPollService("chat", "127.0.0.1", 3301, nil)
+			session := ps.NewSession()
+
+			ps.Branch("say")
+			say, _ := ps.Select("say")
+			say.Terminal().Only(routes.ByPackets(func(p *grids.GridPacket) {
+				s, _ := p.Get("Session").(*PollSession)
+				g.Assert(s == session).IsTrue("the packet carries its session")
+
+				arch.Reply(p, 200, []byte(`"heard"`))
+				g.Assert(len(session.drain())).Eql(1)
+				done()
+			}))
+
+			rw := httptest.NewRecorder()
+			req := httptest.NewRequest("POST", "/chat/say", strings.NewReader("hello"))
+			req.Header.Set("X-Poll-Session", session.ID())
+			ps.ProcessPackets(rw, req)
+			g.Assert(rw.Code).Eql(202)
+
+			rw = httptest.NewRecorder()
+			ps.ProcessPackets(rw, httptest.NewRequest("POST", "/chat/say?session=none", nil))
+			g.Assert(rw.Code).Eql(404)
+		})
+
+		g.It("can idle sessions expire", func() {
+			ps := NewPollService("idle", "127.0.0.1", 3302, nil)
+			ps.IdleTimeout = 20 * time.Millisecond
+			defer ps.Drop()
+
+			stale := ps.NewSession()
+			go ps.expireSessions()
+
+			time.Sleep(80 * time.Millisecond)
+			g.Assert(ps.Sessions()).Eql(0)
+			g.Assert(stale.Closed()).IsTrue("expired sessions are closed")
+			g.Assert(stale.Send(nil)).Eql(ErrSessionClosed)
+		})
+
+		g.It("can sessions with a poll held past the idle timeout not expire", func() {
+			ps := NewPollService("held", "127.0.0.1", 3304, nil)
+			ps.IdleTimeout = 20 * time.Millisecond
+			ps.PollTimeout = 100 * time.Millisecond
+			defer ps.Drop()
+
+			polling := ps.NewSession()
+			go ps.expireSessions()
+
+			rw := httptest.NewRecorder()
+			ps.ProcessPackets(rw, httptest.NewRequest("GET", "/held?session="+polling.ID(), nil))
+
+			g.Assert(polling.Closed()).IsFalse("the session was kept while polled")
+			g.Assert(ps.Sessions()).Eql(1)
+		})
+
+		g.It("can poll timeouts not above zero fall back to the default", func() {
+			ps := NewPollService("zero", "127.0.0.1", 3305, nil)
+
+			for _, wait := range []time.Duration{0, -time.Second} {
+				ps.PollTimeout = wait
+				g.Assert(ps.pollTimeout()).Eql(DefaultPollTimeout)
+			}
+		})
+
+		g.It("can sessions expire with idle timeouts too small to tick on", func() {
+			for _, idle := range []time.Duration{0, -time.Second, time.Nanosecond} {
+				ps := NewPollService("idle", "127.0.0.1", 3303, nil)
+				ps.IdleTimeout = idle
+				ps.NewSession()
+
+				go ps.expireSessions()
+				time.Sleep(5 * time.Millisecond)
+				ps.Drop()
+			}
+		})
+	})
+}
@@ -0,0 +1,281 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/influx6/composelab/arch"
+	"github.com/influx6/composelab/routes"
+)
+
+//ErrResponseEnded is returned when writing to a response that has already ended
+var ErrResponseEnded = errors.New("response already ended")
+
+//ResponseIdle is the time after their last write that responses route handlers
+//wrote without ending are taken as done, handlers written before responses could be
+//ended write their response and return without ending it
+var ResponseIdle = 50 * time.Millisecond
+
+//Response wraps the http.ResponseWriter handed to route handlers, it records the
+//status written and signals through Wrote when the handler first writes and
+//through Done when the handler has ended the response
+type Response struct {
+	http.ResponseWriter
+	lock    sync.Mutex
+	status  int
+	wrote   bool
+	ended   bool
+	last    time.Time
+	written chan struct{}
+	done    chan struct{}
+}
+
+//NewResponse returns a new Response wrapping the given writer
+func NewResponse(rw http.ResponseWriter) *Response {
+	return &Response{
+		ResponseWriter: rw,
+		written:        make(chan struct{}),
+		done:           make(chan struct{}),
+	}
+}
+
+//touch records a write, signalling Wrote on the first, it is called with the lock held
+func (r *Response) touch() {
+	r.last = time.Now()
+
+	if !r.wrote {
+		r.wrote = true
+		close(r.written)
+	}
+}
+
+//WriteHeader writes the status code to the underline writer
+func (r *Response) WriteHeader(code int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.ended || r.wrote {
+		return
+	}
+
+	r.status = code
+	r.touch()
+	r.ResponseWriter.WriteHeader(code)
+}
+
+//Write writes the data to the underline writer
+func (r *Response) Write(b []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.ended {
+		return 0, ErrResponseEnded
+	}
+
+	if !r.wrote {
+		r.status = http.StatusOK
+	}
+
+	r.touch()
+	return r.ResponseWriter.Write(b)
+}
+
+//Status returns the status code written, it is 0 if none has been written
+func (r *Response) Status() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.status
+}
+
+//Written returns true if the status or any data has been written
+func (r *Response) Written() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.wrote
+}
+
+//Fail writes the status and body and ends the response if the route handlers have
+//not yet written anything, returning true if it did
+func (r *Response) Fail(code int, body []byte) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.ended || r.wrote {
+		return false
+	}
+
+	r.status = code
+	r.touch()
+	r.ResponseWriter.WriteHeader(code)
+	r.ResponseWriter.Write(body)
+	r.ended = true
+	close(r.done)
+	return true
+}
+
+//End marks the response as complete, writes after End are discarded
+func (r *Response) End() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.ended {
+		return
+	}
+
+	r.ended = true
+	close(r.done)
+}
+
+//Done returns a chan which is closed when the response is ended
+func (r *Response) Done() <-chan struct{} {
+	return r.done
+}
+
+//Wrote returns a chan which is closed when the status or any data is first written
+func (r *Response) Wrote() <-chan struct{} {
+	return r.written
+}
+
+//EndIdle ends the response once no write has been made to it for the idle duration
+//or the cancel chan is closed, returning when the response has ended
+func (r *Response) EndIdle(idle time.Duration, cancel <-chan struct{}) {
+	defer r.End()
+
+	for {
+		r.lock.Lock()
+		left := idle - time.Since(r.last)
+		r.lock.Unlock()
+
+		if left <= 0 {
+			return
+		}
+
+		timer := time.NewTimer(left)
+
+		select {
+		case <-r.done:
+		case <-cancel:
+		case <-timer.C:
+			continue
+		}
+
+		timer.Stop()
+		return
+	}
+}
+
+//EndResponse ends the writer if it is a *Response
+func EndResponse(rw http.ResponseWriter) {
+	if res, ok := rw.(*Response); ok {
+		res.End()
+	}
+}
+
+//replyResponse returns the 'Reply' meta answering requests through the response
+func replyResponse(res *Response) arch.Replier {
+	return func(status int, body []byte) error {
+		defer res.End()
+
+		if json.Valid(body) {
+			res.Header().Set("Content-Type", "application/json; charset=utf-8")
+		} else {
+			res.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		}
+
+		res.WriteHeader(status)
+		_, err := res.Write(body)
+		return err
+	}
+}
+
+//sessionReply returns the 'Reply' meta answering upstream session messages by
+//sending the body to the session
+func sessionReply(s Session) arch.Replier {
+	return func(_ int, body []byte) error {
+		return s.Send(body)
+	}
+}
+
+//pushReply returns the 'Reply' meta answering upstream messages of hybrid sessions
+//by pushing the body to the session on the path of the message
+func pushReply(s *HybridSession, path string) arch.Replier {
+	return func(_ int, body []byte) error {
+		return s.Push(path, body)
+	}
+}
+
+//haltResponse returns the 'OnHalt' callback answering requests stopped by route
+//middleware with the error body of the halt
+func haltResponse(res *Response, id string) func(error) {
+	return func(err error) {
+		defer res.End()
+
+		if err == routes.ErrHandled {
+			return
+		}
+
+		failResponse(res, arch.AsError(err), id)
+	}
+}
+
+//failResponse ends the response with the error body of the error stamped with the
+//request id, it returns false if the response was already written
+func failResponse(res *Response, err *arch.Error, id string) bool {
+	e := *err
+
+	if e.RequestID == "" {
+		e.RequestID = id
+	}
+
+	res.Header().Set("Content-Type", "application/json; charset=utf-8")
+	return res.Fail(e.Code, e.Body())
+}
+
+//errorReply returns the error body for a reply with an error status, bodies which
+//are not error bodies become the message of one stamped with the request id
+func errorReply(status int, body []byte, id string) []byte {
+	e, ok := arch.ParseError(body)
+
+	if !ok {
+		e = arch.StatusError(status, body).(*arch.Error)
+		e.RequestID = id
+	}
+
+	return e.Body()
+}
+
+//bufferedResponse is a http.ResponseWriter which keeps the status and body in memory
+//for transports that must transform the response before sending it
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newBufferedResponse() *bufferedResponse {
+	return &bufferedResponse{header: make(http.Header)}
+}
+
+//Header returns the headers of the response
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+//WriteHeader stores the status code
+func (b *bufferedResponse) WriteHeader(code int) {
+	if b.status == 0 {
+		b.status = code
+	}
+}
+
+//Write buffers the data
+func (b *bufferedResponse) Write(d []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.body.Write(d)
+}
@@ -1,91 +1,275 @@
 package services
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"net"
+	"sync"
 
 	"github.com/influx6/composelab/arch"
+	"github.com/influx6/composelab/routes"
 	"github.com/influx6/grids"
 )
 
-//UDPService provides the service struct for all udp services
+//ErrServiceEnded is returned by replies sent through a udp service which has ended
+var ErrServiceEnded = errors.New("udp service has ended")
+
+//UDPService provides the service struct for all udp services, its Server is set by
+//Dial and cleared by End under the service lock
 type UDPService struct {
 	*arch.Service
-	closer chan interface{}
-	buffer []byte
-	Addr   *net.UDPAddr
-	Server *net.UDPConn
+	closer  chan interface{}
+	buffer  []byte
+	Addr    *net.UDPAddr
+	Server  *net.UDPConn
+	lock    sync.Mutex
+	seq     uint64
+	pending map[uint64]*udpRequest
 }
 
-//ProcessDatagrams handles the process of datagrams
-func (u *UDPService) ProcessDatagrams() {
-	for {
-		select {
-		case <-u.closer:
-			log.Fatal("UDPServer is shutting down", u)
-			u.Server.Close()
-		default:
-			len, addr, err := u.Server.ReadFromUDP(u.buffer)
-
-			if err != nil {
-				log.Fatal("Error reading udp", err, addr)
-				return
-			}
+//udpRequest is a datagram issued to the service routes, each datagram gets an id
+//from the service as clients may reuse uuids or send none
+type udpRequest struct {
+	id      uint64
+	pack    *arch.UDPPack
+	dl      *routes.Deadline
+	service *UDPService
+}
 
-			data := u.buffer[:len]
+//answer marks the request as answered through the service, it returns false if the
+//request has already timed out and must not be answered again
+func (r *udpRequest) answer() bool {
+	u := r.service
 
-			upack := new(arch.UDPPack)
-			err = json.Unmarshal(data, upack)
+	u.lock.Lock()
+	_, ok := u.pending[r.id]
+	delete(u.pending, r.id)
+	u.lock.Unlock()
 
-			if err != nil {
-				log.Fatal("data is not a valid udp service packet", err)
-				return
+	r.dl.Stop()
+	return ok || !r.dl.Expired()
+}
+
+//server returns the connection the service listens on, nil once it has ended
+func (u *UDPService) server() *net.UDPConn {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.Server
+}
+
+//Reply sends the data back to the sender of the udp pack. Data too large for a
+//datagram is not sent, the sender gets a 500 error body saying so in its place and
+//arch.ErrDatagramTooLarge is returned. Replies after the service ended return
+//ErrServiceEnded
+func (u *UDPService) Reply(pack *arch.UDPPack, data []byte) error {
+	conn := u.server()
+
+	if conn == nil {
+		return ErrServiceEnded
+	}
+
+	ubinx, err := json.Marshal(arch.UDPPackFrom(pack, data, u.Addr))
+
+	if err != nil {
+		return err
+	}
+
+	if len(ubinx) > arch.MaxDatagram {
+		e := arch.NewError(500, fmt.Sprintf("reply of %d bytes is larger than a udp datagram carries", len(ubinx))).With("path", pack.Path)
+		e.RequestID = pack.UUID
+
+		if ubinx, err = json.Marshal(arch.UDPPackFrom(pack, e.Body(), u.Addr)); err != nil {
+			return err
+		}
+
+		conn.WriteTo(ubinx, pack.Address)
+		return arch.ErrDatagramTooLarge
+	}
+
+	_, err = conn.WriteTo(ubinx, pack.Address)
+	return err
+}
+
+//replier returns the 'Reply' meta answering the udp request, error statuses are
+//sent as error bodies
+func (u *UDPService) replier(req *udpRequest) arch.Replier {
+	return func(status int, body []byte) error {
+		if !req.answer() {
+			return ErrResponseEnded
+		}
+
+		if status >= 400 {
+			body = errorReply(status, body, req.pack.UUID)
+		}
+
+		return u.Reply(req.pack, body)
+	}
+}
+
+//haltReply returns the 'OnHalt' callback answering udp requests stopped by route middleware
+func (u *UDPService) haltReply(req *udpRequest) func(error) {
+	return func(err error) {
+		if err == routes.ErrHandled || !req.answer() {
+			return
+		}
+
+		ResponseError(req.pack, u, arch.AsError(err))
+	}
+}
+
+//awaitReply sends an error pack to the sender if the request deadline passes before
+//the route handlers reply through the request's 'Reply' meta. Requests taken by
+//WhenUDP handlers, which reply on their own, are not waited on
+func (u *UDPService) awaitReply(req *udpRequest) {
+	<-req.dl.Done()
+
+	u.lock.Lock()
+	_, ok := u.pending[req.id]
+	delete(u.pending, req.id)
+	u.lock.Unlock()
+
+	if !ok || !req.dl.Expired() {
+		return
+	}
+
+	pack := req.pack
+
+	u.RecordTimeout(pack.Path)
+	e := arch.NewError(504, "request timed out")
+	e.RequestID = pack.UUID
+
+	if err := u.Reply(pack, e.Body()); err != nil {
+		u.Logger().Error("unable to send udp timeout", arch.Fields{"path": pack.Path, "err": err})
+	}
+}
+
+//issue gives the datagram its id and deadline and issues it to the service routes
+func (u *UDPService) issue(pack *arch.UDPPack) {
+	u.lock.Lock()
+	u.seq++
+	req := &udpRequest{u.seq, pack, u.NewDeadline(context.Background()), u}
+	u.pending[req.id] = req
+	u.lock.Unlock()
+
+	go u.awaitReply(req)
+
+	u.Route.IssueRequestPath(pack.Path, func(p *grids.GridPacket) {
+		p.Set("Packet", pack)
+		p.Set("Datagram", req)
+		p.Set("Trace", pack.TraceContext())
+		p.Set("Deadline", req.dl)
+		p.Set("Context", req.dl.Context())
+		p.Set("Reply", u.replier(req))
+		p.Set("OnHalt", u.haltReply(req))
+	})
+}
+
+//ProcessDatagrams reads datagrams from the server and issues them as requests till
+//the service ends, datagrams which are not udp packs are logged and dropped. It
+//returns the error which stopped the server reading or nil once the service ends
+func (u *UDPService) ProcessDatagrams() error {
+	u.lock.Lock()
+	conn, closer := u.Server, u.closer
+	u.lock.Unlock()
+
+	if conn == nil {
+		return ErrServiceEnded
+	}
+
+	for {
+		len, addr, err := conn.ReadFromUDP(u.buffer)
+
+		if err != nil {
+			select {
+			case <-closer:
+				return nil
+			default:
 			}
 
-			upack.Address = addr
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				u.Logger().Warn("udp read failed", arch.Fields{"service": u.ServiceName(), "err": err})
+				continue
+			}
 
-			u.Route.IssueRequestPath(upack.Path, func(p *grids.GridPacket) {
-				p.Set("Packet", upack)
-			})
+			u.Logger().Error("udp server stopped reading", arch.Fields{"service": u.ServiceName(), "err": err})
+			return err
+		}
+
+		data := u.buffer[:len]
+
+		upack := new(arch.UDPPack)
 
+		if err := json.Unmarshal(data, upack); err != nil {
+			u.Logger().Warn("dropped invalid udp pack", arch.Fields{"service": u.ServiceName(), "addr": addr, "err": err})
+			continue
 		}
+
+		upack.Address = addr
+		u.issue(upack)
 	}
 }
 
-//Dial sets up the server and connections for the server
-func (u *UDPService) Dial() {
+//release stops waiting on the request to be answered through its 'Reply' meta
+func (u *UDPService) release(req *udpRequest) {
+	u.lock.Lock()
+	delete(u.pending, req.id)
+	u.lock.Unlock()
+
+	req.dl.Stop()
+}
+
+//Dial listens on the service address and processes datagrams till the service ends,
+//returning the error which stopped it listening or reading
+func (u *UDPService) Dial() error {
+	u.lock.Lock()
+
 	if u.Server != nil {
-		return
+		u.lock.Unlock()
+		return nil
 	}
 
 	con, err := net.ListenUDP("udp", u.Addr)
 
 	if err != nil {
-		log.Fatal("UDP Server dialing error", err, con, u.Addr)
-		return
+		u.lock.Unlock()
+		return err
 	}
 
+	u.closer = make(chan interface{})
 	u.Server = con
-	u.ProcessDatagrams()
+	u.lock.Unlock()
+
+	return u.ProcessDatagrams()
 }
 
-//End calls to disconnect the udp link
+//End stops the udp server and the deadlines of the requests awaiting replies, replies
+//sent after it return ErrServiceEnded
 func (u *UDPService) End() {
-	if u.Server == nil {
-		return
+	u.lock.Lock()
+	conn, closer := u.Server, u.closer
+	u.Server = nil
+	pending := u.pending
+	u.pending = make(map[uint64]*udpRequest)
+	u.lock.Unlock()
+
+	if conn != nil {
+		close(closer)
+		conn.Close()
 	}
 
-	u.closer <- 1
-	close(u.closer)
-	u.Server = nil
+	for _, req := range pending {
+		req.dl.Stop()
+	}
 }
 
 //UDPNorm type that specifies type descriptor for WhenUDP
 type UDPNorm func(*arch.LinkDescriptor, *arch.UDPPack)
 
-//WhenUDP provides a callback adaptor to check and collect udp data from a gridPacket
+//WhenUDP provides a callback adaptor to check and collect udp data from a gridPacket,
+//handlers taking the pack reply to it themselves so the service does not answer
+//the request with a 504 when its deadline passes
 var WhenUDP = func(checkDesc bool, g *grids.GridPacket, norm UDPNorm) {
 	if !g.Has("Packet") {
 		return
@@ -97,13 +281,17 @@ var WhenUDP = func(checkDesc bool, g *grids.GridPacket, norm UDPNorm) {
 		return
 	}
 
+	if req, ok := g.Get("Datagram").(*udpRequest); ok {
+		req.service.release(req)
+	}
+
 	if checkDesc {
 		dc := new(arch.LinkDescriptor)
 
 		err := json.Unmarshal(udp.Data, dc)
 
 		if err != nil {
-			log.Fatal("Error occur while parsing json data buffer ", err, udp.Data, udp)
+			arch.ReplyError(g, arch.NewError(400, "invalid link descriptor: "+err.Error()))
 			return
 		}
 
@@ -114,55 +302,52 @@ var WhenUDP = func(checkDesc bool, g *grids.GridPacket, norm UDPNorm) {
 	norm(nil, udp)
 }
 
-//ResponseError responds to a udp pack with a generic error map
-var ResponseError = func(u *arch.UDPPack, um *UDPService) {
-	ub := arch.UDPPackFrom(u, []byte("{ error:'not found!'}"), um.Addr)
-	ubinx, err := json.Marshal(ub)
+//ResponseError responds to a udp pack with the error body of the error stamped with
+//the uuid of the pack
+var ResponseError = func(u *arch.UDPPack, um *UDPService, err *arch.Error) {
+	e := *err
 
-	if err != nil {
-		log.Fatal("Unable to create udppack for: ", err, ubinx, ub)
-		return
+	if e.RequestID == "" {
+		e.RequestID = u.UUID
 	}
 
-	um.Server.WriteTo(ubinx, u.Address)
+	if err := um.Reply(u, e.Body()); err != nil {
+		um.Logger().Error("unable to reply to udp pack", arch.Fields{"path": u.Path, "err": err})
+	}
 }
 
 //ResponseSuccess response to a udp pack with a generic success map
 var ResponseSuccess = func(u *arch.UDPPack, um *UDPService) {
-	ub := arch.UDPPackFrom(u, []byte("{ state: 200, error: 'nil'}"), um.Addr)
-	ubinx, err := json.Marshal(ub)
-
-	if err != nil {
-		log.Fatal("Unable to create udppack for: ", err, ubinx, ub)
-		return
+	if err := um.Reply(u, []byte(`{"status":200}`)); err != nil {
+		um.Logger().Error("unable to reply to udp pack", arch.Fields{"path": u.Path, "err": err})
 	}
-
-	um.Server.WriteTo(ubinx, u.Address)
 }
 
 //NewUDPService returns a new udp service struct
-func NewUDPService(serviceName string, addr string, port int, master arch.Linkage) (*UDPService, error) {
+func NewUDPService(serviceName string, addr string, port int, master arch.Linkage, opts ...arch.ServiceOption) (*UDPService, error) {
 	uaddr, err := net.ResolveUDPAddr("udp4", fmt.Sprintf("%s:%d", addr, port))
 
 	if err != nil {
-		log.Fatal("Error occured creating udp address", uaddr, port, addr)
 		return nil, err
 	}
 
 	desc := arch.NewDescriptor("udp", serviceName, addr, uaddr.Port, uaddr.Zone, "udp4")
 
 	var um = &UDPService{
-		arch.NewService(desc, master),
+		arch.NewService(desc, master, opts...),
 		make(chan interface{}),
-		make([]byte, 1024),
+		make([]byte, 64<<10),
 		uaddr,
 		nil,
+		sync.Mutex{},
+		0,
+		make(map[uint64]*udpRequest),
 	}
 
 	reg, err := um.Select("register")
 
 	if err == nil {
-		reg.Terminal().Only(grids.ByPackets(func(g *grids.GridPacket) {
+		reg.Terminal().Only(routes.ByPackets(func(g *grids.GridPacket) {
 			WhenUDP(true, g, func(li *arch.LinkDescriptor, u *arch.UDPPack) {
 				um.Register(u.Service, li)
 				ResponseSuccess(u, um)
@@ -173,13 +358,13 @@ func NewUDPService(serviceName string, addr string, port int, master arch.Linkag
 	disc, err := um.Select("discover")
 
 	if err == nil {
-		disc.Terminal().Only(grids.ByPackets(func(g *grids.GridPacket) {
+		disc.Terminal().Only(routes.ByPackets(func(g *grids.GridPacket) {
 			WhenUDP(false, g, func(_ *arch.LinkDescriptor, u *arch.UDPPack) {
 				if um.HasRegistered(u.Service) {
 					li, err := um.GetServiceProvider(u.Service)
 
 					if err != nil {
-						log.Fatal("Unable to find service: ", u.Service, u)
+						ResponseError(u, um, arch.NewError(404, err.Error()).With("service", u.Service))
 						return
 					}
 
@@ -187,23 +372,46 @@ func NewUDPService(serviceName string, addr string, port int, master arch.Linkag
 					// bin, err := li.MarshalJSON()
 
 					if err != nil {
-						log.Fatal("Unable to jsonify service linkdescriptor: ", err, li)
+						um.Logger().Error("unable to encode link descriptor", arch.Fields{"service": u.Service, "err": err})
+						ResponseError(u, um, arch.AsError(err))
 						return
 					}
 
-					ub := arch.UDPPackFrom(u, bin, um.Addr)
-					ubinx, err := json.Marshal(ub)
-
-					if err != nil {
-						log.Fatal("Unable to create udppack for: ", err, li, ubinx, ub)
+					if err := um.Reply(u, bin); err != nil {
+						um.Logger().Error("unable to reply to udp pack", arch.Fields{"path": u.Path, "err": err})
 						return
 					}
 
-					um.Server.WriteTo(ubinx, u.Address)
-
 				} else {
-					log.Println("responding with error")
-					ResponseError(u, um)
+					um.Logger().Debug("discover of unknown service", arch.Fields{"service": u.Service})
+					ResponseError(u, um, arch.NewError(404, "no provider of "+u.Service).With("service", u.Service))
+				}
+			})
+		}))
+	}
+
+	provs, err := um.Select("providers")
+
+	if err == nil {
+		provs.Terminal().Only(routes.ByPackets(func(g *grids.GridPacket) {
+			WhenUDP(false, g, func(_ *arch.LinkDescriptor, u *arch.UDPPack) {
+				providers, err := um.GetServiceProviders(u.Service)
+
+				if err != nil {
+					ResponseError(u, um, arch.NewError(404, err.Error()).With("service", u.Service))
+					return
+				}
+
+				bin, err := json.Marshal(providers)
+
+				if err != nil {
+					um.Logger().Error("unable to encode service providers", arch.Fields{"service": u.Service, "err": err})
+					ResponseError(u, um, arch.AsError(err))
+					return
+				}
+
+				if err := um.Reply(u, bin); err != nil {
+					um.Logger().Error("unable to reply to udp pack", arch.Fields{"path": u.Path, "err": err})
 				}
 			})
 		}))
@@ -212,7 +420,7 @@ func NewUDPService(serviceName string, addr string, port int, master arch.Linkag
 	unreg, err := um.Select("unregister")
 
 	if err == nil {
-		unreg.Terminal().Only(grids.ByPackets(func(g *grids.GridPacket) {
+		unreg.Terminal().Only(routes.ByPackets(func(g *grids.GridPacket) {
 			WhenUDP(true, g, func(li *arch.LinkDescriptor, u *arch.UDPPack) {
 				um.Unregister(u.Service, li)
 				ResponseSuccess(u, um)
@@ -0,0 +1,156 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/franela/goblin"
+	"github.com/influx6/composelab/arch"
+	"github.com/influx6/composelab/routes"
+	"github.com/influx6/grids"
+)
+
+func TestUDPService(t *testing.T) {
+	g := goblin.Goblin(t)
+
+	us, _ := NewUDPService("dgram", "127.0.0.1", 3350, nil)
+	us.RequestTimeout = 50 * time.Millisecond
+	us.Branch("echo")
+	us.Branch("silent")
+	us.Branch("legacy")
+	us.Branch("big")
+
+	echo, _ := us.Select("echo")
+	echo.Terminal().Only(routes.ByPackets(func(p *grids.GridPacket) {
+		pack, _ := p.Get("Packet").(*arch.UDPPack)
+		arch.Reply(p, 200, pack.Data)
+	}))
+
+	legacy, _ := us.Select("legacy")
+	legacy.Terminal().Only(routes.ByPackets(func(p *grids.GridPacket) {
+		WhenUDP(false, p, func(_ *arch.LinkDescriptor, u *arch.UDPPack) {
+			time.AfterFunc(2*us.RequestTimeout, func() {
+				us.Reply(u, []byte(`"late"`))
+			})
+		})
+	}))
+
+	big, _ := us.Select("big")
+	big.Terminal().Only(routes.ByPackets(func(p *grids.GridPacket) {
+		arch.Reply(p, 200, make([]byte, arch.MaxDatagram))
+	}))
+
+	go us.Dial()
+	defer us.End()
+	time.Sleep(20 * time.Millisecond)
+
+	client, _ := net.DialUDP("udp4", nil, us.Addr)
+	defer client.Close()
+
+	send := func(path, uuid string, data []byte) {
+		ubinx, _ := json.Marshal(arch.NewUDPPack(path, "dgram", uuid, data, nil))
+		client.Write(ubinx)
+	}
+
+	read := func() *arch.UDPPack {
+		buf := make([]byte, 4096)
+		client.SetReadDeadline(time.Now().Add(time.Second))
+
+		n, err := client.Read(buf)
+
+		if err != nil {
+			return nil
+		}
+
+		pack := new(arch.UDPPack)
+		json.Unmarshal(buf[:n], pack)
+		return pack
+	}
+
+	g.Describe("UDPService", func() {
+
+		g.It("can datagrams sharing a uuid each be answered", func() {
+			send("dgram/echo", "same", []byte(`1`))
+			send("dgram/echo", "same", []byte(`2`))
+
+			seen := map[string]bool{}
+			for i := 0; i < 2; i++ {
+				pack := read()
+				g.Assert(pack != nil).IsTrue("reply was read")
+				g.Assert(pack.UUID).Eql("same")
+				seen[string(pack.Data)] = true
+			}
+
+			g.Assert(seen).Eql(map[string]bool{"1": true, "2": true})
+		})
+
+		g.It("can unanswered requests time out once", func() {
+			send("dgram/silent", "s1", nil)
+
+			pack := read()
+			g.Assert(pack != nil).IsTrue("timeout was read")
+
+			e, ok := arch.ParseError(pack.Data)
+			g.Assert(ok).IsTrue(string(pack.Data))
+			g.Assert(e.Code).Eql(504)
+			g.Assert(e.RequestID).Eql("s1")
+		})
+
+		g.It("can handlers replying through the server not be timed out", func() {
+			send("dgram/legacy", "l1", nil)
+
+			pack := read()
+			g.Assert(pack != nil).IsTrue("reply was read")
+			g.Assert(string(pack.Data)).Eql(`"late"`)
+		})
+
+		g.It("can replies too large for a datagram be refused with an error", func() {
+			send("dgram/big", "b1", nil)
+
+			pack := read()
+			g.Assert(pack != nil).IsTrue("error was read")
+
+			e, ok := arch.ParseError(pack.Data)
+			g.Assert(ok).IsTrue(string(pack.Data))
+			g.Assert(e.Code).Eql(500)
+			g.Assert(e.RequestID).Eql("b1")
+		})
+
+		g.It("can ending the service release its pending requests", func() {
+			other, _ := NewUDPService("other", "127.0.0.1", 3351, nil)
+			other.RequestTimeout = time.Minute
+
+			other.Server, _ = net.ListenUDP("udp4", other.Addr)
+			req := &udpRequest{1, arch.NewUDPPack("other/x", "other", "o1", nil, nil), other.NewDeadline(context.Background()), other}
+			other.pending[req.id] = req
+			other.End()
+
+			g.Assert(len(other.pending)).Eql(0)
+			g.Assert(req.dl.Context().Err() != nil).IsTrue("the deadline was stopped")
+			g.Assert(other.Reply(req.pack, nil)).Eql(ErrServiceEnded)
+		})
+
+		g.It("can replies racing the end of the service not fail on its server", func() {
+			racing, _ := NewUDPService("racing", "127.0.0.1", 3352, nil)
+			go racing.Dial()
+			time.Sleep(10 * time.Millisecond)
+
+			pack := arch.NewUDPPack("racing/x", "racing", "r1", nil, us.Addr)
+			done := make(chan struct{})
+
+			go func() {
+				defer close(done)
+				for i := 0; i < 200; i++ {
+					racing.Reply(pack, []byte(`1`))
+				}
+			}()
+
+			racing.End()
+			<-done
+			g.Assert(racing.Reply(pack, nil)).Eql(ErrServiceEnded)
+		})
+	})
+}
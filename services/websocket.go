@@ -0,0 +1,433 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/influx6/composelab/arch"
+	"github.com/influx6/composelab/metrics"
+	"github.com/influx6/composelab/routes"
+	"github.com/influx6/composelab/trace"
+	"github.com/influx6/grids"
+)
+
+//ErrQueueFull is returned when a connection's send queue can take no more messages
+var ErrQueueFull = errors.New("send queue full")
+
+//DefaultPongWait is the time allowed for a client to answer a ping before the
+//connection is seen as dead
+var DefaultPongWait = 60 * time.Second
+
+//DefaultQueueSize is the number of messages a connection can hold pending send
+var DefaultQueueSize = 64
+
+//writeWait is the time allowed for writing a single frame
+const writeWait = 10 * time.Second
+
+//Envelope represents a single websocket frame, requests from clients are routed by
+//their path and the response is sent back with the same uuid. A request's trace and
+//span ids place it within a trace and its response carries the trace and span ids of
+//the request's route span
+type Envelope struct {
+	Path   string          `json:"path"`
+	UUID   string          `json:"uuid"`
+	Data   json.RawMessage `json:"data,omitempty"`
+	Status int             `json:"status,omitempty"`
+	Trace  string          `json:"trace,omitempty"`
+	Span   string          `json:"span,omitempty"`
+}
+
+//WSConn represents a single websocket client connection, all frames are written
+//through its send queue by a single writer
+type WSConn struct {
+	id      string
+	conn    *websocket.Conn
+	req     *http.Request
+	send    chan []byte
+	closer  chan struct{}
+	once    sync.Once
+	session Session
+	service *WebSocketService
+}
+
+//ID returns the id of the connection
+func (w *WSConn) ID() string {
+	return w.id
+}
+
+//Send queues a raw frame for the client
+func (w *WSConn) Send(data []byte) error {
+	select {
+	case <-w.closer:
+		return ErrSessionClosed
+	default:
+	}
+
+	select {
+	case w.send <- data:
+		return nil
+	case <-w.closer:
+		return ErrSessionClosed
+	default:
+		return ErrQueueFull
+	}
+}
+
+//SendEnvelope queues the envelope for the client
+func (w *WSConn) SendEnvelope(env *Envelope) error {
+	bin, err := json.Marshal(env)
+
+	if err != nil {
+		return err
+	}
+
+	return w.Send(bin)
+}
+
+//Push sends a server initiated message to the client on the given path
+func (w *WSConn) Push(path string, data []byte) error {
+	return w.SendEnvelope(&Envelope{
+		Path: path,
+		UUID: uuid.New(),
+		Data: rawMessage(data),
+	})
+}
+
+//Close ends the connection and removes it from its service
+func (w *WSConn) Close() {
+	w.once.Do(func() {
+		close(w.closer)
+		w.conn.Close()
+		w.service.remove(w)
+	})
+}
+
+//Closed returns a chan which is closed when the connection ends
+func (w *WSConn) Closed() <-chan struct{} {
+	return w.closer
+}
+
+//readFrames reads every frame from the client and dispatches it into the service
+//routes till the connection fails or stops answering pings
+func (w *WSConn) readFrames() {
+	defer w.Close()
+
+	pongWait := w.service.pongWait()
+
+	w.conn.SetReadDeadline(time.Now().Add(pongWait))
+	w.conn.SetPongHandler(func(string) error {
+		return w.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	for {
+		_, data, err := w.conn.ReadMessage()
+
+		if err != nil {
+			return
+		}
+
+		env := new(Envelope)
+
+		if err := json.Unmarshal(data, env); err != nil || env.Path == "" {
+			w.SendEnvelope(&Envelope{
+				UUID:   env.UUID,
+				Status: http.StatusBadRequest,
+				Data:   errorReply(http.StatusBadRequest, []byte("invalid envelope"), env.UUID),
+			})
+			continue
+		}
+
+		w.dispatch(env)
+	}
+}
+
+//dispatch issues the envelope as a request to the service routes and sends the
+//response written by the route handlers back with the envelope's uuid
+func (w *WSConn) dispatch(env *Envelope) {
+	buf := newBufferedResponse()
+	res := NewResponse(buf)
+	dl := w.service.NewDeadline(context.Background())
+
+	var issued *grids.GridPacket
+
+	w.service.Route.IssueRequestPath(env.Path, func(pack *grids.GridPacket) {
+		issued = pack
+		pack.Set("RequestID", env.UUID)
+		pack.Set("Trace", trace.Context{TraceID: env.Trace, SpanID: env.Span})
+		pack.Set("Deadline", dl)
+		pack.Set("Context", dl.Context())
+		pack.Set("Reply", replyResponse(res))
+		pack.Set("OnHalt", haltResponse(res, env.UUID))
+		pack.Set("Ws", w)
+		pack.Set("Session", w.session)
+		pack.Set("Envelope", env)
+		pack.Set("Req", w.req)
+		pack.Set("Res", res)
+		pack.Set("Type", "json")
+		pack.Set("JSON", true)
+		pack.Set("Data", true)
+		pack.Set("Body", []byte(env.Data))
+	})
+
+	go func() {
+		select {
+		case <-res.Done():
+			dl.Stop()
+		case <-res.Wrote():
+			dl.Stop()
+			res.EndIdle(ResponseIdle, w.closer)
+		case <-dl.Done():
+			if dl.Expired() {
+				w.service.RecordTimeout(env.Path)
+				failResponse(res, arch.NewError(http.StatusGatewayTimeout, "request timed out"), env.UUID)
+			}
+			res.End()
+		case <-w.closer:
+			dl.Stop()
+			res.End()
+			return
+		}
+
+		tc := routes.PacketTrace(issued)
+
+		reply := &Envelope{
+			Path:   env.Path,
+			UUID:   env.UUID,
+			Status: buf.status,
+			Trace:  tc.TraceID,
+			Span:   tc.SpanID,
+		}
+
+		if buf.status >= 400 {
+			reply.Data = errorReply(buf.status, buf.body.Bytes(), env.UUID)
+		} else if buf.body.Len() > 0 {
+			reply.Data = rawMessage(buf.body.Bytes())
+		}
+
+		if err := w.SendEnvelope(reply); err != nil {
+			w.service.Logger().Warn("unable to send websocket reply", arch.Fields{"path": env.Path, "uuid": env.UUID, "err": err})
+		}
+	}()
+}
+
+//writeFrames writes the queued frames and pings the client till the connection ends
+func (w *WSConn) writeFrames() {
+	ticker := time.NewTicker(w.service.pingPeriod())
+
+	defer func() {
+		ticker.Stop()
+		w.Close()
+	}()
+
+	for {
+		select {
+		case <-w.closer:
+			return
+		case data := <-w.send:
+			w.conn.SetWriteDeadline(time.Now().Add(writeWait))
+
+			if err := w.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if err := w.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+//WebSocketService represents a service handling the websocket protocol, each frame
+//from a client is an Envelope routed by its path
+type WebSocketService struct {
+	*HTTPService
+	PongWait  time.Duration
+	QueueSize int
+	lock      sync.RWMutex
+	conns     map[string]*WSConn
+}
+
+//Dial beings the service connection
+func (w *WebSocketService) Dial() error {
+	return w.Serve(w.ProcessPackets)
+}
+
+//Drop closes all connections of the service
+func (w *WebSocketService) Drop() {
+	w.lock.RLock()
+	conns := make([]*WSConn, 0, len(w.conns))
+	for _, c := range w.conns {
+		conns = append(conns, c)
+	}
+	w.lock.RUnlock()
+
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+//ProcessPackets for WebSocketService upgrades the request and starts reading and writing
+//frames for the new connection
+func (w *WebSocketService) ProcessPackets(rw http.ResponseWriter, r *http.Request) {
+	if !isWebSocketRequest(r) {
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write([]byte("websocket upgrade required"))
+		return
+	}
+
+	u, err := webSocketUpgrade.Upgrade(rw, r, upgradeHeaders(r))
+
+	if err != nil {
+		w.Logger().Warn("websocket upgrade failed", arch.Fields{"path": r.URL.Path, "err": err})
+		return
+	}
+
+	w.Accept(u, r, uuid.New(), nil)
+}
+
+//Accept adds the websocket connection to the service with the given id and starts
+//its reader and writer, the session is handed to route handlers as the 'Session'
+//meta and when nil the connection itself is used
+func (w *WebSocketService) Accept(u *websocket.Conn, r *http.Request, id string, session Session) *WSConn {
+	con := &WSConn{
+		id:      id,
+		conn:    u,
+		req:     r,
+		send:    make(chan []byte, w.queueSize()),
+		closer:  make(chan struct{}),
+		session: session,
+		service: w,
+	}
+
+	if con.session == nil {
+		con.session = con
+	}
+
+	w.lock.Lock()
+	w.conns[con.id] = con
+	w.lock.Unlock()
+
+	go con.writeFrames()
+	go con.readFrames()
+
+	return con
+}
+
+//pongWait returns the PongWait of the service or DefaultPongWait if it is not above zero
+func (w *WebSocketService) pongWait() time.Duration {
+	if w.PongWait <= 0 {
+		return DefaultPongWait
+	}
+	return w.PongWait
+}
+
+//pingPeriod returns the time between pings, short enough for clients to answer
+//within the pong wait
+func (w *WebSocketService) pingPeriod() time.Duration {
+	wait := w.pongWait()
+
+	if period := wait * 9 / 10; period > 0 {
+		return period
+	}
+
+	return wait
+}
+
+//queueSize returns the QueueSize of the service or DefaultQueueSize if it is not above
+//zero
+func (w *WebSocketService) queueSize() int {
+	if w.QueueSize <= 0 {
+		return DefaultQueueSize
+	}
+	return w.QueueSize
+}
+
+func (w *WebSocketService) remove(c *WSConn) {
+	w.lock.Lock()
+	if w.conns[c.id] == c {
+		delete(w.conns, c.id)
+	}
+	w.lock.Unlock()
+}
+
+//Conn returns the connection with the given id
+func (w *WebSocketService) Conn(id string) (*WSConn, bool) {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+
+	c, ok := w.conns[id]
+	return c, ok
+}
+
+//Connections returns the total number of open connections
+func (w *WebSocketService) Connections() int {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+	return len(w.conns)
+}
+
+//Measure adds the metrics of the service to the registry as arch.Service does along
+//with a gauge of its open connections
+func (w *WebSocketService) Measure(reg *metrics.Registry) {
+	w.measureSessions(reg)
+	w.HTTPService.Measure(reg)
+}
+
+//ExposeMetrics measures the service with the registry as Measure does and exposes
+//the registry on the service's metrics path
+func (w *WebSocketService) ExposeMetrics(reg *metrics.Registry) {
+	w.measureSessions(reg)
+	w.HTTPService.ExposeMetrics(reg)
+}
+
+//measureSessions adds the gauge of open connections to the registry once
+func (w *WebSocketService) measureSessions(reg *metrics.Registry) {
+	if !w.Measures(reg, "websocket") {
+		return
+	}
+
+	name := w.ServiceName()
+
+	reg.GaugeFunc("composelab_websocket_sessions", "Open websocket connections of a service.", func(set func(float64, ...string)) {
+		set(float64(w.Connections()), name)
+	}, "service")
+}
+
+//Push sends a server initiated message on the given path to the connection with the id
+func (w *WebSocketService) Push(id, path string, data []byte) error {
+	c, ok := w.Conn(id)
+
+	if !ok {
+		return ErrSessionNotFound
+	}
+
+	return c.Push(path, data)
+}
+
+//Broadcast sends a server initiated message on the given path to every connection
+func (w *WebSocketService) Broadcast(path string, data []byte) {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+
+	for _, c := range w.conns {
+		if err := c.Push(path, data); err != nil {
+			w.Logger().Warn("unable to push to websocket", arch.Fields{"conn": c.ID(), "err": err})
+		}
+	}
+}
+
+//NewWebSocketService returns a new websocket based service struct
+func NewWebSocketService(service, addr string, port int, master arch.Linkage, opts ...arch.ServiceOption) *WebSocketService {
+	return &WebSocketService{
+		HTTPService: NewHTTPService(service, addr, port, master, opts...),
+		PongWait:    DefaultPongWait,
+		QueueSize:   DefaultQueueSize,
+		conns:       make(map[string]*WSConn),
+	}
+}
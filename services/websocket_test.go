@@ -0,0 +1,190 @@
+package services
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/franela/goblin"
+	"github.com/gorilla/websocket"
+	"github.com/influx6/composelab/arch"
+	"github.com/influx6/composelab/metrics"
+	"github.com/influx6/composelab/routes"
+	"github.com/influx6/grids"
+)
+
+//dialWS opens a websocket client to the test server
+func dialWS(srv *httptest.Server) (*websocket.Conn, error) {
+	c, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	return c, err
+}
+
+//readEnvelope reads the next envelope sent to the client
+func readEnvelope(c *websocket.Conn) (*Envelope, error) {
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	_, data, err := c.ReadMessage()
+
+	if err != nil {
+		return nil, err
+	}
+
+	env := new(Envelope)
+	return env, json.Unmarshal(data, env)
+}
+
+func TestWebSocketService(t *testing.T) {
+	g := goblin.Goblin(t)
+
+	ws := NewWebSocketService("chat", "127.0.0.1", 3330, nil)
+	ws.Branch("echo")
+	ws.Branch("legacy")
+
+	conns := make(chan *WSConn, 4)
+
+	echo, _ := ws.Select("echo")
+	echo.Terminal().Only(routes.ByPackets(func(p *grids.GridPacket) {
+		c, _ := p.Get("Ws").(*WSConn)
+		conns <- c
+
+		body, _ := p.Get("Body").([]byte)
+		arch.Reply(p, 200, body)
+	}))
+
+	legacy, _ := ws.Select("legacy")
+	legacy.Terminal().Only(routes.ByPackets(func(p *grids.GridPacket) {
+		res, _ := p.Get("Res").(*Response)
+		res.WriteHeader(202)
+		res.Write([]byte(`"queued"`))
+	}))
+
+	srv := httptest.NewServer(http.HandlerFunc(ws.ProcessPackets))
+	defer srv.Close()
+	defer ws.Drop()
+
+	g.Describe("WebSocketService", func() {
+
+		g.It("can plain requests be refused", func() {
+			rw := httptest.NewRecorder()
+			ws.ProcessPackets(rw, httptest.NewRequest("GET", "/chat", nil))
+			g.Assert(rw.Code).Eql(400)
+		})
+
+		g.It("can envelopes be routed by their path and answered with their uuid", func() {
+			c, err := dialWS(srv)
+			g.Assert(err == nil).IsTrue("client connected")
+			defer c.Close()
+
+			c.WriteJSON(&Envelope{Path: "chat/echo", UUID: "e1", Data: json.RawMessage(`{"a":1}`)})
+
+			env, err := readEnvelope(c)
+			g.Assert(err == nil).IsTrue("reply was read")
+			g.Assert(env.UUID).Eql("e1")
+			g.Assert(env.Path).Eql("chat/echo")
+			g.Assert(env.Status).Eql(200)
+			g.Assert(string(env.Data)).Eql(`{"a":1}`)
+
+			c.WriteJSON(&Envelope{Path: "chat/legacy", UUID: "e2"})
+
+			env, _ = readEnvelope(c)
+			g.Assert(env.UUID).Eql("e2")
+			g.Assert(env.Status).Eql(202)
+			g.Assert(string(env.Data)).Eql(`"queued"`)
+
+			c.WriteMessage(websocket.TextMessage, []byte("not json"))
+
+			env, _ = readEnvelope(c)
+			g.Assert(env.Status).Eql(400)
+		})
+
+		g.It("can messages be pushed to a connection", func() {
+			for len(conns) > 0 {
+				<-conns
+			}
+
+			c, _ := dialWS(srv)
+			defer c.Close()
+
+			c.WriteJSON(&Envelope{Path: "chat/echo", UUID: "p1"})
+			readEnvelope(c)
+
+			conn := <-conns
+			g.Assert(ws.Push(conn.ID(), "news", []byte(`{"hot":true}`)) == nil).IsTrue("message was pushed")
+			g.Assert(ws.Push("none", "news", nil)).Eql(ErrSessionNotFound)
+
+			env, err := readEnvelope(c)
+			g.Assert(err == nil).IsTrue("push was read")
+			g.Assert(env.Path).Eql("news")
+			g.Assert(env.UUID != "").IsTrue("pushes get their own uuid")
+			g.Assert(env.Status).Eql(0)
+			g.Assert(string(env.Data)).Eql(`{"hot":true}`)
+		})
+
+		g.It("can connections answering pings be kept and silent ones dropped", func() {
+			ws.PongWait = 100 * time.Millisecond
+			defer func() { ws.PongWait = DefaultPongWait }()
+
+			//let the connections of the earlier clients close
+			for i := 0; i < 100 && ws.Connections() > 0; i++ {
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			live, _ := dialWS(srv)
+			defer live.Close()
+
+			//the client answers pings while it reads
+			go func() {
+				for {
+					if _, _, err := live.ReadMessage(); err != nil {
+						return
+					}
+				}
+			}()
+
+			silent, _ := dialWS(srv)
+			defer silent.Close()
+
+			time.Sleep(30 * time.Millisecond)
+			g.Assert(ws.Connections()).Eql(2)
+
+			time.Sleep(300 * time.Millisecond)
+			g.Assert(ws.Connections()).Eql(1)
+		})
+
+		g.It("can the connections gauge be added once per registry", func() {
+			reg := metrics.NewRegistry()
+			ws.Measure(reg)
+			ws.ExposeMetrics(reg)
+			ws.ExposeMetrics(reg)
+
+			text := string(reg.Text())
+			g.Assert(strings.Count(text, `composelab_websocket_sessions{service="chat"}`)).Eql(1)
+		})
+
+		g.It("can pong waits not above zero fall back to the default", func() {
+			ws.PongWait = 0
+			defer func() { ws.PongWait = DefaultPongWait }()
+
+			g.Assert(ws.pongWait()).Eql(DefaultPongWait)
+			g.Assert(ws.pingPeriod() > 0).IsTrue()
+
+			ws.PongWait = time.Nanosecond
+			g.Assert(ws.pingPeriod()).Eql(time.Nanosecond)
+		})
+
+		g.It("can queue sizes not above zero fall back to the default", func() {
+			defer func() { ws.QueueSize = DefaultQueueSize }()
+
+			for _, size := range []int{0, -1} {
+				ws.QueueSize = size
+				g.Assert(ws.queueSize()).Eql(DefaultQueueSize)
+			}
+
+			ws.QueueSize = 2
+			g.Assert(ws.queueSize()).Eql(2)
+		})
+	})
+}
@@ -0,0 +1,57 @@
+package trace
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+)
+
+//JSONLines exports spans as a json object per line
+type JSONLines struct {
+	lock   sync.Mutex
+	w      io.Writer
+	closer io.Closer
+}
+
+//NewJSONLines returns an exporter writing spans to the writer
+func NewJSONLines(w io.Writer) *JSONLines {
+	return &JSONLines{w: w}
+}
+
+//OpenJSONLines returns an exporter appending spans to the file, which is created if
+//it does not exist
+func OpenJSONLines(file string) (*JSONLines, error) {
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &JSONLines{w: f, closer: f}, nil
+}
+
+//Export writes the span as a line of json
+func (j *JSONLines) Export(s *Span) error {
+	s.lock.Lock()
+	bin, err := json.Marshal(s)
+	s.lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	_, err = j.w.Write(append(bin, '\n'))
+	return err
+}
+
+//Close closes the file of an exporter returned by OpenJSONLines
+func (j *JSONLines) Close() error {
+	if j.closer == nil {
+		return nil
+	}
+	return j.closer.Close()
+}
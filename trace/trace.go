@@ -0,0 +1,272 @@
+//Package trace records spans for the requests services take and make so a single
+//request can be followed through a chain of services. A trace id is shared by every
+//span of a request and each span points to the span it was started under
+
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//TraceHeader and SpanHeader are the http headers a trace context is carried in
+const (
+	TraceHeader = "X-Trace-ID"
+	SpanHeader  = "X-Span-ID"
+)
+
+//The kinds of spans services record
+const (
+	//RouteSpan is recorded for every request dispatched into a service's routes
+	RouteSpan = "route"
+	//LinkSpan is recorded for every request sent to another service over a link
+	LinkSpan = "link"
+)
+
+//Context identifies a span within its trace, it is what is passed between services
+type Context struct {
+	TraceID string `json:"trace_id"`
+	SpanID  string `json:"span_id"`
+}
+
+//Valid returns true if the context belongs to a trace
+func (c Context) Valid() bool {
+	return c.TraceID != ""
+}
+
+//Inject sets the context as the trace headers
+func Inject(h http.Header, c Context) {
+	if !c.Valid() {
+		return
+	}
+
+	h.Set(TraceHeader, c.TraceID)
+	h.Set(SpanHeader, c.SpanID)
+}
+
+//Extract returns the context in the trace headers, it is not valid if there is none
+func Extract(h http.Header) Context {
+	return Context{h.Get(TraceHeader), h.Get(SpanHeader)}
+}
+
+//contextKey is the key a trace context is kept under in a context.Context
+type contextKey struct{}
+
+//NewContext returns a copy of the parent carrying the trace context
+func NewContext(parent context.Context, c Context) context.Context {
+	return context.WithValue(parent, contextKey{}, c)
+}
+
+//FromContext returns the trace context the context carries, it is not valid if there
+//is none
+func FromContext(ctx context.Context) Context {
+	c, _ := ctx.Value(contextKey{}).(Context)
+	return c
+}
+
+//Span records a single step of a request, a nil span ignores every call so code may
+//use the spans of a nil Tracer freely
+type Span struct {
+	TraceID  string            `json:"trace_id"`
+	SpanID   string            `json:"span_id"`
+	ParentID string            `json:"parent_id,omitempty"`
+	Service  string            `json:"service"`
+	Kind     string            `json:"kind"`
+	Name     string            `json:"name"`
+	Start    time.Time         `json:"start"`
+	Duration time.Duration     `json:"duration"`
+	Error    string            `json:"error,omitempty"`
+	Attrs    map[string]string `json:"attrs,omitempty"`
+	lock     sync.Mutex
+	once     sync.Once
+	tracer   *Tracer
+}
+
+//Context returns the context of the span for spans started under it
+func (s *Span) Context() Context {
+	if s == nil {
+		return Context{}
+	}
+	return Context{s.TraceID, s.SpanID}
+}
+
+//Set adds an attribute to the span
+func (s *Span) Set(key, value string) {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	if s.Attrs == nil {
+		s.Attrs = make(map[string]string)
+	}
+	s.Attrs[key] = value
+	s.lock.Unlock()
+}
+
+//Attr returns the attribute of the span with the key
+func (s *Span) Attr(key string) string {
+	if s == nil {
+		return ""
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.Attrs[key]
+}
+
+//Failed returns true if an error was recorded for the span
+func (s *Span) Failed() bool {
+	if s == nil {
+		return false
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.Error != ""
+}
+
+//Fail records the error the span's step failed with
+func (s *Span) Fail(err error) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.lock.Lock()
+	s.Error = err.Error()
+	s.lock.Unlock()
+}
+
+//Finish ends the span and hands it to its tracer's exporter, a span is only
+//exported the first time it is finished
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+
+	s.once.Do(func() {
+		s.lock.Lock()
+		s.Duration = time.Since(s.Start)
+		s.lock.Unlock()
+
+		s.tracer.export(s)
+	})
+}
+
+//Exporter sends finished spans where they are kept
+type Exporter interface {
+	Export(*Span) error
+}
+
+//ExporterFunc turns a function into an Exporter
+type ExporterFunc func(*Span) error
+
+//Export calls the function with the span
+func (fx ExporterFunc) Export(s *Span) error {
+	return fx(s)
+}
+
+//Tee returns an exporter handing every span to each of the exporters in turn, the
+//first error is returned once all have had the span
+func Tee(exporters ...Exporter) Exporter {
+	return ExporterFunc(func(s *Span) error {
+		var first error
+
+		for _, e := range exporters {
+			if e == nil {
+				continue
+			}
+
+			if err := e.Export(s); err != nil && first == nil {
+				first = err
+			}
+		}
+
+		return first
+	})
+}
+
+//Tracer starts the spans of a service and exports them once finished, a nil tracer
+//starts nil spans. Exporter is set before spans are started, AddExporter adds one
+//while spans may be exported
+type Tracer struct {
+	Service  string
+	Exporter Exporter
+	OnError  func(error)
+	lock     sync.RWMutex
+}
+
+//NewTracer returns a new tracer for the service
+func NewTracer(service string, exporter Exporter) *Tracer {
+	return &Tracer{Service: service, Exporter: exporter}
+}
+
+//Start starts a span of the kind under the parent, a span without a valid parent
+//starts a new trace
+func (t *Tracer) Start(kind, name string, parent Context) *Span {
+	if t == nil {
+		return nil
+	}
+
+	span := &Span{
+		TraceID:  parent.TraceID,
+		SpanID:   newID(8),
+		ParentID: parent.SpanID,
+		Service:  t.Service,
+		Kind:     kind,
+		Name:     name,
+		Start:    time.Now(),
+		tracer:   t,
+	}
+
+	if !parent.Valid() {
+		span.TraceID = newID(16)
+		span.ParentID = ""
+	}
+
+	return span
+}
+
+//AddExporter hands the spans of the tracer to the exporter as well as the exporters
+//it already has
+func (t *Tracer) AddExporter(exporter Exporter) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.Exporter == nil {
+		t.Exporter = exporter
+		return
+	}
+
+	t.Exporter = Tee(t.Exporter, exporter)
+}
+
+//export hands the span to the exporter, errors go to OnError if it is set
+func (t *Tracer) export(s *Span) {
+	if t == nil {
+		return
+	}
+
+	t.lock.RLock()
+	exporter := t.Exporter
+	t.lock.RUnlock()
+
+	if exporter == nil {
+		return
+	}
+
+	if err := exporter.Export(s); err != nil && t.OnError != nil {
+		t.OnError(err)
+	}
+}
+
+//newID returns a random hex id of the given number of bytes
+func newID(size int) string {
+	bin := make([]byte, size)
+	rand.Read(bin)
+	return hex.EncodeToString(bin)
+}
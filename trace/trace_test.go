@@ -0,0 +1,121 @@
+package trace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/franela/goblin"
+)
+
+func TestTrace(t *testing.T) {
+	g := goblin.Goblin(t)
+
+	g.Describe("Tracing", func() {
+
+		g.It("can spans share the trace of their parent", func() {
+			var buf bytes.Buffer
+			tracer := NewTracer("models", NewJSONLines(&buf))
+
+			root := tracer.Start(RouteSpan, "/models", Context{})
+			child := tracer.Start(LinkSpan, "views/render", root.Context())
+			child.Set("status", "200")
+			child.Finish()
+			root.Fail(errors.New("failed"))
+			root.Finish()
+			root.Finish()
+
+			g.Assert(root.ParentID).Eql("")
+			g.Assert(len(root.TraceID)).Eql(32)
+			g.Assert(child.TraceID).Eql(root.TraceID)
+			g.Assert(child.ParentID).Eql(root.SpanID)
+
+			lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+			g.Assert(len(lines)).Eql(2)
+
+			var span map[string]interface{}
+			g.Assert(json.Unmarshal([]byte(lines[1]), &span)).Eql(nil)
+			g.Assert(span["service"]).Eql("models")
+			g.Assert(span["kind"]).Eql(RouteSpan)
+			g.Assert(span["error"]).Eql("failed")
+		})
+
+		g.It("can a trace context go through http headers", func() {
+			h := make(http.Header)
+			Inject(h, Context{"t1", "s1"})
+			g.Assert(Extract(h)).Eql(Context{"t1", "s1"})
+
+			g.Assert(Extract(make(http.Header)).Valid()).IsFalse()
+		})
+
+		g.It("can exporters be added while spans are exported", func() {
+			var lock sync.Mutex
+			exported := 0
+			count := ExporterFunc(func(*Span) error {
+				lock.Lock()
+				exported++
+				lock.Unlock()
+				return nil
+			})
+
+			tracer := NewTracer("models", count)
+			done := make(chan struct{})
+
+			go func() {
+				defer close(done)
+				for i := 0; i < 100; i++ {
+					tracer.Start(RouteSpan, "/models", Context{}).Finish()
+				}
+			}()
+
+			tracer.AddExporter(count)
+			<-done
+
+			lock.Lock()
+			defer lock.Unlock()
+			g.Assert(exported >= 100).IsTrue("every span was exported")
+		})
+
+		g.It("can a trace context be carried by a context", func() {
+			ctx := NewContext(context.Background(), Context{"t1", "s1"})
+			g.Assert(FromContext(ctx)).Eql(Context{"t1", "s1"})
+			g.Assert(FromContext(context.Background()).Valid()).IsFalse()
+		})
+
+		g.It("can a nil tracer start spans which do nothing", func() {
+			var tracer *Tracer
+			span := tracer.Start(RouteSpan, "/models", Context{"t1", "s1"})
+			span.Set("status", "200")
+			span.Fail(errors.New("failed"))
+			span.Finish()
+
+			g.Assert(span == nil).IsTrue()
+			g.Assert(span.Context().Valid()).IsFalse()
+		})
+
+		g.It("can spans be appended to a file", func() {
+			dir, _ := ioutil.TempDir("", "trace")
+			defer os.RemoveAll(dir)
+
+			file := filepath.Join(dir, "spans.jsonl")
+
+			for i := 0; i < 2; i++ {
+				ex, err := OpenJSONLines(file)
+				g.Assert(err).Eql(nil)
+				NewTracer("models", ex).Start(RouteSpan, "/models", Context{}).Finish()
+				ex.Close()
+			}
+
+			data, _ := ioutil.ReadFile(file)
+			g.Assert(strings.Count(string(data), "\n")).Eql(2)
+		})
+	})
+}